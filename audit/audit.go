@@ -0,0 +1,211 @@
+////////////////////////////////////////////////////////////
+/*       审计日志，记录修改集群的api调用和节点的加入退出       */
+////////////////////////////////////////////////////////////
+
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/logging"
+)
+
+var logger = logging.Logger("audit")
+
+const (
+	API         = "api"
+	NodeJoin    = "node_join"
+	NodeLeave   = "node_leave"
+	NodeOffline = "node_offline"
+	NodeEvict   = "node_evict"
+)
+
+// 一条审计记录
+type Entry struct {
+	Time time.Time
+	Type string
+	// 记录该条日志的controller
+	Controller string
+
+	User         string `json:",omitempty"`
+	RequestId    string `json:",omitempty"`
+	RemoteAddr   string `json:",omitempty"`
+	ForwardedFor string `json:",omitempty"`
+	// 由其他controller转发时为其服务地址
+	Forwarded string `json:",omitempty"`
+	Method    string `json:",omitempty"`
+	Path      string `json:",omitempty"`
+
+	Container string `json:",omitempty"`
+	Image     string `json:",omitempty"`
+	Exec      string `json:",omitempty"`
+	Node      string `json:",omitempty"`
+	Role      string `json:",omitempty"`
+
+	Status int `json:",omitempty"`
+	// 处理时间，毫秒
+	Duration int64  `json:",omitempty"`
+	Message  string `json:",omitempty"`
+}
+
+// 追加写入的审计日志，超过大小后轮转
+type Logger struct {
+	sync.Mutex
+
+	path string
+	file *os.File
+	size int64
+}
+
+var AuditServer = &Logger{}
+
+// 打开日志文件，未打开时不记录
+func (this *Logger) Open(path string) error {
+	this.Lock()
+	defer this.Unlock()
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	this.path, this.file, this.size = path, file, info.Size()
+	return nil
+}
+
+// 写入一条记录，写入失败只输出日志，不影响请求处理
+func (this *Logger) Record(entry *Entry) {
+	this.Lock()
+	defer this.Unlock()
+
+	if this.file == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	entry.Controller = config.Get().ClusterAddress
+	line, err := json.Marshal(entry)
+	if err != nil {
+		logger.Error("Encode audit entry error", "error", err)
+		return
+	}
+	line = append(line, '\n')
+	if config.Get().Audit.MaxSize > 0 && this.size+int64(len(line)) > config.Get().Audit.MaxSize {
+		if err = this.rotate(); err != nil {
+			logger.Error("Rotate audit log error", "error", err)
+		}
+	}
+	n, err := this.file.Write(line)
+	this.size += int64(n)
+	if err != nil {
+		logger.Error("Write audit log error", "error", err)
+	}
+}
+
+// 当前文件改名为path.1，已有的依次后移，超出保留个数的删除；调用时需持有锁
+func (this *Logger) rotate() error {
+	if err := this.file.Close(); err != nil {
+		return err
+	}
+	for i := config.Get().Audit.MaxFiles; i > 0; i-- {
+		from := rotatedPath(this.path, i-1)
+		if i == config.Get().Audit.MaxFiles {
+			os.Remove(from)
+			continue
+		}
+		if err := os.Rename(from, rotatedPath(this.path, i)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	file, err := os.OpenFile(this.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		this.file = nil
+		return err
+	}
+	this.file, this.size = file, 0
+	return nil
+}
+
+func rotatedPath(path string, index int) string {
+	if index == 0 {
+		return path
+	}
+	return fmt.Sprintf("%s.%d", path, index)
+}
+
+// 查询条件，为空的字段不限制
+type Query struct {
+	Type      string
+	User      string
+	RequestId string
+	Node      string
+	Container string
+	Image     string
+	Since     time.Time
+	Until     time.Time
+	// 只返回最新的Limit条
+	Limit int
+}
+
+func (this *Query) match(entry *Entry) bool {
+	return (this.Type == "" || entry.Type == this.Type) &&
+		(this.User == "" || entry.User == this.User) &&
+		(this.RequestId == "" || entry.RequestId == this.RequestId) &&
+		(this.Node == "" || entry.Node == this.Node) &&
+		(this.Container == "" || entry.Container == this.Container) &&
+		(this.Image == "" || entry.Image == this.Image) &&
+		(this.Since.IsZero() || !entry.Time.Before(this.Since)) &&
+		(this.Until.IsZero() || entry.Time.Before(this.Until))
+}
+
+// 按时间顺序在所有轮转的文件中查询
+func (this *Logger) Search(query *Query) ([]*Entry, error) {
+	this.Lock()
+	path := this.path
+	this.Unlock()
+
+	if path == "" {
+		return nil, fmt.Errorf("Impossible: audit log is not enabled")
+	}
+	entries := []*Entry{}
+	for i := config.Get().Audit.MaxFiles - 1; i >= 0; i-- {
+		file, err := os.Open(rotatedPath(path, i))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			entry := &Entry{}
+			if err = json.Unmarshal(scanner.Bytes(), entry); err != nil {
+				continue
+			}
+			if query.match(entry) {
+				entries = append(entries, entry)
+				if query.Limit > 0 && len(entries) > query.Limit {
+					entries = entries[1:]
+				}
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,90 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hugb/beegecluster/config"
+)
+
+func setAuditLimits(t *testing.T, maxSize int64, maxFiles int) {
+	previous := config.Get()
+	c := *previous
+	c.ClusterAddress = "10.0.0.60:4244"
+	c.Audit.MaxSize, c.Audit.MaxFiles = maxSize, maxFiles
+	config.Set(&c)
+	t.Cleanup(func() { config.Set(previous) })
+}
+
+func openTestLogger(t *testing.T) (*Logger, string) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l := &Logger{}
+	if err := l.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.file.Close() })
+	return l, path
+}
+
+func TestRecordAndSearch(t *testing.T) {
+	setAuditLimits(t, 0, 1)
+	l, _ := openTestLogger(t)
+	started := time.Now()
+
+	l.Record(&Entry{Type: API, User: "root", Method: "POST", Path: "/containers/create", Container: "c1", Status: 201})
+	l.Record(&Entry{Type: NodeJoin, Node: "h1:4243", Role: config.DockerRoleName})
+	l.Record(&Entry{Type: API, User: "ops", Method: "DELETE", Path: "/containers/c1", Container: "c1", Status: 204})
+
+	entries, err := l.Search(&Query{Type: API})
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("expected two api entries, got %d %v", len(entries), err)
+	}
+	if entries[0].User != "root" || entries[1].User != "ops" || entries[0].Controller != "10.0.0.60:4244" {
+		t.Fatalf("expected entries in order with the controller, got %+v %+v", entries[0], entries[1])
+	}
+	if entries, _ = l.Search(&Query{Container: "c1", Limit: 1}); len(entries) != 1 || entries[0].User != "ops" {
+		t.Fatalf("expected only the latest entry, got %+v", entries)
+	}
+	if entries, _ = l.Search(&Query{Node: "h1:4243", Since: started}); len(entries) != 1 || entries[0].Type != NodeJoin {
+		t.Fatalf("expected membership entry, got %+v", entries)
+	}
+	if entries, _ = l.Search(&Query{Until: started.Add(-time.Second)}); len(entries) != 0 {
+		t.Fatalf("expected no entries before the start, got %d", len(entries))
+	}
+}
+
+func TestRotateKeepsMaxFiles(t *testing.T) {
+	setAuditLimits(t, 200, 3)
+	l, path := openTestLogger(t)
+
+	for i := 0; i < 20; i++ {
+		l.Record(&Entry{Type: API, User: "root", Path: "/containers/create"})
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := os.Stat(rotatedPath(path, i)); err != nil {
+			t.Fatalf("expected rotated file %d: %s", i, err)
+		}
+	}
+	if _, err := os.Stat(rotatedPath(path, 3)); !os.IsNotExist(err) {
+		t.Fatal("expected files beyond MaxFiles to be removed")
+	}
+	info, _ := os.Stat(path)
+	if info.Size() > 200 {
+		t.Fatalf("expected current file to stay within MaxSize, got %d", info.Size())
+	}
+	// 查询覆盖保留的所有文件
+	entries, err := l.Search(&Query{})
+	if err != nil || len(entries) < 3 || len(entries) >= 20 {
+		t.Fatalf("expected entries from the retained files, got %d %v", len(entries), err)
+	}
+}
+
+func TestDisabledLogger(t *testing.T) {
+	l := &Logger{}
+	l.Record(&Entry{Type: API})
+	if _, err := l.Search(&Query{}); err == nil {
+		t.Fatal("expected search without audit log to be an error")
+	}
+}
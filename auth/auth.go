@@ -0,0 +1,167 @@
+////////////////////////////////////////////////////////////
+/*        controller api的认证和基于角色的访问控制         */
+////////////////////////////////////////////////////////////
+
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	// follower转发请求时携带已认证的用户，需有集群密钥的签名
+	UserHeader = "X-Beege-User"
+)
+
+type Authorizer struct {
+	sync.RWMutex
+
+	// 为nil时不做认证
+	policy *Policy
+}
+
+var AuthServer = &Authorizer{}
+
+var versionPrefix = regexp.MustCompile(`^/v[0-9.]+/`)
+
+// 加载策略文件后开启认证
+func (this *Authorizer) LoadPolicy(path string) error {
+	policy, err := LoadPolicy(path)
+	if err != nil {
+		return err
+	}
+	this.SetPolicy(policy)
+	return nil
+}
+
+// 替换用户和角色，为nil时关闭认证
+func (this *Authorizer) SetPolicy(policy *Policy) {
+	this.Lock()
+	defer this.Unlock()
+
+	this.policy = policy
+}
+
+func (this *Authorizer) Enabled() bool {
+	this.RLock()
+	defer this.RUnlock()
+
+	return this.policy != nil
+}
+
+// 认证请求的用户，未开启认证时返回nil
+func (this *Authorizer) Authenticate(r *http.Request) (*User, error) {
+	this.RLock()
+	defer this.RUnlock()
+
+	if this.policy == nil {
+		return nil, nil
+	}
+
+	// 其他controller转发的请求已经认证，签名无效时忽略携带的用户，按原始凭据认证
+	if name := r.Header.Get(UserHeader); name != "" && VerifiedForward(r) {
+		if user := this.lookup(name); user != nil {
+			return user, nil
+		}
+		return nil, fmt.Errorf("Unauthorized: unknown user %s", name)
+	}
+
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token := strings.TrimPrefix(header, "Bearer ")
+		for _, user := range this.policy.Users {
+			if user.Token != "" && subtle.ConstantTimeCompare([]byte(user.Token), []byte(token)) == 1 {
+				return user, nil
+			}
+		}
+		return nil, fmt.Errorf("Unauthorized: invalid token")
+	}
+
+	if name, password, ok := r.BasicAuth(); ok {
+		sum := sha256.Sum256([]byte(password))
+		user := this.lookup(name)
+		if user == nil || user.PasswordSha256 == "" ||
+			subtle.ConstantTimeCompare([]byte(user.PasswordSha256), []byte(hex.EncodeToString(sum[:]))) != 1 {
+			return nil, fmt.Errorf("Wrong login/password")
+		}
+		return user, nil
+	}
+
+	// 开启tlsverify时客户端证书已由CA验证
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		name := r.TLS.PeerCertificates[0].Subject.CommonName
+		if user := this.lookup(name); user != nil {
+			return user, nil
+		}
+		return nil, fmt.Errorf("Unauthorized: unknown certificate %s", name)
+	}
+
+	return nil, fmt.Errorf("Unauthorized: authentication required")
+}
+
+// 检查用户的角色是否允许该请求
+func (this *Authorizer) Authorize(user *User, method, path string) error {
+	this.RLock()
+	defer this.RUnlock()
+
+	if this.policy == nil {
+		return nil
+	}
+	if user == nil {
+		return fmt.Errorf("Unauthorized: authentication required")
+	}
+	if match := versionPrefix.FindString(path); match != "" {
+		path = path[len(match)-1:]
+	}
+	for _, role := range user.Roles {
+		for _, permission := range this.policy.Roles[role] {
+			if permission.Allow(method, path) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("Forbidden: user %s is not allowed to %s %s", user.Name, method, path)
+}
+
+// 租户的配额，不是已知租户时返回nil
+func (this *Authorizer) Quota(tenant string) *Quota {
+	this.RLock()
+	defer this.RUnlock()
+
+	if this.policy == nil {
+		return nil
+	}
+	return this.policy.Tenants[tenant]
+}
+
+// 调用时需持有锁
+func (this *Authorizer) lookup(name string) *User {
+	for _, user := range this.policy.Users {
+		if user.Name == name {
+			return user
+		}
+	}
+	return nil
+}
+
+type contextKey struct{}
+
+// 在请求的context中保存已认证的用户
+func WithUser(r *http.Request, user *User) *http.Request {
+	if user == nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), contextKey{}, user))
+}
+
+func UserFromRequest(r *http.Request) *User {
+	user, _ := r.Context().Value(contextKey{}).(*User)
+	return user
+}
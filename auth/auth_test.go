@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hugb/beegecluster/config"
+)
+
+const testPolicy = `{
+	"Users": [
+		{"Name": "root", "Token": "root-token", "Roles": ["admin"]},
+		{"Name": "viewer", "Token": "viewer-token", "Roles": ["readonly"]},
+		{"Name": "ops", "Token": "ops-token", "Roles": ["operator"]}
+	]
+}`
+
+func loadTestPolicy(t *testing.T, content string) *Authorizer {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	authorizer := &Authorizer{}
+	if err := authorizer.LoadPolicy(path); err != nil {
+		t.Fatal(err)
+	}
+	return authorizer
+}
+
+func setClusterSecret(t *testing.T, secret string) {
+	previous := config.Get()
+	c := *previous
+	c.Auth.ClusterSecret = secret
+	config.Set(&c)
+	t.Cleanup(func() { config.Set(previous) })
+}
+
+func TestAuthenticateToken(t *testing.T) {
+	authorizer := loadTestPolicy(t, testPolicy)
+
+	r := httptest.NewRequest("GET", "/containers/json", nil)
+	r.Header.Set("Authorization", "Bearer viewer-token")
+	user, err := authorizer.Authenticate(r)
+	if err != nil || user == nil || user.Name != "viewer" {
+		t.Fatalf("expected viewer, got %v %v", user, err)
+	}
+
+	r.Header.Set("Authorization", "Bearer wrong")
+	if _, err = authorizer.Authenticate(r); err == nil {
+		t.Fatal("expected invalid token to be rejected")
+	}
+}
+
+func TestForwardedUserRequiresSignature(t *testing.T) {
+	authorizer := loadTestPolicy(t, testPolicy)
+	setClusterSecret(t, "0123456789abcdef")
+
+	// 伪造的转发头不能冒充用户，按原始凭据认证
+	r := httptest.NewRequest("POST", "/containers/create", nil)
+	r.Header.Set(ForwardedHeader, "10.0.0.1:4243")
+	r.Header.Set(UserHeader, "root")
+	r.Header.Set("Authorization", "Bearer viewer-token")
+	user, err := authorizer.Authenticate(r)
+	if err != nil || user.Name != "viewer" {
+		t.Fatalf("expected unsigned user header to be ignored, got %v %v", user, err)
+	}
+
+	r = httptest.NewRequest("POST", "/v1.10/containers/create", nil)
+	SignForward(r, "10.0.0.1:4243", &User{Name: "root"})
+	if !VerifiedForward(r) {
+		t.Fatal("expected signed forward to verify")
+	}
+	if user, err = authorizer.Authenticate(r); err != nil || user.Name != "root" {
+		t.Fatalf("expected root, got %v %v", user, err)
+	}
+
+	// 修改用户或路径后签名失效
+	r.Header.Set(UserHeader, "ops")
+	if VerifiedForward(r) {
+		t.Fatal("expected tampered user to fail verification")
+	}
+	r.Header.Set(UserHeader, "root")
+	r.URL.Path = "/containers/c1/kill"
+	if VerifiedForward(r) {
+		t.Fatal("expected tampered path to fail verification")
+	}
+
+	// 密钥不同的controller签名无效
+	r = httptest.NewRequest("GET", "/info", nil)
+	SignForward(r, "10.0.0.1:4243", &User{Name: "root"})
+	setClusterSecret(t, "fedcba9876543210")
+	if VerifiedForward(r) {
+		t.Fatal("expected signature with another secret to fail")
+	}
+}
+
+func TestSignForwardWithoutSecret(t *testing.T) {
+	setClusterSecret(t, "")
+
+	r := httptest.NewRequest("GET", "/info", nil)
+	r.Header.Set(UserHeader, "root")
+	SignForward(r, "10.0.0.1:4243", &User{Name: "root"})
+	if r.Header.Get(UserHeader) != "" || VerifiedForward(r) {
+		t.Fatal("expected no trusted user without cluster secret")
+	}
+	if r.Header.Get(ForwardedHeader) != "10.0.0.1:4243" {
+		t.Fatal("expected forwarded header to be set")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	authorizer := loadTestPolicy(t, testPolicy)
+	ops := &User{Name: "ops", Roles: []string{"operator"}}
+
+	if err := authorizer.Authorize(ops, "POST", "/v1.10/containers/create"); err != nil {
+		t.Fatal(err)
+	}
+	if err := authorizer.Authorize(ops, "DELETE", "/images/busybox"); err == nil {
+		t.Fatal("expected operator to be forbidden to delete images")
+	}
+	if err := authorizer.Authorize(nil, "GET", "/info"); err == nil {
+		t.Fatal("expected anonymous request to be rejected")
+	}
+}
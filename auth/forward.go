@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hugb/beegecluster/config"
+)
+
+const (
+	// 转发请求的controller
+	ForwardedHeader = "X-Beege-Forwarded"
+
+	forwardTimeHeader      = "X-Beege-Forward-Time"
+	forwardSignatureHeader = "X-Beege-Forward-Signature"
+
+	// 签名的有效期，前后各允许的时钟偏差
+	forwardSignatureTTL = time.Minute
+)
+
+// 转发给leader前用集群密钥签名转发的controller和已认证的用户；
+// 开启认证时配置检查保证已设置密钥，未开启时不携带用户
+func SignForward(r *http.Request, from string, user *User) {
+	r.Header.Set(ForwardedHeader, from)
+	r.Header.Del(UserHeader)
+	r.Header.Del(forwardTimeHeader)
+	r.Header.Del(forwardSignatureHeader)
+
+	secret := config.Get().Auth.ClusterSecret
+	if secret == "" {
+		return
+	}
+	name := ""
+	if user != nil {
+		name = user.Name
+		r.Header.Set(UserHeader, name)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	r.Header.Set(forwardTimeHeader, timestamp)
+	r.Header.Set(forwardSignatureHeader, forwardSignature(secret, from, name, r.Method, r.URL.Path, timestamp))
+}
+
+// 请求是否由持有集群密钥的controller转发，签名过期或不匹配时返回false
+func VerifiedForward(r *http.Request) bool {
+	secret := config.Get().Auth.ClusterSecret
+	from := r.Header.Get(ForwardedHeader)
+	signature := r.Header.Get(forwardSignatureHeader)
+	if secret == "" || from == "" || signature == "" {
+		return false
+	}
+	timestamp := r.Header.Get(forwardTimeHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(seconds, 0)); age > forwardSignatureTTL || age < -forwardSignatureTTL {
+		return false
+	}
+	expected := forwardSignature(secret, from, r.Header.Get(UserHeader), r.Method, r.URL.Path, timestamp)
+	return hmac.Equal([]byte(signature), []byte(expected))
+}
+
+// 签名不包含版本前缀，leader按docker的版本改写路径后仍然有效
+func forwardSignature(secret, from, user, method, path, timestamp string) string {
+	if match := versionPrefix.FindString(path); match != "" {
+		path = path[len(match)-1:]
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join([]string{from, user, method, path, timestamp}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// 用户可以通过客户端证书的CN、token或用户名密码认证，
+// 密码保存为sha256的十六进制
+type User struct {
+	Name           string
+	Token          string
+	PasswordSha256 string
+	Roles          []string
+	// 所属租户，为空时可以访问所有租户的资源
+	Tenant string
+}
+
+// 允许的请求，Methods为空时允许所有方法，Path为匹配去掉版本前缀后路径的正则，
+// 同时匹配Exclude的路径不允许
+type Permission struct {
+	Methods []string
+	Path    string
+	Exclude string `json:",omitempty"`
+
+	pattern *regexp.Regexp
+	exclude *regexp.Regexp
+}
+
+// 租户配额，为0时不限制；限制内存时创建容器必须指定内存
+type Quota struct {
+	Containers int
+	Memory     int64
+}
+
+type Policy struct {
+	Users   []*User
+	Roles   map[string][]*Permission
+	Tenants map[string]*Quota
+}
+
+const (
+	// 集群配置和审计日志只有管理员可以查看
+	adminOnlyPaths = "/admin/.*|/audit"
+	// 以GET建立的交互式连接可以向容器写入，只读用户不能使用
+	interactivePaths = "/containers/[^/]+/attach/ws"
+)
+
+// 内置角色，可在策略文件中覆盖；加载时复制后使用，不会被修改
+var builtinRoles = map[string][]*Permission{
+	"admin": {
+		{Path: ".*"},
+	},
+	"operator": {
+		{Methods: []string{"GET", "HEAD"}, Path: ".*", Exclude: adminOnlyPaths},
+		{Methods: []string{"POST"}, Path: "/containers/create"},
+		{Methods: []string{"POST"}, Path: "/containers/[^/]+/(start|stop|restart|kill|pause|unpause|wait|attach|exec|resize)"},
+		{Methods: []string{"POST"}, Path: "/exec/[^/]+/(start|resize)"},
+		{Methods: []string{"DELETE"}, Path: "/containers/[^/]+"},
+	},
+	"readonly": {
+		{Methods: []string{"GET", "HEAD"}, Path: ".*", Exclude: adminOnlyPaths + "|" + interactivePaths},
+	},
+}
+
+// 从json文件加载用户和角色
+func LoadPolicy(path string) (*Policy, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	policy := &Policy{}
+	if err = json.Unmarshal(content, policy); err != nil {
+		return nil, err
+	}
+	// 在副本上编译，正在使用的策略和内置角色不受影响
+	roles := make(map[string][]*Permission)
+	for name, permissions := range builtinRoles {
+		roles[name] = copyPermissions(permissions)
+	}
+	for name, permissions := range policy.Roles {
+		roles[name] = permissions
+	}
+	policy.Roles = roles
+	if policy.Tenants == nil {
+		policy.Tenants = make(map[string]*Quota)
+	}
+	for name, permissions := range policy.Roles {
+		for _, permission := range permissions {
+			if err = permission.compile(); err != nil {
+				return nil, fmt.Errorf("Bad parameter: role %s: %s", name, err)
+			}
+		}
+	}
+	names := make(map[string]bool)
+	for _, user := range policy.Users {
+		if user.Name == "" {
+			return nil, fmt.Errorf("Bad parameter: user name is required")
+		}
+		if names[user.Name] {
+			return nil, fmt.Errorf("Bad parameter: duplicate user %s", user.Name)
+		}
+		names[user.Name] = true
+		user.PasswordSha256 = strings.ToLower(user.PasswordSha256)
+		if user.Tenant != "" && policy.Tenants[user.Tenant] == nil {
+			policy.Tenants[user.Tenant] = &Quota{}
+		}
+		for _, role := range user.Roles {
+			if _, ok := policy.Roles[role]; !ok {
+				return nil, fmt.Errorf("Bad parameter: user %s has unknown role %s", user.Name, role)
+			}
+		}
+	}
+	return policy, nil
+}
+
+func copyPermissions(permissions []*Permission) []*Permission {
+	copies := make([]*Permission, len(permissions))
+	for i, permission := range permissions {
+		copies[i] = &Permission{
+			Methods: append([]string(nil), permission.Methods...),
+			Path:    permission.Path,
+			Exclude: permission.Exclude,
+		}
+	}
+	return copies
+}
+
+func (this *Permission) compile() error {
+	var err error
+	if this.pattern, err = regexp.Compile("^(" + this.Path + ")$"); err != nil {
+		return fmt.Errorf("path %s: %s", this.Path, err)
+	}
+	if this.Exclude != "" {
+		if this.exclude, err = regexp.Compile("^(" + this.Exclude + ")$"); err != nil {
+			return fmt.Errorf("exclude %s: %s", this.Exclude, err)
+		}
+	}
+	return nil
+}
+
+func (this *Permission) Allow(method, path string) bool {
+	if len(this.Methods) > 0 {
+		allowed := false
+		for _, m := range this.Methods {
+			if strings.EqualFold(m, method) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	if this.exclude != nil && this.exclude.MatchString(path) {
+		return false
+	}
+	return this.pattern.MatchString(path)
+}
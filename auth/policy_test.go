@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuiltinRolesHideAdminPaths(t *testing.T) {
+	authorizer := loadTestPolicy(t, testPolicy)
+	viewer := &User{Name: "viewer", Roles: []string{"readonly"}}
+	ops := &User{Name: "ops", Roles: []string{"operator"}}
+	root := &User{Name: "root", Roles: []string{"admin"}}
+
+	for _, path := range []string{"/admin/config", "/v1.10/admin/loglevel", "/audit"} {
+		if err := authorizer.Authorize(viewer, "GET", path); err == nil {
+			t.Errorf("expected readonly to be forbidden to GET %s", path)
+		}
+		if err := authorizer.Authorize(ops, "GET", path); err == nil {
+			t.Errorf("expected operator to be forbidden to GET %s", path)
+		}
+		if err := authorizer.Authorize(root, "GET", path); err != nil {
+			t.Errorf("expected admin to GET %s: %s", path, err)
+		}
+	}
+	for _, path := range []string{"/containers/json", "/auditing", "/nodes"} {
+		if err := authorizer.Authorize(viewer, "GET", path); err != nil {
+			t.Errorf("expected readonly to GET %s: %s", path, err)
+		}
+	}
+}
+
+func TestReadonlyCannotAttach(t *testing.T) {
+	authorizer := loadTestPolicy(t, testPolicy)
+	viewer := &User{Name: "viewer", Roles: []string{"readonly"}}
+	ops := &User{Name: "ops", Roles: []string{"operator"}}
+
+	for _, path := range []string{"/containers/abc/attach/ws", "/v1.12/containers/abc/attach/ws"} {
+		if err := authorizer.Authorize(viewer, "GET", path); err == nil {
+			t.Errorf("expected readonly to be forbidden to GET %s", path)
+		}
+		if err := authorizer.Authorize(ops, "GET", path); err != nil {
+			t.Errorf("expected operator to GET %s: %s", path, err)
+		}
+	}
+	for _, path := range []string{"/containers/abc/attach", "/exec/abc/start"} {
+		if err := authorizer.Authorize(viewer, "POST", path); err == nil {
+			t.Errorf("expected readonly to be forbidden to POST %s", path)
+		}
+	}
+	if err := authorizer.Authorize(viewer, "GET", "/containers/abc/logs"); err != nil {
+		t.Errorf("expected readonly to read logs: %s", err)
+	}
+}
+
+func TestLoadPolicyDoesNotModifyBuiltinRoles(t *testing.T) {
+	first := loadTestPolicy(t, testPolicy)
+	loadTestPolicy(t, testPolicy)
+
+	for name, permissions := range builtinRoles {
+		for _, permission := range permissions {
+			if permission.pattern != nil || permission.exclude != nil {
+				t.Fatalf("builtin role %s was compiled in place", name)
+			}
+		}
+	}
+	if first.policy.Roles["readonly"][0] == builtinRoles["readonly"][0] {
+		t.Fatal("expected policy to use a copy of the builtin roles")
+	}
+}
+
+func TestFailedLoadKeepsPolicy(t *testing.T) {
+	authorizer := loadTestPolicy(t, testPolicy)
+	policy := authorizer.policy
+
+	path := filepath.Join(t.TempDir(), "bad.json")
+	content := `{"Roles": {"broken": [{"Path": "("}]}, "Users": [{"Name": "x", "Roles": ["broken"]}]}`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := authorizer.LoadPolicy(path); err == nil {
+		t.Fatal("expected invalid pattern to fail")
+	}
+	if authorizer.policy != policy {
+		t.Fatal("expected failed load to keep the current policy")
+	}
+	if err := authorizer.Authorize(&User{Name: "viewer", Roles: []string{"readonly"}}, "GET", "/info"); err != nil {
+		t.Fatal(err)
+	}
+}
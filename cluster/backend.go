@@ -0,0 +1,128 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/dotcloud/docker/engine"
+	dockerUtils "github.com/dotcloud/docker/utils"
+
+	"github.com/hugb/beegecluster/resource"
+)
+
+// docker主机上的数据来源：链接到dockerd时通过engine执行job，
+// 独立运行的agent通过docker的远程api读取
+type DockerBackend interface {
+	// 镜像和容器列表，json数组，与远程api的返回相同
+	Images() ([]byte, error)
+	Containers() ([]byte, error)
+	Version() (*resource.Version, error)
+	// 从since开始持续接收事件，直到事件流结束
+	Events(since int64, handle func(m *dockerUtils.JSONMessage)) error
+}
+
+// 远程api返回的镜像列表中需要的字段，engine的images job输出相同的json
+type apiImage struct {
+	Id       string
+	Created  int64
+	RepoTags []string
+}
+
+// 远程api返回的容器列表中需要的字段，租户由标签恢复
+type apiContainer struct {
+	Id      string
+	Created int64
+	Labels  map[string]string
+}
+
+// 链接到dockerd时使用的engine
+type engineBackend struct {
+	eng *engine.Engine
+}
+
+func NewEngineBackend(eng *engine.Engine) DockerBackend {
+	return &engineBackend{eng: eng}
+}
+
+func (this *engineBackend) Images() ([]byte, error) {
+	job := this.eng.Job("images")
+	job.Setenv("filter", "")
+	job.Setenv("all", "0")
+	return readJob(job)
+}
+
+func (this *engineBackend) Containers() ([]byte, error) {
+	job := this.eng.Job("containers")
+	job.Setenv("all", "1")
+	return readJob(job)
+}
+
+// 执行job并读取全部输出
+func readJob(job *engine.Job) ([]byte, error) {
+	src, err := job.Stdout.AddPipe()
+	if err != nil {
+		return nil, err
+	}
+	type result struct {
+		content []byte
+		err     error
+	}
+	// job结束时关闭管道
+	done := make(chan result, 1)
+	go func() {
+		content, err := ioutil.ReadAll(src)
+		done <- result{content, err}
+	}()
+	if err = job.Run(); err != nil {
+		return nil, err
+	}
+	r := <-done
+	return r.content, r.err
+}
+
+func (this *engineBackend) Version() (*resource.Version, error) {
+	job := this.eng.Job("version")
+	env, err := job.Stdout.AddEnv()
+	if err != nil {
+		return nil, err
+	}
+	if err = job.Run(); err != nil {
+		return nil, err
+	}
+	version := &resource.Version{
+		Version:       env.Get("Version"),
+		ApiVersion:    env.Get("ApiVersion"),
+		MinAPIVersion: env.Get("MinAPIVersion"),
+		GitCommit:     env.Get("GitCommit"),
+		GoVersion:     env.Get("GoVersion"),
+		Os:            env.Get("Os"),
+		Arch:          env.Get("Arch"),
+		KernelVersion: env.Get("KernelVersion"),
+	}
+	return version, nil
+}
+
+func (this *engineBackend) Events(since int64, handle func(m *dockerUtils.JSONMessage)) error {
+	job := this.eng.Job("events", "DockerAgent")
+	// 从当前到3214080000（100年）后,^-^100后我都不在了，还需要考虑超时吗
+	job.Setenv("since", fmt.Sprint(since))
+	job.Setenv("until", fmt.Sprint(since+3214080000))
+	reader, err := job.Stdout.AddPipe()
+	if err != nil {
+		return err
+	}
+	// 从管道读取事件数据
+	go func() {
+		dec := json.NewDecoder(reader)
+		for {
+			m := &dockerUtils.JSONMessage{}
+			if err := dec.Decode(m); err != nil {
+				logger.Error("Streaming events error", "error", err)
+				break
+			}
+			handle(m)
+		}
+	}()
+	return job.Run()
+}
@@ -3,16 +3,10 @@ package cluster
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net"
-	"os"
-	gosignal "os/signal"
 	"sync"
-	"syscall"
 	"time"
 
-	"github.com/dotcloud/docker/engine"
 	dockerUtils "github.com/dotcloud/docker/utils"
 
 	"github.com/hugb/beegecluster/config"
@@ -20,39 +14,42 @@ import (
 )
 
 var (
-	Eng *engine.Engine
+	// 本机docker
+	Docker DockerBackend
 
 	waitGroup sync.WaitGroup
 
 	connCloseCh chan string
+
+	// docker事件日志
+	journal *EventJournal
 )
 
 // 我要加入组织
 func ControllerJoinCluster() {
 	// 得到各个分社的领导人姓名
-	getController(config.JoinAddress)
+	if err := joinMembers(); err != nil {
+		logger.Error("Join cluster error", "error", err)
+	}
 	// 所有领导人
-	log.Println("Controllers:", config.Controllers)
+	config.NodesLock.RLock()
+	logger.Info("Joined cluster", "controllers", config.Controllers)
+	config.NodesLock.RUnlock()
 }
 
-func DockerJoinCluster(eng *engine.Engine) {
-	Eng = eng
-	// 捕获系统信号
-	c := make(chan os.Signal, 1)
-	gosignal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
-	go func() {
-		for sig := range c {
-			// os.Interrupt=ctrl+c
-			log.Printf("Received signal '%v'", sig)
-		}
-	}()
+func DockerJoinCluster(backend DockerBackend) {
+	Docker = backend
+
+	connCloseCh = make(chan string, 10)
 
 	// 获取所有controller的集群内部通信地址
-	getController(config.JoinAddress)
+	if err := joinMembers(); err != nil {
+		fatal("Join cluster error", "error", err)
+	}
 
-	log.Println("Controllers:", config.Controllers)
+	logger.Info("Joined cluster", "controllers", config.Controllers)
 
-	connCloseCh = make(chan string, 10)
+	journal = NewEventJournal(config.EventJournalSize)
 
 	// 连接所有controller
 	for address, _ := range config.Controllers {
@@ -70,106 +67,123 @@ func DockerJoinCluster(eng *engine.Engine) {
 
 	// 事件上报
 	if err := reportEvents(); err != nil {
-		log.Println("Report event error:", err)
+		logger.Error("Report event error", "error", err)
 	}
 
-	log.Println("Event report finish")
+	logger.Info("Event report finish")
 }
 
 func reportImagesAndContainers(c *utils.Connection) error {
 	// 读取镜像列表
-	log.Println("Report images start.")
-	imageJob := Eng.Job("images")
-	imageJob.Setenv("filter", "")
-	imageJob.Setenv("all", "0")
-	imageSrc, err := imageJob.Stdout.AddPipe()
+	logger.Debug("Report images start", "node", c.Src)
+	images, err := Docker.Images()
 	if err != nil {
-		log.Fatalf("Create images receive pipe error:%s", err)
-	}
-	// 从管道读取事件数据并广播给所有controller
-	go func() {
-		imagesBytes, err := ioutil.ReadAll(imageSrc)
-		if err != nil {
-			log.Println("Read data error from pipe:", err)
-		}
-		c.SendCommandBytes("docker_images", imagesBytes)
-	}()
-	if err := imageJob.Run(); err != nil {
 		return err
 	}
+	c.SendCommandBytes("docker_images", images)
 	// 读取容器列表
-	log.Println("Report containers start")
-	containerJob := Eng.Job("containers")
-	containerJob.Setenv("all", "1")
-	containerSrc, err := containerJob.Stdout.AddPipe()
+	logger.Debug("Report containers start", "node", c.Src)
+	containers, err := Docker.Containers()
 	if err != nil {
-		log.Fatalf("Create containers receive pipe error:%s", err)
+		return err
 	}
-	// 从管道读取事件数据并广播给所有controller
-	go func() {
-		containersBytes, err := ioutil.ReadAll(containerSrc)
-		if err != nil {
-			log.Println("Read data error from pipe:", err)
-		}
-		c.SendCommandBytes("docker_containers", containersBytes)
-	}()
-
-	return containerJob.Run()
+	_, err = c.SendCommandBytes("docker_containers", containers)
+	return err
 }
 
-// 上报docker事件
-func reportEvents() error {
-	job := Eng.Job("events", "DockerAgent")
-	// 从当前到3214080000（100年）后,^-^100后我都不在了，还需要考虑超时吗
-	job.Setenv("since", fmt.Sprint(time.Now().Unix()))
-	job.Setenv("until", fmt.Sprint(time.Now().Unix()+3214080000))
-	reader, err := job.Stdout.AddPipe()
+// 上报docker版本，controller据此判断支持的api版本
+func reportVersion(c *utils.Connection) error {
+	version, err := Docker.Version()
 	if err != nil {
-		log.Fatalf("Create event receive pipe error:%s", err)
+		return err
 	}
-	// 从管道读取事件数据并广播给所有controller
-	go func() {
-		dec := json.NewDecoder(reader)
-		for {
-			m := &dockerUtils.JSONMessage{}
-			if err := dec.Decode(m); err != nil {
-				log.Printf("Error streaming events: %s\n", err)
-				break
-			}
-			if b, err := json.Marshal(m); err == nil {
-				// 广播
-				log.Println("Event:", string(b))
-				content := utils.PacketByes(append(b, " docker_event"...))
-				ClusterSwitcher.Broadcast(content)
+	if version.MinAPIVersion == "" {
+		version.MinAPIVersion = config.DefaultMinAPIVersion
+	}
+	b, err := json.Marshal(version)
+	if err != nil {
+		return err
+	}
+	_, err = c.SendCommandBytes("docker_version", b)
+	return err
+}
+
+// 上报docker事件，广播给所有controller
+func reportEvents() error {
+	return Docker.Events(time.Now().Unix(), func(m *dockerUtils.JSONMessage) {
+		b, err := json.Marshal(m)
+		if err != nil {
+			return
+		}
+		// 先写入事件日志，断线的controller重连后补发
+		entry, overflowed := journal.Append(b)
+		for _, address := range overflowed {
+			logger.Warn("Unacknowledged events have been discarded, resync", "node", address)
+			if c := ClusterSwitcher.Lookup(address); c != nil {
+				go resyncEvents(c)
 			}
 		}
-	}()
+		if b, err = json.Marshal(entry); err == nil {
+			// 广播
+			logger.Debug("Broadcast event", "seq", entry.Seq, "event", string(entry.Event))
+			content := utils.PacketByes(append(b, " docker_event"...))
+			ClusterSwitcher.Broadcast(content)
+		}
+	})
+}
 
-	return job.Run()
+// 从seq之后开始向controller补发事件，日志中缺失的部分无法补发时进行全量同步
+func resumeEvents(c *utils.Connection, seq uint64) {
+	entries, ok := journal.Since(seq)
+	if !ok {
+		logger.Warn("Events have been discarded, resync", "node", c.Src, "seq", seq)
+		resyncEvents(c)
+		return
+	}
+	logger.Info("Replay events", "node", c.Src, "count", len(entries))
+	journal.Ack(c.Src, seq)
+	for _, entry := range entries {
+		b, err := json.Marshal(entry)
+		if err != nil {
+			logger.Error("Encode event error", "error", err)
+			continue
+		}
+		c.SendCommandBytes("docker_event", b)
+	}
+}
+
+// 全量同步镜像和容器，并告知controller从当前序号开始接收事件
+func resyncEvents(c *utils.Connection) {
+	seq := journal.LastSeq()
+	journal.Ack(c.Src, seq)
+	c.SendCommandString("docker_event_reset", fmt.Sprintf("%d %d", journal.Epoch(), seq))
+	if err := reportImagesAndContainers(c); err != nil {
+		logger.Error("Report images and containers error", "node", c.Src, "error", err)
+	}
 }
 
 // 上报docker主机状态
 func reportStatus() {
-	log.Println("Report status start")
-	tick := time.Tick(time.Duration(5) * time.Second)
+	logger.Info("Report status start")
+	tick := time.Tick(config.Get().Docker.StatusInterval.Duration())
 	for {
 		select {
 		case <-tick:
 			systemInfo, err := utils.GetSystemInfo()
 			if err != nil {
-				log.Println("Get system info error:", err)
+				logger.Error("Get system info error", "error", err)
 			}
 			// 包含cpu使用率，内存，交换区和负载信息
 			systemInfoBytes, err := json.Marshal(systemInfo)
 			if err != nil {
-				log.Println("Encode system info error:", err)
+				logger.Error("Encode system info error", "error", err)
 			}
-			log.Println("Report status...")
+			logger.Debug("Report status")
 			data := utils.PacketByes(append(systemInfoBytes, " docker_status"...))
 			ClusterSwitcher.Broadcast(data)
 		}
 	}
-	log.Println("Report status finish")
+	logger.Info("Report status finish")
 }
 
 // docker连接到controller，保持着
@@ -189,11 +203,11 @@ func connectController(address string) {
 
 	defer func() { connCloseCh <- address }()
 
-	log.Printf("Connect controller %s", address)
+	logger.Info("Connect controller", "node", address)
 
 	conn, err = net.Dial("tcp", address)
 	if err != nil {
-		log.Println(err)
+		logger.Error("Connect controller error", "node", address, "error", err)
 		waitGroup.Done()
 		return
 	}
@@ -210,7 +224,7 @@ func connectController(address string) {
 	}()
 
 	waitGroup.Done()
-	connection.SendCommandString("docker_greetings", config.ClusterAddress)
+	connection.SendCommandString("docker_greetings", config.Get().ClusterAddress)
 
 	for {
 		if length, data, err = connection.Read(); err != nil {
@@ -218,51 +232,15 @@ func connectController(address string) {
 		}
 		cmd, payload = utils.CmdDecode(length, data)
 
-		log.Printf("Cmd:%s", cmd)
+		logger.Debug("Receive command", "node", address, "cmd", cmd)
 
 		if handler, exist = ClusterSwitcher.handlers[cmd]; exist {
 			handler(connection, payload)
 		} else {
-			log.Printf("Command[%s] is not exist", cmd)
-		}
-	}
-	log.Printf("Controller %s is disconnect", address)
-}
-
-// 由入口地址得到所有的controller
-func getController(address string) {
-	conn, err := net.Dial("tcp", address)
-	if err != nil {
-		panic(err)
-	}
-
-	connection := &utils.Connection{Conn: conn}
-
-	defer func() { conn.Close() }()
-
-	log.Println("Get all controllers request")
-	connection.SendCommandString(fmt.Sprintf("%s_join", config.Role), config.ClusterAddress)
-
-	lenght, data, err := connection.Read()
-	if err != nil {
-		panic(err)
-	}
-
-	cmd, payload := utils.CmdDecode(lenght, data)
-
-	log.Printf("Response cmd:%s, payload:%s", cmd, string(payload))
-
-	var controllers map[string]int64
-	if err = json.Unmarshal(payload, &controllers); err != nil {
-		panic(err)
-	}
-
-	for address, _ := range controllers {
-		if _, exist := config.Controllers[address]; !exist {
-			config.Controllers[address] = time.Now().Unix()
-			getController(address)
+			logger.Warn("Command does not exist", "node", address, "cmd", cmd)
 		}
 	}
+	logger.Warn("Controller is disconnected", "node", address)
 }
 
 // 重新连接到Controller
@@ -274,13 +252,20 @@ func reConnectController() {
 	for {
 		address = <-connCloseCh
 
-		for i := 3; i > 0; i-- {
-			log.Printf("Wait %d seconed reconnect %s", i, address)
-			time.Sleep(1 * time.Second)
-		}
+		wait := config.Get().Docker.ReconnectWait.Duration()
+		logger.Debug("Wait to reconnect", "node", address, "wait", wait)
+		time.Sleep(wait)
 
-		if _, ok = config.Controllers[address]; ok {
-			log.Printf("[%s] has been working, abandon reconnection", address)
+		config.NodesLock.RLock()
+		_, ok = config.Controllers[address]
+		config.NodesLock.RUnlock()
+		if ok {
+			logger.Info("Controller has been working, abandon reconnection", "node", address)
+			continue
+		}
+		// 主动离开的controller不再重连，重新加入后由成员管理通知
+		if IsLeaving(address) {
+			logger.Info("Controller has left, abandon reconnection", "node", address)
 			continue
 		}
 
@@ -0,0 +1,174 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	dockerUtils "github.com/dotcloud/docker/utils"
+
+	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/resource"
+	"github.com/hugb/beegecluster/utils"
+)
+
+const (
+	// 查询镜像、容器和版本的超时，事件流不限制
+	dockerAPITimeout = 30 * time.Second
+)
+
+// 通过远程api访问本机的docker，用于独立运行的agent
+type apiBackend struct {
+	host   string
+	url    string
+	client *http.Client
+}
+
+// host为unix://path、tcp://host:port或http(s)://host:port
+func NewAPIBackend(host string) (DockerBackend, error) {
+	parts := strings.SplitN(host, "://", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("Bad parameter: docker host %s", host)
+	}
+	transport := &http.Transport{}
+	backend := &apiBackend{host: host, client: &http.Client{Transport: transport}}
+	switch parts[0] {
+	case "unix":
+		dialer := &net.Dialer{Timeout: 5 * time.Second}
+		transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", parts[1])
+		}
+		backend.url = "http://docker"
+	case "tcp", "http":
+		backend.url = "http://" + parts[1]
+	case "https":
+		transport.TLSClientConfig = utils.ClientTLSConfig()
+		backend.url = host
+	default:
+		return nil, fmt.Errorf("Bad parameter: docker host %s", host)
+	}
+	backend.url = strings.TrimSuffix(backend.url, "/")
+	return backend, nil
+}
+
+// 发送GET请求，非200时返回docker的错误信息
+func (this *apiBackend) get(ctx context.Context, path string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", this.url+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := this.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		message, _ := ioutil.ReadAll(response.Body)
+		return nil, fmt.Errorf("Docker %s %s: %d %s", this.host, path, response.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return response, nil
+}
+
+func (this *apiBackend) read(path string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dockerAPITimeout)
+	defer cancel()
+
+	response, err := this.get(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	return ioutil.ReadAll(response.Body)
+}
+
+func (this *apiBackend) Images() ([]byte, error) {
+	return this.read("/images/json")
+}
+
+func (this *apiBackend) Containers() ([]byte, error) {
+	return this.read("/containers/json?all=1")
+}
+
+func (this *apiBackend) Version() (*resource.Version, error) {
+	content, err := this.read("/version")
+	if err != nil {
+		return nil, err
+	}
+	version := &resource.Version{}
+	if err = json.Unmarshal(content, version); err != nil {
+		return nil, err
+	}
+	return version, nil
+}
+
+// 远程api的事件，新版本docker在Type、Action和Actor中描述事件，
+// 只有容器和镜像的事件带有旧的status和id
+type apiEvent struct {
+	Status string `json:"status"`
+	ID     string `json:"id"`
+	From   string `json:"from"`
+	Time   int64  `json:"time"`
+	Type   string
+	Action string
+	Actor  struct {
+		ID string
+	}
+}
+
+func (this *apiEvent) message() *dockerUtils.JSONMessage {
+	m := &dockerUtils.JSONMessage{Status: this.Status, ID: this.ID, From: this.From, Time: this.Time}
+	if m.Status == "" && (this.Type == "container" || this.Type == "image") {
+		m.Status, m.ID = this.Action, this.Actor.ID
+	}
+	return m
+}
+
+// 事件流中断后等待重连，从最后收到的事件时间继续，
+// 跳过该秒内已经处理过的事件
+func (this *apiBackend) Events(since int64, handle func(m *dockerUtils.JSONMessage)) error {
+	var handled int
+	for {
+		skip := handled
+		err := this.streamEvents(since, func(m *dockerUtils.JSONMessage) {
+			if m.Time == since && skip > 0 {
+				skip--
+				return
+			}
+			if m.Time != since {
+				since, handled = m.Time, 0
+			}
+			handled++
+			// 网络、数据卷等事件不需要处理
+			if m.Status != "" {
+				handle(m)
+			}
+		})
+		wait := config.Get().Docker.ReconnectWait.Duration()
+		logger.Warn("Docker event stream interrupted", "host", this.host, "wait", wait, "error", err)
+		time.Sleep(wait)
+	}
+}
+
+func (this *apiBackend) streamEvents(since int64, handle func(m *dockerUtils.JSONMessage)) error {
+	response, err := this.get(context.Background(), fmt.Sprintf("/events?since=%d", since))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	logger.Info("Streaming docker events", "host", this.host, "since", since)
+	dec := json.NewDecoder(response.Body)
+	for {
+		event := &apiEvent{}
+		if err := dec.Decode(event); err != nil {
+			return err
+		}
+		handle(event.message())
+	}
+}
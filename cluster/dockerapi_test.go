@@ -0,0 +1,214 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dockerUtils "github.com/dotcloud/docker/utils"
+
+	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/registry"
+	"github.com/hugb/beegecluster/utils"
+)
+
+func newTestBackend(t *testing.T, handler http.HandlerFunc) *apiBackend {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	backend, err := NewAPIBackend("tcp://" + strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend.(*apiBackend)
+}
+
+func TestNewAPIBackendRejectsBadHost(t *testing.T) {
+	for _, host := range []string{"", "127.0.0.1:2375", "tcp://", "ftp://127.0.0.1"} {
+		if _, err := NewAPIBackend(host); err == nil || !strings.HasPrefix(err.Error(), "Bad parameter") {
+			t.Fatalf("expected %q to be rejected, got %v", host, err)
+		}
+	}
+}
+
+func TestAPIBackendListsImagesAndContainers(t *testing.T) {
+	backend := newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/images/json":
+			fmt.Fprint(w, `[{"Id":"img1","Created":100,"RepoTags":["busybox:latest"]}]`)
+		case "/containers/json":
+			if r.URL.Query().Get("all") != "1" {
+				t.Errorf("expected stopped containers to be listed, got %s", r.URL.RawQuery)
+			}
+			fmt.Fprint(w, `[{"Id":"c1","Created":200,"Image":"busybox"}]`)
+		case "/version":
+			fmt.Fprint(w, `{"Version":"1.13.1","ApiVersion":"1.26","MinAPIVersion":"1.12"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	content, err := backend.Images()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var images []apiImage
+	if err = json.Unmarshal(content, &images); err != nil || len(images) != 1 || images[0].Created != 100 || images[0].RepoTags[0] != "busybox:latest" {
+		t.Fatalf("unexpected images %s %v", content, err)
+	}
+	content, err = backend.Containers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var containers []apiContainer
+	if err = json.Unmarshal(content, &containers); err != nil || len(containers) != 1 || containers[0].Id != "c1" || containers[0].Created != 200 {
+		t.Fatalf("unexpected containers %s %v", content, err)
+	}
+	version, err := backend.Version()
+	if err != nil || version.ApiVersion != "1.26" || version.MinAPIVersion != "1.12" {
+		t.Fatalf("unexpected version %+v %v", version, err)
+	}
+}
+
+func TestAPIBackendReturnsDockerError(t *testing.T) {
+	backend := newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "server is on fire", http.StatusInternalServerError)
+	})
+
+	if _, err := backend.Images(); err == nil || !strings.Contains(err.Error(), "500 server is on fire") {
+		t.Fatalf("expected docker error to be returned, got %v", err)
+	}
+	if _, err := backend.Version(); err == nil {
+		t.Fatal("expected version error")
+	}
+
+	backend = newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `not json`)
+	})
+	if _, err := backend.Version(); err == nil {
+		t.Fatal("expected invalid version to be an error")
+	}
+}
+
+func TestAPIBackendEventsResumeAfterInterruption(t *testing.T) {
+	previous := config.Get()
+	c := *previous
+	c.Docker.ReconnectWait = config.Duration(10 * time.Millisecond)
+	config.Set(&c)
+	defer config.Set(previous)
+
+	var (
+		lock     sync.Mutex
+		requests []string
+	)
+	backend := newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests = append(requests, r.URL.Query().Get("since"))
+		attempt := len(requests)
+		lock.Unlock()
+		switch attempt {
+		case 1:
+			fmt.Fprint(w, `{"status":"create","id":"a","time":100}`)
+			fmt.Fprint(w, `{"status":"start","id":"a","time":100}`)
+		case 2:
+			// 重连后docker会重新发送该秒内的事件
+			fmt.Fprint(w, `{"status":"create","id":"a","time":100}`)
+			fmt.Fprint(w, `{"status":"start","id":"a","time":100}`)
+			fmt.Fprint(w, `{"Type":"network","Action":"connect","Actor":{"ID":"n"},"time":101}`)
+			fmt.Fprint(w, `{"Type":"container","Action":"die","Actor":{"ID":"a"},"time":101}`)
+		default:
+			http.Error(w, "gone", http.StatusServiceUnavailable)
+		}
+	})
+
+	received := make(chan *dockerUtils.JSONMessage, 10)
+	go backend.Events(100, func(m *dockerUtils.JSONMessage) { received <- m })
+
+	var got []string
+	for len(got) < 3 {
+		select {
+		case m := <-received:
+			got = append(got, m.Status+" "+m.ID)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected three events, got %v", got)
+		}
+	}
+	if strings.Join(got, ",") != "create a,start a,die a" {
+		t.Fatalf("expected each event once without network events, got %v", got)
+	}
+	select {
+	case m := <-received:
+		t.Fatalf("unexpected event %+v", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if requests[0] != "100" || requests[1] != "100" {
+		t.Fatalf("expected stream to resume from the last event time, got %v", requests)
+	}
+}
+
+func TestDockerListsDecodeRemoteAPIJSON(t *testing.T) {
+	host := "10.0.0.8:4243"
+	defer registry.RegistryServer.UnregisterImagesByHost(host)
+	defer registry.RegistryServer.UnregisterContainersByHost(host)
+	c := &utils.Connection{Src: host}
+	id := strings.Repeat("c0", 32)
+
+	dockerImages(c, []byte(`[{"Id":"img-decode","Created":100,"RepoTags":["app:1"]}]`))
+	image, ok := registry.RegistryServer.LookupImage("img-decode")
+	if !ok || image.Created != 100 || len(image.RepoTags) != 1 || image.RepoTags[0] != "app:1" {
+		t.Fatalf("expected image to be registered, got %+v %v", image, ok)
+	}
+	// 无法解析的数据不影响已经同步的镜像
+	dockerImages(c, []byte(`{"message":"error"}`))
+	if _, ok = registry.RegistryServer.LookupImage("img-decode"); !ok {
+		t.Fatal("expected image to be kept after invalid data")
+	}
+
+	dockerContainers(c, []byte(`[{"Id":"`+id+`","Created":200,"Names":["/app"],"Labels":{"beege.tenant":"acme","beege.memory":"64"}}]`))
+	if registry.RegistryServer.GetHostByContainerId(id) != host {
+		t.Fatal("expected container to be registered")
+	}
+	// 没有经过本controller创建的容器也能由标签恢复租户
+	if container, _ := registry.RegistryServer.LookupContainer(id); container.Tenant != "acme" || container.Memory != 64 {
+		t.Fatalf("expected tenant to be recovered from labels, got %+v", container)
+	}
+	if count, memory := registry.RegistryServer.TenantUsage("acme"); count != 1 || memory != 64 {
+		t.Fatalf("expected recovered container to count against the quota, got %d %d", count, memory)
+	}
+	dockerContainers(c, []byte(`[]`))
+	if registry.RegistryServer.GetHostByContainerId(id) != "" {
+		t.Fatal("expected removed container to be unregistered")
+	}
+}
+
+func TestCreateEventRecoversTenant(t *testing.T) {
+	id := strings.Repeat("e0", 32)
+	docker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/containers/"+id+"/json" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"Id":"`+id+`","Config":{"Labels":{"beege.tenant":"acme","beege.memory":"32"}}}`)
+	}))
+	defer docker.Close()
+	host := strings.TrimPrefix(docker.URL, "http://")
+	defer registry.RegistryServer.UnregisterContainersByHost(host)
+
+	applyDockerEvent(host, &dockerUtils.JSONMessage{Status: "create", ID: id, Time: 100})
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if container, _ := registry.RegistryServer.LookupContainer(id); container != nil && container.Tenant == "acme" && container.Memory == 32 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected tenant of the created container to be inspected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
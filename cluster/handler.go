@@ -3,13 +3,17 @@ package cluster
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
-	"github.com/dotcloud/docker/engine"
+	dockerUtils "github.com/dotcloud/docker/utils"
 
+	"github.com/hugb/beegecluster/audit"
 	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/notify"
+	"github.com/hugb/beegecluster/raft"
 	"github.com/hugb/beegecluster/registry"
 	"github.com/hugb/beegecluster/resource"
 	"github.com/hugb/beegecluster/utils"
@@ -18,8 +22,13 @@ import (
 func ClusterHandlers() {
 	m := map[string]HandlerFunc{
 		"heartbeat":                 heartbeat,
+		"leaving":                   leaving,
 		"docker_status":             dockerStatus,
+		"docker_version":            dockerVersion,
 		"docker_event":              dockerEvent,
+		"docker_event_ack":          dockerEventAck,
+		"docker_event_replay":       dockerEventReplay,
+		"docker_event_reset":        dockerEventReset,
 		"docker_images":             dockerImages,
 		"docker_containers":         dockerContainers,
 		"docker_greetings":          dockerGreetings,
@@ -31,76 +40,333 @@ func ClusterHandlers() {
 	}
 	for cmd, fct := range m {
 		if err := ClusterSwitcher.Register(cmd, fct); err != nil {
-			log.Printf("Register cluster handler[%s] failure:%s", cmd, err)
+			logger.Error("Register cluster handler failure", "cmd", cmd, "error", err)
 		} else {
-			log.Printf("Register cluster hander[%s] success", cmd)
+			logger.Debug("Register cluster handler", "cmd", cmd)
 		}
 	}
 }
 
 // 心跳
 func heartbeat(c *utils.Connection, data []byte) {
-	c.SendCommandString("heartbeat", config.ClusterAddress)
+	c.SendCommandString("heartbeat", config.Get().ClusterAddress)
 }
 
 // docker主机状态
 func dockerStatus(c *utils.Connection, data []byte) {
-	log.Println("Status:", string(data))
+	logger.Debug("Docker status", "node", c.Src, "status", string(data))
+	systemInfo := &utils.SystemInfo{}
+	if err := json.Unmarshal(data, systemInfo); err != nil {
+		logger.Error("Decode status error", "node", c.Src, "error", err)
+		return
+	}
+	if c.Src != "" {
+		setNodeStatus(c.Src, systemInfo)
+	}
+}
+
+// docker版本
+func dockerVersion(c *utils.Connection, data []byte) {
+	version := &resource.Version{}
+	if err := json.Unmarshal(data, version); err != nil {
+		logger.Error("Decode version error", "node", c.Src, "error", err)
+		return
+	}
+	if c.Src != "" {
+		logger.Info("Docker version", "node", c.Src, "version", version.Version,
+			"min_api", version.MinAPIVersion, "api", version.ApiVersion)
+		setNodeVersion(c.Src, version)
+	}
 }
 
-// docker事件
+// docker事件，按序号依次处理，发现缺失时请求docker补发
 func dockerEvent(c *utils.Connection, data []byte) {
-	log.Println("Event:", string(data))
+	// 尚未问候的连接不知道来源，事件在问候后补发
+	if c.Src == "" {
+		return
+	}
+	entry := &JournalEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		logger.Error("Decode event error", "node", c.Src, "error", err)
+		return
+	}
+	var expected bool
+	withEventCursor(c.Src, func(cursor *resource.EventCursor) {
+		// 尚未同步过，等待docker告知开始的位置
+		if cursor.Epoch == 0 {
+			return
+		}
+		// docker重启过，新日志中之前的事件可能已经丢失，请求全量同步；
+		// 旧的epoch与docker不符，docker收到后会全量同步
+		if entry.Epoch != cursor.Epoch || entry.Seq > cursor.Seq+1 {
+			if !cursor.Replaying {
+				logger.Warn("Event gap", "node", c.Src, "epoch", entry.Epoch, "expect", cursor.Seq+1, "seq", entry.Seq)
+				cursor.Replaying = true
+				c.SendCommandString("docker_event_replay", fmt.Sprintf("%d %d", cursor.Epoch, cursor.Seq))
+			}
+			return
+		}
+		expected = entry.Seq == cursor.Seq+1
+	})
+	if !expected {
+		return
+	}
+
+	m := &dockerUtils.JSONMessage{}
+	if err := json.Unmarshal(entry.Event, m); err != nil {
+		logger.Error("Decode event error", "node", c.Src, "seq", entry.Seq, "error", err)
+	} else {
+		logger.Debug("Docker event", "node", c.Src, "seq", entry.Seq, "event", string(entry.Event))
+		applyDockerEvent(c.Src, m)
+	}
+	withEventCursor(c.Src, func(cursor *resource.EventCursor) {
+		cursor.Seq = entry.Seq
+		cursor.Replaying = false
+	})
+	c.SendCommandString("docker_event_ack", fmt.Sprintf("%d %d", entry.Epoch, entry.Seq))
+}
+
+// 根据事件更新注册表
+func applyDockerEvent(host string, m *dockerUtils.JSONMessage) {
+	switch m.Status {
+	case "create":
+		registry.RegistryServer.RegisterContainer(m.ID, &resource.Container{Host: host, Created: m.Time})
+		go inspectContainerOwner(host, m.ID)
+	case "die":
+		go notifyContainerDie(host, m.ID)
+	case "destroy":
+		registry.RegistryServer.UnregisterContainer(m.ID)
+	case "delete":
+		registry.RegistryServer.UnregisterImageFromHost(m.ID, host)
+	}
+}
+
+// 查询docker远程api，docker启用https时使用本机证书
+var dockerClient = &http.Client{
+	Timeout:   10 * time.Second,
+	Transport: &http.Transport{TLSClientConfig: utils.ClientTLSConfig()},
+}
+
+// 通过controller创建的容器带有租户标签，任何controller都能据此恢复所属的租户
+func containerOwner(labels map[string]string) (string, int64) {
+	tenant := labels[config.TenantLabel]
+	if tenant == "" {
+		return "", 0
+	}
+	memory, _ := strconv.ParseInt(labels[config.TenantMemoryLabel], 10, 64)
+	return tenant, memory
+}
+
+// 事件中没有标签，新建的容器需要到docker上查询所属的租户
+func inspectContainerOwner(host, id string) {
+	response, err := dockerClient.Get(utils.DockerURL(host, fmt.Sprintf("/containers/%s/json", id)))
+	if err != nil {
+		logger.Error("Inspect container error", "node", host, "container", id, "error", err)
+		return
+	}
+	defer response.Body.Close()
+
+	var container struct {
+		Config struct {
+			Labels map[string]string
+		}
+	}
+	if response.StatusCode != http.StatusOK {
+		return
+	}
+	if err = json.NewDecoder(response.Body).Decode(&container); err != nil {
+		logger.Error("Decode container error", "node", host, "container", id, "error", err)
+		return
+	}
+	tenant, memory := containerOwner(container.Config.Labels)
+	// 查询期间容器可能已被删除
+	if _, ok := registry.RegistryServer.LookupContainer(id); ok && tenant != "" {
+		registry.RegistryServer.SetContainerOwner(id, host, tenant, memory)
+	}
+}
+
+// 容器异常退出时通知，事件中没有退出码，需要到docker上查询
+func notifyContainerDie(host, id string) {
+	response, err := dockerClient.Get(utils.DockerURL(host, fmt.Sprintf("/containers/%s/json", id)))
+	if err != nil {
+		logger.Error("Inspect container error", "node", host, "container", id, "error", err)
+		return
+	}
+	defer response.Body.Close()
+
+	var container struct {
+		State struct {
+			ExitCode int
+		}
+	}
+	if err = json.NewDecoder(response.Body).Decode(&container); err != nil {
+		logger.Error("Decode container error", "node", host, "container", id, "error", err)
+		return
+	}
+	if container.State.ExitCode != 0 {
+		notify.NotifyServer.Notify(&notify.Event{
+			Type:      notify.ContainerDie,
+			Node:      host,
+			Container: id,
+			ExitCode:  container.State.ExitCode,
+		})
+	}
+}
+
+// controller确认已处理的事件
+func dockerEventAck(c *utils.Connection, data []byte) {
+	epoch, seq, err := parseEventPosition(data)
+	if err != nil {
+		logger.Error("Parse event ack error", "node", c.Src, "error", err)
+		return
+	}
+	if epoch == journal.Epoch() {
+		journal.Ack(c.Src, seq)
+	}
+}
+
+// controller请求补发事件
+func dockerEventReplay(c *utils.Connection, data []byte) {
+	epoch, seq, err := parseEventPosition(data)
+	if err != nil {
+		logger.Error("Parse event replay error", "node", c.Src, "error", err)
+		return
+	}
+	if epoch != journal.Epoch() {
+		resyncEvents(c)
+	} else {
+		resumeEvents(c, seq)
+	}
+}
+
+// docker全量同步后，从指定位置开始接收事件
+func dockerEventReset(c *utils.Connection, data []byte) {
+	epoch, seq, err := parseEventPosition(data)
+	if err != nil {
+		logger.Error("Parse event reset error", "node", c.Src, "error", err)
+		return
+	}
+	withEventCursor(c.Src, func(cursor *resource.EventCursor) {
+		cursor.Epoch = epoch
+		cursor.Seq = seq
+		cursor.Replaying = false
+	})
+}
+
+// 解析"epoch seq"格式的事件位置
+func parseEventPosition(data []byte) (int64, uint64, error) {
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("Bad parameter: %s", string(data))
+	}
+	epoch, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	seq, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return epoch, seq, nil
 }
 
 // docker主机上的镜像
 func dockerImages(c *utils.Connection, data []byte) {
-	dst := engine.NewTable("", 0)
-	if _, err := dst.ReadListFrom(data); err != nil {
-		log.Println("Read table error:", err)
-	}
-	for _, env := range dst.Data {
-		created, err := strconv.ParseInt(env.Get("Created"), 10, 64)
-		if err == nil {
-			image := &resource.Image{Host: c.Src, Created: created}
-			registry.RegistryServer.RegisterImage(env.Get("Id"), image)
-			log.Printf("Register image id:%s host:%s", env.Get("Id"), c.Src)
-		} else {
-			log.Printf("Parse image created time error:%s", err)
+	var images []apiImage
+	if err := json.Unmarshal(data, &images); err != nil {
+		// 数据无法解析时保留原有的镜像，等待下次同步
+		logger.Error("Decode images error", "node", c.Src, "error", err)
+		return
+	}
+	// 全量同步，清除该主机原有的镜像
+	registry.RegistryServer.UnregisterImagesByHost(c.Src)
+	for _, image := range images {
+		if image.Id == "" {
+			continue
 		}
+		registry.RegistryServer.RegisterImage(image.Id, &resource.Image{Host: c.Src, Created: image.Created, RepoTags: image.RepoTags})
+		logger.Debug("Register image", "node", c.Src, "image", image.Id)
 	}
+	logger.Info("Images synchronized", "node", c.Src, "count", len(images))
 }
 
 // docker主机上的容器
 func dockerContainers(c *utils.Connection, data []byte) {
-	dst := engine.NewTable("", 0)
-	if _, err := dst.ReadListFrom(data); err != nil {
-		log.Println("Read table error:", err)
+	var list []apiContainer
+	if err := json.Unmarshal(data, &list); err != nil {
+		// 数据无法解析时保留原有的容器，以免误删其所有者
+		logger.Error("Decode containers error", "node", c.Src, "error", err)
+		return
 	}
-	if content, err := dst.ToListString(); err != nil {
-		log.Println("Table to string error:", err)
-	} else {
-		log.Println("Containers:", content)
+	// 全量同步，替换该主机原有的容器
+	containers := make(map[string]*resource.Container)
+	for _, container := range list {
+		if container.Id != "" {
+			tenant, memory := containerOwner(container.Labels)
+			containers[container.Id] = &resource.Container{Host: c.Src, Created: container.Created, Tenant: tenant, Memory: memory}
+		}
 	}
+	registry.RegistryServer.SyncContainersByHost(c.Src, containers)
+	logger.Info("Containers synchronized", "node", c.Src, "count", len(list))
+	logger.Debug("Containers", "node", c.Src, "list", string(data))
 }
 
 // 注册资料
 func dockerGreetings(c *utils.Connection, data []byte) {
+	if rejectEvicted(c, string(data)) {
+		return
+	}
 	c.Src = string(data)
-	config.Dockers[string(data)] = time.Now().Unix()
-	log.Println("Docker:", string(data), "is online.")
-	log.Println("Dockers:", config.Dockers)
-	c.SendCommandString("docker_greetings_reply", config.ClusterAddress)
+	setLeaving(c.Src, false)
+	setNodeStatus(c.Src, nil)
+	logger.Info("Docker is online", "node", c.Src)
+	audit.AuditServer.Record(&audit.Entry{Type: audit.NodeJoin, Node: c.Src, Role: config.DockerRoleName})
+	go admitDocker(string(data))
+	// 从快照恢复的镜像和容器已经得到确认
+	registry.RegistryServer.ConfirmHost(c.Src)
+	// 同时告知已处理到的事件位置，docker从此处补发
+	var position string
+	withEventCursor(c.Src, func(cursor *resource.EventCursor) {
+		position = fmt.Sprintf("%d %d", cursor.Epoch, cursor.Seq)
+	})
+	c.SendCommandString("docker_greetings_reply", config.Get().ClusterAddress+" "+position)
+}
+
+// 被移出集群的节点重新连接时断开
+func rejectEvicted(c *utils.Connection, address string) bool {
+	if !Evicted(address) {
+		return false
+	}
+	logger.Warn("Reject evicted node", "node", address)
+	c.Conn.Close()
+	return true
+}
+
+// 由leader将docker加入集群，选举期间没有leader时重试
+func admitDocker(address string) {
+	var err error
+	for i := 0; i < 3; i++ {
+		if err = raft.Propose("docker_admit", address); err == nil {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+	logger.Error("Admit docker error", "node", address, "error", err)
 }
 
 // 我收了个小弟
 // todo:是否要审核
 // 由于其知道我的名字我默认相信他
 func dockerJoin(c *utils.Connection, data []byte) {
+	if rejectEvicted(c, string(data)) {
+		return
+	}
 	// 向集群结构配置里面添加新成员
-	config.Dockers[string(data)] = time.Now().Unix()
+	go admitDocker(string(data))
 	// 返回组织中领导层所有人姓名以便小弟有事时着他们
+	config.NodesLock.RLock()
 	b, err := json.Marshal(config.Controllers)
+	config.NodesLock.RUnlock()
 	if err != nil {
 		// 我收集的资料有误
 		c.SendCommandString("docker_join", "")
@@ -113,12 +379,18 @@ func dockerJoin(c *utils.Connection, data []byte) {
 // 结拜了个兄弟
 func controllerJoin(c *utils.Connection, data []byte) {
 	address := string(data)
+	if rejectEvicted(c, address) {
+		return
+	}
+	config.NodesLock.Lock()
 	// 把他名字记下来
 	config.Controllers[address] = time.Now().Unix()
+	delete(config.StaleControllers, address)
 	// 把我以前结拜的所有兄弟告诉他，让他们也认识一下
 	b, err := json.Marshal(config.Controllers)
+	config.NodesLock.Unlock()
 	if err != nil {
-		log.Println(err)
+		logger.Error("Encode controllers error", "node", address, "error", err)
 		c.SendCommandString("controller_join", "")
 	} else {
 		c.SendCommandBytes("controller_join", b)
@@ -129,26 +401,50 @@ func controllerJoin(c *utils.Connection, data []byte) {
 
 	message := fmt.Sprintf("%s %s", address, "controller_join_to_docker")
 	ClusterSwitcher.Broadcast(utils.PacketString(message))
-	log.Println("Controllers", config.Controllers)
+	config.NodesLock.RLock()
+	logger.Info("Controller joined", "node", address, "controllers", config.Controllers)
+	config.NodesLock.RUnlock()
 }
 
 // 小弟说我结拜的兄弟死了
 func controllerOffline(c *utils.Connection, data []byte) {
-	log.Println("controller:", string(data), "is offline.")
+	logger.Warn("Controller is offline", "node", string(data))
+	config.NodesLock.Lock()
+	defer config.NodesLock.Unlock()
+	// 每个小弟都会来报丧，只通知一次
+	if _, exist := config.Controllers[string(data)]; exist {
+		notify.NotifyServer.Notify(&notify.Event{Type: notify.ControllerOffline, Node: string(data)})
+	}
 	// 从生死簿中将他的名字抹去
 	delete(config.Controllers, string(data))
-	log.Println("Controllers:", config.Controllers)
+	logger.Info("Controllers", "controllers", config.Controllers)
 }
 
 // 新的controller加入，docker需要连接到它
 func controllerJoinToDocker(c *utils.Connection, data []byte) {
 	address := string(data)
-	log.Printf("Connect new controller %s", address)
+	logger.Info("Connect new controller", "node", address)
 	// docker连接到新的controller
 	connCloseCh <- address
 }
 
 func dockerGreetingsReply(c *utils.Connection, data []byte) {
-	config.Controllers[string(data)] = time.Now().Unix()
-	reportImagesAndContainers(c)
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return
+	}
+	config.NodesLock.Lock()
+	config.Controllers[fields[0]] = time.Now().Unix()
+	config.NodesLock.Unlock()
+	if err := reportVersion(c); err != nil {
+		logger.Error("Report version error", "error", err)
+	}
+	// controller处理过本次启动的事件，只需补发断线期间的事件
+	if len(fields) == 3 {
+		if epoch, seq, err := parseEventPosition([]byte(strings.Join(fields[1:], " "))); err == nil && epoch == journal.Epoch() {
+			resumeEvents(c, seq)
+			return
+		}
+	}
+	resyncEvents(c)
 }
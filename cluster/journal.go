@@ -0,0 +1,169 @@
+////////////////////////////////////////////////////////////
+/* docker事件日志，与controller断线期间的事件在重连后补发 */
+////////////////////////////////////////////////////////////
+
+package cluster
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/hugb/beegecluster/resource"
+)
+
+// 事件日志中的一条记录，Epoch为docker本次启动的标识，Seq为单调递增的序号
+type JournalEntry struct {
+	Epoch int64
+	Seq   uint64
+	Event json.RawMessage
+}
+
+// 所有controller都已确认的记录最多保留size条，供新连接的controller补发；
+// 有controller未确认的记录最多保留size*journalOverflowFactor条
+const journalOverflowFactor = 4
+
+type EventJournal struct {
+	sync.RWMutex
+
+	epoch   int64
+	seq     uint64
+	size    int
+	entries []*JournalEntry
+	// 各controller已确认的序号，未确认的记录不会被丢弃，直到超出上限
+	acked map[string]uint64
+}
+
+func NewEventJournal(size int) *EventJournal {
+	return &EventJournal{
+		epoch:   time.Now().UnixNano(),
+		size:    size,
+		entries: make([]*JournalEntry, 0, size),
+		acked:   make(map[string]uint64),
+	}
+}
+
+func (this *EventJournal) Epoch() int64 {
+	return this.epoch
+}
+
+func (this *EventJournal) LastSeq() uint64 {
+	this.RLock()
+	defer this.RUnlock()
+
+	return this.seq
+}
+
+// 追加事件，超出容量时丢弃已确认的旧记录；未确认的记录超出上限时也被丢弃，
+// 返回因此缺失事件的controller，它们需要全量同步
+func (this *EventJournal) Append(event []byte) (*JournalEntry, []string) {
+	this.Lock()
+	defer this.Unlock()
+
+	this.seq++
+	entry := &JournalEntry{Epoch: this.epoch, Seq: this.seq, Event: event}
+	this.entries = append(this.entries, entry)
+
+	acked := this.seq
+	for _, seq := range this.acked {
+		if seq < acked {
+			acked = seq
+		}
+	}
+	drop := 0
+	for len(this.entries)-drop > this.size && this.entries[drop].Seq <= acked {
+		drop++
+	}
+	var overflowed []string
+	for len(this.entries)-drop > this.size*journalOverflowFactor {
+		dropped := this.entries[drop].Seq
+		for address, seq := range this.acked {
+			if seq < dropped {
+				overflowed = append(overflowed, address)
+				delete(this.acked, address)
+			}
+		}
+		drop++
+	}
+	if drop > 0 {
+		this.entries = append(this.entries[:0], this.entries[drop:]...)
+	}
+
+	return entry, overflowed
+}
+
+// 返回序号大于seq的所有记录，若其中部分记录已被丢弃则返回false
+func (this *EventJournal) Since(seq uint64) ([]*JournalEntry, bool) {
+	this.RLock()
+	defer this.RUnlock()
+
+	if seq >= this.seq {
+		return nil, true
+	}
+	if len(this.entries) == 0 || this.entries[0].Seq > seq+1 {
+		return nil, false
+	}
+	start := int(seq + 1 - this.entries[0].Seq)
+	entries := make([]*JournalEntry, len(this.entries)-start)
+	copy(entries, this.entries[start:])
+
+	return entries, true
+}
+
+// 记录controller确认的序号，补发或全量同步时从开始的位置记录
+func (this *EventJournal) Ack(address string, seq uint64) {
+	this.Lock()
+	defer this.Unlock()
+
+	if acked, ok := this.acked[address]; !ok || seq > acked {
+		this.acked[address] = seq
+	}
+}
+
+func (this *EventJournal) Acked(address string) uint64 {
+	this.RLock()
+	defer this.RUnlock()
+
+	return this.acked[address]
+}
+
+// controller端记录每个docker已处理到的事件位置，读写都需持有锁
+var eventCursors = struct {
+	sync.Mutex
+	m map[string]*resource.EventCursor
+}{m: make(map[string]*resource.EventCursor)}
+
+// 持有锁访问docker的事件位置，不存在时创建
+func withEventCursor(address string, fct func(cursor *resource.EventCursor)) {
+	eventCursors.Lock()
+	defer eventCursors.Unlock()
+
+	cursor, ok := eventCursors.m[address]
+	if !ok {
+		cursor = &resource.EventCursor{}
+		eventCursors.m[address] = cursor
+	}
+	fct(cursor)
+}
+
+// 得到所有docker的事件位置，用于保存快照
+func EventCursors() map[string]*resource.EventCursor {
+	eventCursors.Lock()
+	defer eventCursors.Unlock()
+
+	cursors := make(map[string]*resource.EventCursor)
+	for address, cursor := range eventCursors.m {
+		cursors[address] = &resource.EventCursor{Epoch: cursor.Epoch, Seq: cursor.Seq}
+	}
+	return cursors
+}
+
+// 从快照恢复事件位置
+func RestoreEventCursors(cursors map[string]*resource.EventCursor) {
+	eventCursors.Lock()
+	defer eventCursors.Unlock()
+
+	for address, cursor := range cursors {
+		eventCursors.m[address] = cursor
+	}
+}
@@ -0,0 +1,148 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/gossip"
+	"github.com/hugb/beegecluster/resource"
+	"github.com/hugb/beegecluster/utils"
+)
+
+func TestJournalKeepsUnackedEntries(t *testing.T) {
+	j := NewEventJournal(2)
+	j.Ack("c1:4244", 0)
+	for i := 0; i < 5; i++ {
+		if _, overflowed := j.Append([]byte(`{}`)); len(overflowed) > 0 {
+			t.Fatalf("unexpected overflow %v", overflowed)
+		}
+	}
+	entries, ok := j.Since(0)
+	if !ok || len(entries) != 5 {
+		t.Fatalf("expected unacknowledged entries to be kept, got %d %v", len(entries), ok)
+	}
+
+	// 确认之后只保留容量内的记录
+	j.Ack("c1:4244", 5)
+	j.Append([]byte(`{}`))
+	if _, ok = j.Since(3); ok {
+		t.Fatal("expected acknowledged entries beyond the size to be dropped")
+	}
+	if entries, ok = j.Since(4); !ok || len(entries) != 2 {
+		t.Fatalf("expected the last entries to be kept, got %d %v", len(entries), ok)
+	}
+}
+
+func TestJournalOverflowRequiresResync(t *testing.T) {
+	j := NewEventJournal(2)
+	j.Ack("c1:4244", 0)
+	j.Ack("c2:4244", 0)
+
+	var overflowed []string
+	for i := 0; i < 2*journalOverflowFactor+1; i++ {
+		j.Ack("c2:4244", j.LastSeq())
+		_, dropped := j.Append([]byte(`{}`))
+		overflowed = append(overflowed, dropped...)
+	}
+	if len(overflowed) != 1 || overflowed[0] != "c1:4244" {
+		t.Fatalf("expected the lagging controller to overflow, got %v", overflowed)
+	}
+	if _, ok := j.Since(0); ok {
+		t.Fatal("expected replay from the start to require a resync")
+	}
+	// 溢出的controller不再阻止丢弃记录
+	j.Ack("c2:4244", j.LastSeq())
+	j.Append([]byte(`{}`))
+	if entries, _ := j.Since(j.LastSeq() - 2); len(entries) != 2 {
+		t.Fatalf("expected journal to shrink back to its size, got %d", len(entries))
+	}
+}
+
+// 读取docker发给controller的命令
+func readCommand(t *testing.T, conn net.Conn) (string, string) {
+	conn.SetDeadline(time.Now().Add(time.Second))
+	length, data, err := (&utils.Connection{Conn: conn}).Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, payload := utils.CmdDecode(length, data)
+	return cmd, string(payload)
+}
+
+func TestEpochChangeForcesResync(t *testing.T) {
+	address := "10.0.0.9:4243"
+	RestoreEventCursors(map[string]*resource.EventCursor{address: {Epoch: 1, Seq: 5}})
+	defer func() {
+		eventCursors.Lock()
+		delete(eventCursors.m, address)
+		eventCursors.Unlock()
+	}()
+
+	server, client := net.Pipe()
+	defer client.Close()
+	c := &utils.Connection{Conn: server, Src: address}
+	data, _ := json.Marshal(&JournalEntry{Epoch: 2, Seq: 10, Event: json.RawMessage(`{"status":"create","id":"x"}`)})
+	go dockerEvent(c, data)
+
+	cmd, payload := readCommand(t, client)
+	if cmd != "docker_event_replay" || payload != "1 5" {
+		t.Fatalf("expected replay request with the old position, got %s %q", cmd, payload)
+	}
+	cursor := EventCursors()[address]
+	if cursor.Epoch != 1 || cursor.Seq != 5 {
+		t.Fatalf("expected cursor to wait for the resync, got %+v", cursor)
+	}
+
+	// 全量同步后从docker告知的位置继续
+	dockerEventReset(c, []byte("2 10"))
+	data, _ = json.Marshal(&JournalEntry{Epoch: 2, Seq: 11, Event: json.RawMessage(`{"status":"start","id":"x"}`)})
+	go dockerEvent(c, data)
+	if cmd, payload = readCommand(t, client); cmd != "docker_event_ack" || payload != "2 11" {
+		t.Fatalf("expected event to be acknowledged, got %s %q", cmd, payload)
+	}
+}
+
+// docker收到controller的问候回复时，成员管理可能同时修改controller列表
+func TestGreetingsReplyRacesMemberChanges(t *testing.T) {
+	resetNodes(t)
+	previousDocker, previousJournal := Docker, journal
+	Docker = newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/version":
+			fmt.Fprint(w, `{"ApiVersion":"1.26"}`)
+		default:
+			fmt.Fprint(w, `[]`)
+		}
+	})
+	journal = NewEventJournal(4)
+	role := config.Role
+	config.Role = config.ControllerRoleName
+	defer func() { Docker, journal, config.Role = previousDocker, previousJournal, role }()
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go io.Copy(ioutil.Discard, client)
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			memberChange(gossip.Member{Address: fmt.Sprintf("10.0.0.%d:4244", i), Role: config.ControllerRoleName, State: gossip.Alive})
+		}
+		close(done)
+	}()
+	dockerGreetingsReply(&utils.Connection{Conn: server}, []byte("10.0.0.50:4244"))
+	<-done
+
+	config.NodesLock.RLock()
+	defer config.NodesLock.RUnlock()
+	if _, ok := config.Controllers["10.0.0.50:4244"]; !ok {
+		t.Fatal("expected replying controller to be recorded")
+	}
+}
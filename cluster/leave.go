@@ -0,0 +1,53 @@
+package cluster
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hugb/beegecluster/audit"
+	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/gossip"
+	"github.com/hugb/beegecluster/utils"
+)
+
+// 主动离开集群的节点，其连接断开不视为故障
+var leavingNodes = struct {
+	sync.RWMutex
+	m map[string]int64
+}{m: make(map[string]int64)}
+
+// 主动离开集群，通知所有相连的节点以及成员管理
+func Leave() {
+	logger.Info("Leaving cluster")
+	ClusterSwitcher.BroadcastWait(utils.PacketByes(append([]byte(config.Get().ClusterAddress), " leaving"...)))
+	if gossip.Members != nil {
+		gossip.Members.Leave()
+	}
+}
+
+func IsLeaving(address string) bool {
+	leavingNodes.RLock()
+	defer leavingNodes.RUnlock()
+
+	_, ok := leavingNodes.m[address]
+	return ok
+}
+
+func setLeaving(address string, leaving bool) {
+	leavingNodes.Lock()
+	defer leavingNodes.Unlock()
+
+	if leaving {
+		leavingNodes.m[address] = time.Now().Unix()
+	} else {
+		delete(leavingNodes.m, address)
+	}
+}
+
+// 对方即将退出
+func leaving(c *utils.Connection, data []byte) {
+	address := string(data)
+	logger.Info("Node is leaving", "node", address)
+	setLeaving(address, true)
+	audit.AuditServer.Record(&audit.Entry{Type: audit.NodeLeave, Node: address})
+}
@@ -0,0 +1,25 @@
+package cluster
+
+import (
+	"testing"
+
+	"github.com/hugb/beegecluster/utils"
+)
+
+func TestLeavingNodeIsNotAFailure(t *testing.T) {
+	address := "10.0.0.30:4243"
+	defer setLeaving(address, false)
+
+	if IsLeaving(address) {
+		t.Fatal("expected node not to be leaving")
+	}
+	leaving(&utils.Connection{}, []byte(address))
+	if !IsLeaving(address) {
+		t.Fatal("expected announced node to be leaving")
+	}
+	// 重新加入后断开视为故障
+	setLeaving(address, false)
+	if IsLeaving(address) {
+		t.Fatal("expected rejoined node not to be leaving")
+	}
+}
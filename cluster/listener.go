@@ -5,7 +5,6 @@
 package cluster
 
 import (
-	"log"
 	"net"
 
 	"github.com/hugb/beegecluster/config"
@@ -19,7 +18,7 @@ func NewClusterServer() {
 		conn net.Conn
 		ln   net.Listener
 	)
-	if ln, err = net.Listen("tcp", config.ClusterAddress); err != nil {
+	if ln, err = net.Listen("tcp", config.Get().ClusterAddress); err != nil {
 		panic(err)
 	}
 	for {
@@ -57,12 +56,12 @@ func serve(conn net.Conn) {
 		}
 		cmd, payload = utils.CmdDecode(n, data)
 
-		log.Printf("Controller receive cmd:%s", cmd)
+		logger.Debug("Receive command", "node", connection.Src, "cmd", cmd)
 
 		if handler, ok = ClusterSwitcher.handlers[cmd]; ok {
 			handler(connection, payload)
 		} else {
-			log.Printf("Command[%s] does not exist", cmd)
+			logger.Warn("Command does not exist", "node", connection.Src, "cmd", cmd)
 		}
 	}
 }
@@ -0,0 +1,15 @@
+package cluster
+
+import (
+	"os"
+
+	"github.com/hugb/beegecluster/logging"
+)
+
+var logger = logging.Logger("cluster")
+
+// 输出错误日志后退出
+func fatal(msg string, args ...interface{}) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
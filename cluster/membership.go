@@ -0,0 +1,75 @@
+package cluster
+
+import (
+	"strings"
+	"time"
+
+	"github.com/hugb/beegecluster/audit"
+	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/gossip"
+	"github.com/hugb/beegecluster/notify"
+)
+
+// 启动成员管理并通过入口地址加入集群，入口地址可以有多个，以逗号分隔
+func joinMembers() error {
+	if err := gossip.Start(config.Get().ClusterAddress, config.Role, config.Get().Labels); err != nil {
+		return err
+	}
+	if config.Get().JoinAddress != "" {
+		if err := gossip.Members.Join(strings.Split(config.Get().JoinAddress, ",")); err != nil {
+			return err
+		}
+	}
+
+	config.NodesLock.Lock()
+	for _, member := range gossip.Members.Alive(config.ControllerRoleName) {
+		config.Controllers[member.Address] = time.Now().Unix()
+	}
+	config.NodesLock.Unlock()
+
+	gossip.Members.OnChange(memberChange)
+	return nil
+}
+
+// 成员状态变化
+func memberChange(member gossip.Member) {
+	if member.Role != config.ControllerRoleName || member.Address == config.Get().ClusterAddress {
+		return
+	}
+	switch member.State {
+	case gossip.Alive:
+		setLeaving(member.Address, false)
+		config.NodesLock.Lock()
+		_, exist := config.Controllers[member.Address]
+		if config.Role == config.ControllerRoleName {
+			config.Controllers[member.Address] = time.Now().Unix()
+			delete(config.StaleControllers, member.Address)
+		}
+		config.NodesLock.Unlock()
+		if !exist && config.Role == config.ControllerRoleName {
+			audit.AuditServer.Record(&audit.Entry{Type: audit.NodeJoin, Node: member.Address, Role: member.Role})
+		}
+		// 新的controller加入，docker需要连接到它
+		if !exist && config.Role == config.DockerRoleName {
+			logger.Info("Connect new controller", "node", member.Address)
+			connCloseCh <- member.Address
+		}
+	case gossip.Dead, gossip.Left:
+		if config.Role != config.ControllerRoleName {
+			return
+		}
+		config.NodesLock.Lock()
+		_, exist := config.Controllers[member.Address]
+		delete(config.Controllers, member.Address)
+		config.NodesLock.Unlock()
+		if !exist {
+			return
+		}
+		if member.State == gossip.Dead {
+			notify.NotifyServer.Notify(&notify.Event{Type: notify.ControllerOffline, Node: member.Address})
+			audit.AuditServer.Record(&audit.Entry{Type: audit.NodeOffline, Node: member.Address, Role: member.Role})
+		} else {
+			audit.AuditServer.Record(&audit.Entry{Type: audit.NodeLeave, Node: member.Address, Role: member.Role})
+		}
+	}
+}
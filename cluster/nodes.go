@@ -0,0 +1,256 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hugb/beegecluster/audit"
+	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/gossip"
+	"github.com/hugb/beegecluster/raft"
+	"github.com/hugb/beegecluster/registry"
+	"github.com/hugb/beegecluster/resource"
+	"github.com/hugb/beegecluster/utils"
+)
+
+const (
+	NodeOnline  = "online"
+	NodeStale   = "stale"
+	NodeSuspect = "suspect"
+	NodeOffline = "offline"
+)
+
+// docker最近一次上报的主机状态
+type nodeStatus struct {
+	Time       int64
+	SystemInfo *utils.SystemInfo
+	Version    *resource.Version
+}
+
+var nodeStatuses = struct {
+	sync.RWMutex
+	m map[string]*nodeStatus
+}{m: make(map[string]*nodeStatus)}
+
+func setNodeStatus(address string, systemInfo *utils.SystemInfo) {
+	nodeStatuses.Lock()
+	defer nodeStatuses.Unlock()
+
+	status, ok := nodeStatuses.m[address]
+	if !ok {
+		status = &nodeStatus{}
+		nodeStatuses.m[address] = status
+	}
+	status.Time = time.Now().Unix()
+	if systemInfo != nil {
+		status.SystemInfo = systemInfo
+	}
+}
+
+func setNodeVersion(address string, version *resource.Version) {
+	nodeStatuses.Lock()
+	defer nodeStatuses.Unlock()
+
+	status, ok := nodeStatuses.m[address]
+	if !ok {
+		status = &nodeStatus{Time: time.Now().Unix()}
+		nodeStatuses.m[address] = status
+	}
+	status.Version = version
+}
+
+// 得到docker报告的版本，未报告时返回nil
+func NodeVersion(address string) *resource.Version {
+	return lookupNodeStatus(address).Version
+}
+
+// 得到在线docker报告的版本，只读取已缓存的状态，供每个请求检查版本时使用
+func DockerVersions() []*resource.Version {
+	config.NodesLock.RLock()
+	addresses := make([]string, 0, len(config.Dockers))
+	for address := range config.Dockers {
+		addresses = append(addresses, address)
+	}
+	config.NodesLock.RUnlock()
+
+	var versions []*resource.Version
+	for _, address := range addresses {
+		// 与Nodes一致，成员管理认为不在线的docker不计入
+		if gossip.Members != nil {
+			if member, ok := gossip.Members.Lookup(address); ok && member.State != gossip.Alive {
+				continue
+			}
+		}
+		if version := NodeVersion(address); version != nil {
+			versions = append(versions, version)
+		}
+	}
+	return versions
+}
+
+func lookupNodeStatus(address string) nodeStatus {
+	nodeStatuses.RLock()
+	defer nodeStatuses.RUnlock()
+
+	if status, ok := nodeStatuses.m[address]; ok {
+		return *status
+	}
+	return nodeStatus{}
+}
+
+// 得到所有集群成员
+func Nodes() resource.NodeArray {
+	images := registry.RegistryServer.CountImagesByHost()
+	containers := registry.RegistryServer.CountContainersByHost()
+	leader, _ := raft.Leader()
+
+	nodes := make(map[string]*resource.Node)
+	add := func(address, role, state string) {
+		if _, exist := nodes[address]; !exist {
+			nodes[address] = &resource.Node{Id: address, Role: role, Address: address, State: state}
+		}
+	}
+
+	config.NodesLock.RLock()
+	for address := range config.Dockers {
+		add(address, config.DockerRoleName, NodeOnline)
+	}
+	for address := range config.StaleDockers {
+		add(address, config.DockerRoleName, NodeStale)
+	}
+	for address := range config.Controllers {
+		add(address, config.ControllerRoleName, NodeOnline)
+	}
+	for address := range config.StaleControllers {
+		add(address, config.ControllerRoleName, NodeStale)
+	}
+	for address, node := range nodes {
+		node.Schedule = config.DockerStates[address]
+	}
+	config.NodesLock.RUnlock()
+
+	var members []gossip.Member
+	if gossip.Members != nil {
+		members = gossip.Members.List()
+	}
+	for _, member := range members {
+		state := NodeOnline
+		switch member.State {
+		case gossip.Suspect:
+			state = NodeSuspect
+		case gossip.Dead, gossip.Left:
+			state = NodeOffline
+		}
+		node, exist := nodes[member.Address]
+		if !exist {
+			// docker通过成员管理可见，但尚未连接到本controller
+			if state == NodeOnline {
+				state = NodeStale
+			}
+			add(member.Address, member.Role, state)
+			node = nodes[member.Address]
+		} else if state != NodeOnline {
+			node.State = state
+		}
+		node.Labels = member.Labels
+		node.LastHeartbeat = member.LastSeen
+	}
+
+	var result resource.NodeArray
+	for address, node := range nodes {
+		if address == config.Get().ClusterAddress {
+			node.Labels = config.Get().Labels
+			node.LastHeartbeat = time.Now().Unix()
+			node.Version = &resource.Version{
+				Version:   config.Version,
+				GoVersion: runtime.Version(),
+				Os:        runtime.GOOS,
+				Arch:      runtime.GOARCH,
+			}
+		}
+		if status := lookupNodeStatus(address); status.Time != 0 {
+			node.LastHeartbeat = status.Time
+			node.SystemInfo = status.SystemInfo
+			node.Version = status.Version
+		}
+		node.Leader = node.Role == config.ControllerRoleName && address == leader
+		node.Images = images[address]
+		node.Containers = containers[address]
+		result = append(result, node)
+	}
+	sort.Sort(result)
+	return result
+}
+
+func LookupNode(id string) (*resource.Node, bool) {
+	for _, node := range Nodes() {
+		if node.Id == id {
+			return node, true
+		}
+	}
+	return nil, false
+}
+
+// 强制将节点移出集群，由leader提交后在所有controller生效，
+// 之后节点重新连接也不再接纳，直到通过ReadmitNode重新允许
+func EvictNode(ctx context.Context, id string) error {
+	node, exist := LookupNode(id)
+	if !exist {
+		return fmt.Errorf("No such node: %s", id)
+	}
+	if id == config.Get().ClusterAddress {
+		return fmt.Errorf("Conflict: can't evict the controller itself")
+	}
+	// 先移出raft成员，之后不再计入多数派
+	if node.Role == config.ControllerRoleName {
+		if err := raft.RemoveMember(ctx, id); err != nil {
+			return err
+		}
+	}
+	return raft.ProposeContext(ctx, "node_evict", id)
+}
+
+// 重新允许被移出的节点加入集群，由leader提交后在所有controller生效
+func ReadmitNode(ctx context.Context, id string) error {
+	if !Evicted(id) {
+		return fmt.Errorf("No such evicted node: %s", id)
+	}
+	return raft.ProposeContext(ctx, "node_readmit", id)
+}
+
+// 节点是否已被移出集群
+func Evicted(address string) bool {
+	config.NodesLock.RLock()
+	defer config.NodesLock.RUnlock()
+
+	_, evicted := config.EvictedNodes[address]
+	return evicted
+}
+
+// 清除节点的所有信息并断开其连接，重新允许之前拒绝其连接和成员消息
+func ForgetNode(address string) {
+	audit.AuditServer.Record(&audit.Entry{Type: audit.NodeEvict, Node: address})
+
+	if gossip.Members != nil {
+		gossip.Members.Forget(address)
+	}
+
+	nodeStatuses.Lock()
+	delete(nodeStatuses.m, address)
+	nodeStatuses.Unlock()
+
+	eventCursors.Lock()
+	delete(eventCursors.m, address)
+	eventCursors.Unlock()
+
+	registry.RegistryServer.UnregisterImagesByHost(address)
+	registry.RegistryServer.UnregisterContainersByHost(address)
+
+	// 主动移除的节点断开时不需要告警
+	setLeaving(address, true)
+	ClusterSwitcher.Disconnect(address)
+}
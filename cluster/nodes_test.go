@@ -0,0 +1,132 @@
+package cluster
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/registry"
+	"github.com/hugb/beegecluster/resource"
+	"github.com/hugb/beegecluster/utils"
+)
+
+// 替换节点列表，测试结束后还原
+func resetNodes(t *testing.T) {
+	config.NodesLock.Lock()
+	dockers, controllers := config.Dockers, config.Controllers
+	staleDockers, staleControllers := config.StaleDockers, config.StaleControllers
+	states, evicted := config.DockerStates, config.EvictedNodes
+	config.Dockers, config.Controllers = make(map[string]int64), make(map[string]int64)
+	config.StaleDockers, config.StaleControllers = make(map[string]int64), make(map[string]int64)
+	config.DockerStates, config.EvictedNodes = make(map[string]string), make(map[string]int64)
+	config.NodesLock.Unlock()
+	t.Cleanup(func() {
+		config.NodesLock.Lock()
+		config.Dockers, config.Controllers = dockers, controllers
+		config.StaleDockers, config.StaleControllers = staleDockers, staleControllers
+		config.DockerStates, config.EvictedNodes = states, evicted
+		config.NodesLock.Unlock()
+	})
+}
+
+func TestNodesListsMembers(t *testing.T) {
+	resetNodes(t)
+	previous := config.Get()
+	c := *previous
+	c.ClusterAddress = "10.0.0.40:4244"
+	config.Set(&c)
+	defer config.Set(previous)
+
+	config.Controllers["10.0.0.40:4244"] = 1
+	config.Dockers["10.0.0.41:4243"] = 1
+	config.StaleDockers["10.0.0.42:4243"] = 1
+	config.DockerStates["10.0.0.41:4243"] = config.DockerCordoned
+	registry.RegistryServer.RegisterImage("img-nodes", &resource.Image{Host: "10.0.0.41:4243"})
+	defer registry.RegistryServer.UnregisterImage("img-nodes")
+	setNodeVersion("10.0.0.41:4243", &resource.Version{ApiVersion: "1.26"})
+	defer func() {
+		nodeStatuses.Lock()
+		delete(nodeStatuses.m, "10.0.0.41:4243")
+		nodeStatuses.Unlock()
+	}()
+
+	nodes := Nodes()
+	if len(nodes) != 3 {
+		t.Fatalf("expected 3 nodes, got %d", len(nodes))
+	}
+	docker, ok := LookupNode("10.0.0.41:4243")
+	if !ok || docker.State != NodeOnline || docker.Schedule != config.DockerCordoned || docker.Images != 1 || docker.Version.ApiVersion != "1.26" {
+		t.Fatalf("unexpected docker %+v", docker)
+	}
+	if stale, _ := LookupNode("10.0.0.42:4243"); stale.State != NodeStale {
+		t.Fatalf("expected restored docker to be stale, got %s", stale.State)
+	}
+	// 没有raft时自己即为leader
+	if self, _ := LookupNode("10.0.0.40:4244"); !self.Leader || self.Role != config.ControllerRoleName {
+		t.Fatalf("expected controller to be the leader, got %+v", self)
+	}
+	if _, ok = LookupNode("10.0.0.43:4243"); ok {
+		t.Fatal("expected unknown node not to be found")
+	}
+}
+
+func TestDockerVersionsListsOnlineDockers(t *testing.T) {
+	resetNodes(t)
+	config.Dockers["10.0.0.44:4243"] = 1
+	config.Dockers["10.0.0.45:4243"] = 1
+	config.StaleDockers["10.0.0.46:4243"] = 1
+	setNodeVersion("10.0.0.44:4243", &resource.Version{ApiVersion: "1.26", MinAPIVersion: "1.12"})
+	setNodeVersion("10.0.0.46:4243", &resource.Version{ApiVersion: "1.10", MinAPIVersion: "1.0"})
+	defer func() {
+		nodeStatuses.Lock()
+		delete(nodeStatuses.m, "10.0.0.44:4243")
+		delete(nodeStatuses.m, "10.0.0.46:4243")
+		nodeStatuses.Unlock()
+	}()
+
+	// 未报告版本和未连接的docker不计入
+	versions := DockerVersions()
+	if len(versions) != 1 || versions[0].ApiVersion != "1.26" {
+		t.Fatalf("expected only the online docker version, got %v", versions)
+	}
+}
+
+func TestEvictNodeValidates(t *testing.T) {
+	resetNodes(t)
+	previous := config.Get()
+	c := *previous
+	c.ClusterAddress = "10.0.0.40:4244"
+	config.Set(&c)
+	defer config.Set(previous)
+	config.Controllers["10.0.0.40:4244"] = 1
+
+	if err := EvictNode(context.Background(), "10.0.0.43:4243"); err == nil || !strings.HasPrefix(err.Error(), "No such node") {
+		t.Fatalf("expected unknown node to be rejected, got %v", err)
+	}
+	if err := EvictNode(context.Background(), "10.0.0.40:4244"); err == nil || !strings.HasPrefix(err.Error(), "Conflict") {
+		t.Fatalf("expected controller not to evict itself, got %v", err)
+	}
+}
+
+func TestEvictedNodeIsRejected(t *testing.T) {
+	resetNodes(t)
+	address := "10.0.0.44:4243"
+	config.EvictedNodes[address] = 1
+
+	server, client := net.Pipe()
+	defer client.Close()
+	c := &utils.Connection{Conn: server}
+	dockerGreetings(c, []byte(address))
+	if c.Src != "" {
+		t.Fatal("expected evicted docker not to be greeted")
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected connection of evicted docker to be closed, got %v", err)
+	}
+	if err := ReadmitNode(context.Background(), "10.0.0.45:4243"); err == nil || !strings.HasPrefix(err.Error(), "No such") {
+		t.Fatalf("expected node that was not evicted to be rejected, got %v", err)
+	}
+}
@@ -4,17 +4,17 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/hugb/beegecluster/config"
 	"github.com/hugb/beegecluster/utils"
 )
 
-const (
-	maxMessageSize = 256
-)
-
 type HandlerFunc func(c *utils.Connection, data []byte)
 
 type Switcher struct {
 	broadcast   chan []byte
+	flush       chan *flushMessage
+	disconnect  chan string
+	lookup      chan *lookupMessage
 	handlers    map[string]HandlerFunc
 	register    chan *utils.Connection
 	unregister  chan *utils.Connection
@@ -27,11 +27,26 @@ var ClusterSwitcher = &Switcher{
 	register:    make(chan *utils.Connection, 1),
 	unregister:  make(chan *utils.Connection, 1),
 	connections: make(map[*utils.Connection]int64),
-	broadcast:   make(chan []byte, maxMessageSize),
+	flush:       make(chan *flushMessage),
+	disconnect:  make(chan string, 1),
+	lookup:      make(chan *lookupMessage),
+}
+
+// 查找到指定节点的连接
+type lookupMessage struct {
+	address string
+	reply   chan *utils.Connection
+}
+
+// 需要确认已发送的广播
+type flushMessage struct {
+	data []byte
+	done chan bool
 }
 
-func init() {
-	// 启动交换器
+// 启动交换器，广播队列的长度由配置决定，需在加载配置后调用
+func StartSwitcher() {
+	ClusterSwitcher.broadcast = make(chan []byte, config.Get().Cluster.BroadcastQueueSize)
 	go ClusterSwitcher.run()
 }
 
@@ -52,6 +67,25 @@ func (this *Switcher) run() {
 			for c := range this.connections {
 				c.Conn.Write(m)
 			}
+		case m := <-this.flush:
+			for c := range this.connections {
+				c.Conn.Write(m.data)
+			}
+			m.done <- true
+		case m := <-this.lookup:
+			var found *utils.Connection
+			for c := range this.connections {
+				if c.Src == m.address {
+					found = c
+				}
+			}
+			m.reply <- found
+		case address := <-this.disconnect:
+			for c := range this.connections {
+				if c.Src == address {
+					c.Conn.Close()
+				}
+			}
 		}
 	}
 }
@@ -78,3 +112,22 @@ func (this *Switcher) Register(command string, handler HandlerFunc) error {
 	this.handlers[command] = handler
 	return nil
 }
+
+// 广播并等待数据写入所有连接，用于退出前的通知
+func (this *Switcher) BroadcastWait(data []byte) {
+	m := &flushMessage{data: data, done: make(chan bool, 1)}
+	this.flush <- m
+	<-m.done
+}
+
+// 得到到指定节点的连接，不存在时返回nil
+func (this *Switcher) Lookup(address string) *utils.Connection {
+	m := &lookupMessage{address: address, reply: make(chan *utils.Connection, 1)}
+	this.lookup <- m
+	return <-m.reply
+}
+
+// 断开与指定节点的连接
+func (this *Switcher) Disconnect(address string) {
+	this.disconnect <- address
+}
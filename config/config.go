@@ -1,12 +1,250 @@
 package config
 
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 节点配置，依次由默认值、配置文件、环境变量和命令行参数覆盖；
+// 生效后不再修改，需要变更时整体替换。带有reload:"restart"标签的配置项
+// 在启动时使用，重新加载时保留原值，重启后才生效
+type Config struct {
+	// 集群接入点，多个以逗号分隔
+	JoinAddress    string `env:"BEEGE_JOIN" flag:"j" usage:"Join Address" reload:"restart"`
+	ServiceAddress string `env:"BEEGE_SERVICE" flag:"p" usage:"Service Address" reload:"restart"`
+	ClusterAddress string `env:"BEEGE_CLUSTER" flag:"c" usage:"Cluster Address" reload:"restart"`
+
+	// 节点标签，通过成员管理告知其他节点
+	Labels map[string]string `env:"BEEGE_LABELS" flag:"l" usage:"Labels, key=value separated by comma" reload:"restart"`
+	// 事件通知规则文件
+	NotifyRules string `env:"BEEGE_NOTIFY_RULES" flag:"n" usage:"Notify Rules File"`
+	// controller状态存储地址
+	StateStore string `env:"BEEGE_STATE_STORE" flag:"s" usage:"State Store" reload:"restart"`
+	// raft的任期、日志和快照等持久化数据的目录
+	DataDir string `env:"BEEGE_DATA_DIR" flag:"datadir" usage:"Data directory for raft log and snapshots" reload:"restart"`
+	// 代理到api版本较低的docker时是否改写请求的版本
+	DowngradeAPIVersion bool `env:"BEEGE_DOWNGRADE_API_VERSION" flag:"a" usage:"Downgrade API version for older dockers"`
+
+	State     StateConfig
+	Docker    DockerConfig
+	Agent     AgentConfig
+	Cluster   ClusterConfig
+	Scheduler SchedulerConfig
+	Proxy     ProxyConfig
+	Server    ServerConfig
+	TLS       TLSConfig
+	Auth      AuthConfig
+	Audit     AuditConfig
+	Log       LogConfig
+	Trace     TraceConfig
+}
+
+// controller状态快照
+type StateConfig struct {
+	// 保存快照的间隔
+	SnapshotInterval Duration `env:"BEEGE_SNAPSHOT_INTERVAL"`
+	// 从快照恢复的节点超过此时间仍未重新连接时清除，其镜像和容器不再可见
+	StaleTimeout Duration `env:"BEEGE_STALE_TIMEOUT" reload:"restart"`
+}
+
+// docker模块
+type DockerConfig struct {
+	// 上报主机状态的间隔
+	StatusInterval Duration `env:"BEEGE_STATUS_INTERVAL" reload:"restart"`
+	// 与controller断开后等待多久重连
+	ReconnectWait Duration `env:"BEEGE_RECONNECT_WAIT"`
+}
+
+// 独立运行的docker节点，通过远程api管理本机的docker，
+// ClusterAddress为controller访问该docker远程api的地址
+type AgentConfig struct {
+	// 本机docker的地址：unix://path、tcp://host:port或http(s)://host:port
+	DockerHost string `env:"BEEGE_DOCKER_HOST" flag:"dockerhost" usage:"Local docker in agent mode: unix://path, tcp://host:port or http(s)://host:port" reload:"restart"`
+}
+
+// 集群内部通信
+type ClusterConfig struct {
+	// 等待广播的消息数，满时广播阻塞
+	BroadcastQueueSize int `env:"BEEGE_BROADCAST_QUEUE_SIZE" reload:"restart"`
+}
+
+type SchedulerConfig struct {
+	// 没有主机已有镜像时如何选择：spread选择容器最少的主机，binpack选择容器最多的主机
+	Strategy string `env:"BEEGE_SCHEDULER_STRATEGY" flag:"strategy" usage:"Scheduling strategy: spread or binpack"`
+}
+
+type ProxyConfig struct {
+	// 幂等请求失败时最多尝试的次数，包括第一次
+	RetryAttempts int `env:"BEEGE_RETRY_ATTEMPTS" flag:"r" usage:"Attempts for idempotent requests"`
+	// 两次尝试之间的等待时间，每次加倍
+	RetryBackoff Duration `env:"BEEGE_RETRY_BACKOFF"`
+
+	// docker连续失败多少次后暂停向其转发请求
+	BreakerThreshold int `env:"BEEGE_BREAKER_THRESHOLD" flag:"b" usage:"Failures before a docker is skipped"`
+	// 暂停转发的时间，之后允许一个请求试探
+	BreakerCooldown Duration `env:"BEEGE_BREAKER_COOLDOWN"`
+
+	// 到每个docker的连接池设置，ResponseHeaderTimeout为0时只受请求超时限制；
+	// 连接池创建后不再修改
+	DialTimeout           Duration `env:"BEEGE_DIAL_TIMEOUT" reload:"restart"`
+	TLSHandshakeTimeout   Duration `env:"BEEGE_TLS_HANDSHAKE_TIMEOUT" reload:"restart"`
+	ResponseHeaderTimeout Duration `env:"BEEGE_RESPONSE_HEADER_TIMEOUT" reload:"restart"`
+	IdleConnTimeout       Duration `env:"BEEGE_IDLE_CONN_TIMEOUT" reload:"restart"`
+	MaxIdleConnsPerHost   int      `env:"BEEGE_MAX_IDLE_CONNS_PER_HOST" reload:"restart"`
+	MaxConnsPerHost       int      `env:"BEEGE_MAX_CONNS_PER_HOST" reload:"restart"`
+
+	// 代理请求的默认超时和查询类请求的超时，由请求的context控制，
+	// 长时间运行的请求不受限制
+	Timeout        Duration `env:"BEEGE_PROXY_TIMEOUT"`
+	InspectTimeout Duration `env:"BEEGE_INSPECT_TIMEOUT"`
+
+	// 流式响应写给客户端的最大延迟
+	FlushInterval Duration `env:"BEEGE_FLUSH_INTERVAL"`
+
+	// 每个来源ip在各类路由上的速率和并发限制
+	RateLimits map[string]*RateLimit `env:"BEEGE_RATE_LIMITS" flag:"ratelimit" usage:"Rate limits, class=rate:burst:concurrent separated by comma"`
+}
+
+// 服务端读写超时，不限制时间的请求会取消读写超时
+type ServerConfig struct {
+	ReadHeaderTimeout Duration `env:"BEEGE_READ_HEADER_TIMEOUT" reload:"restart"`
+	ReadTimeout       Duration `env:"BEEGE_READ_TIMEOUT" reload:"restart"`
+	WriteTimeout      Duration `env:"BEEGE_WRITE_TIMEOUT" reload:"restart"`
+	IdleTimeout       Duration `env:"BEEGE_IDLE_TIMEOUT" reload:"restart"`
+}
+
+// 证书和CA可以重新加载，开启或关闭https需要重启
+type TLSConfig struct {
+	// 服务端证书，设置后以https提供服务
+	Cert   string `env:"BEEGE_TLS_CERT" flag:"tlscert" usage:"Path to TLS certificate file"`
+	Key    string `env:"BEEGE_TLS_KEY" flag:"tlskey" usage:"Path to TLS key file"`
+	CACert string `env:"BEEGE_TLS_CACERT" flag:"tlscacert" usage:"Trust only remotes providing a certificate signed by this CA"`
+	// 是否要求客户端证书由CA签发
+	Verify bool `env:"BEEGE_TLS_VERIFY" flag:"tlsverify" usage:"Use TLS and verify the remote"`
+	// 是否以https连接所有docker，否则只对带有tls标签的docker使用https
+	Nodes bool `env:"BEEGE_TLS_NODES" flag:"tlsnodes" usage:"Use TLS to connect to all dockers"`
+}
+
+type AuthConfig struct {
+	// 用户和角色文件，设置后开启认证
+	Policy string `env:"BEEGE_AUTH_POLICY" flag:"u" usage:"Users and Roles File"`
+	// controller之间的共享密钥，follower转发请求时用于签名已认证的用户，
+	// 开启认证时必须设置
+	ClusterSecret string `env:"BEEGE_CLUSTER_SECRET"`
+}
+
+type AuditConfig struct {
+	// 审计日志文件，超过MaxSize后轮转，共保留MaxFiles个文件
+	File     string `env:"BEEGE_AUDIT_LOG" flag:"auditlog" usage:"Audit Log File" reload:"restart"`
+	MaxSize  int64  `env:"BEEGE_AUDIT_MAX_SIZE"`
+	MaxFiles int    `env:"BEEGE_AUDIT_MAX_FILES"`
+}
+
+type LogConfig struct {
+	// 日志级别debug、info、warn或error，格式text或json，级别可在运行时修改
+	Level  string `env:"BEEGE_LOG_LEVEL" flag:"loglevel" usage:"Log level: debug, info, warn or error"`
+	Format string `env:"BEEGE_LOG_FORMAT" flag:"logformat" usage:"Log format: text or json" reload:"restart"`
+}
+
+type TraceConfig struct {
+	// 追踪数据导出到file://路径或OTLP/HTTP collector地址，为空时不导出
+	Export string `env:"BEEGE_TRACE" flag:"trace" usage:"Export traces to file://path or an OTLP/HTTP collector url" reload:"restart"`
+}
+
+// 默认配置
+func Default() *Config {
+	return &Config{
+		Labels:     make(map[string]string),
+		StateStore: "file://beegecluster.state",
+		DataDir:    "/var/lib/beegecluster",
+		State: StateConfig{
+			SnapshotInterval: Duration(10 * time.Second),
+			StaleTimeout:     Duration(10 * time.Minute),
+		},
+		Docker: DockerConfig{
+			StatusInterval: Duration(5 * time.Second),
+			ReconnectWait:  Duration(3 * time.Second),
+		},
+		Agent: AgentConfig{
+			DockerHost: "unix:///var/run/docker.sock",
+		},
+		Cluster: ClusterConfig{
+			BroadcastQueueSize: 256,
+		},
+		Scheduler: SchedulerConfig{
+			Strategy: StrategySpread,
+		},
+		Proxy: ProxyConfig{
+			RetryAttempts:       3,
+			RetryBackoff:        Duration(100 * time.Millisecond),
+			BreakerThreshold:    5,
+			BreakerCooldown:     Duration(30 * time.Second),
+			DialTimeout:         Duration(5 * time.Second),
+			TLSHandshakeTimeout: Duration(5 * time.Second),
+			IdleConnTimeout:     Duration(90 * time.Second),
+			MaxIdleConnsPerHost: 16,
+			MaxConnsPerHost:     128,
+			Timeout:             Duration(60 * time.Second),
+			InspectTimeout:      Duration(10 * time.Second),
+			FlushInterval:       Duration(50 * time.Millisecond),
+			RateLimits: map[string]*RateLimit{
+				RouteClassRead:   {Rate: 50, Burst: 100, Concurrent: 32},
+				RouteClassWrite:  {Rate: 10, Burst: 20, Concurrent: 8},
+				RouteClassStream: {Rate: 2, Burst: 10, Concurrent: 16},
+			},
+		},
+		Server: ServerConfig{
+			ReadHeaderTimeout: Duration(10 * time.Second),
+			ReadTimeout:       Duration(10 * time.Minute),
+			WriteTimeout:      Duration(10 * time.Minute),
+			IdleTimeout:       Duration(2 * time.Minute),
+		},
+		Audit: AuditConfig{
+			MaxSize:  100 * 1024 * 1024,
+			MaxFiles: 5,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+	}
+}
+
+// 当前生效的配置
+var current atomic.Pointer[Config]
+
+func init() {
+	current.Store(Default())
+}
+
+func Get() *Config {
+	return current.Load()
+}
+
+func Set(c *Config) {
+	current.Store(c)
+}
+
 var (
-	Role string
+	// 版本号，来自VERSION文件
+	Version string
 
-	JoinAddress    string
-	ServiceAddress string
-	ClusterAddress string
+	Role string
 
 	Dockers     = make(map[string]int64)
 	Controllers = make(map[string]int64)
+
+	// 从快照恢复、尚未重新连接确认的节点
+	StaleDockers     = make(map[string]int64)
+	StaleControllers = make(map[string]int64)
+
+	// docker的调度状态，非空时不再向其调度容器
+	DockerStates = make(map[string]string)
+
+	// 被强制移出集群的节点及移出时间，重新允许加入之前拒绝其连接
+	EvictedNodes = make(map[string]int64)
+
+	// 保护以上节点表的并发访问
+	NodesLock sync.RWMutex
 )
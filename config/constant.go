@@ -3,4 +3,29 @@ package config
 const (
 	DockerRoleName     = "docker"
 	ControllerRoleName = "controller"
+
+	// docker的调度状态，正常状态为空
+	DockerCordoned = "cordoned"
+	DockerDraining = "draining"
+	DockerDrained  = "drained"
+
+	// 调度策略
+	StrategySpread  = "spread"
+	StrategyBinpack = "binpack"
+
+	// 通过controller创建的容器上记录租户的标签
+	TenantLabel = "beege.tenant"
+	// 租户创建的容器的内存限制，各controller据此从docker上报的容器恢复配额用量
+	TenantMemoryLabel = "beege.memory"
+	// 值为true的容器在排空docker时可以迁移到其他docker
+	RescheduleLabel = "beege.reschedule"
+
+	// docker以https提供api时设置的标签
+	TLSLabel = "tls"
+
+	// docker未报告最低api版本时使用的默认值
+	DefaultMinAPIVersion = "1.0"
+
+	// docker本地保存的事件条数
+	EventJournalSize = 1024
 )
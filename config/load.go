@@ -0,0 +1,288 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// 配置文件中的时间，如"5s"、"100ms"
+type Duration time.Duration
+
+func (this Duration) Duration() time.Duration {
+	return time.Duration(this)
+}
+
+func (this Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(this).String()), nil
+}
+
+func (this *Duration) UnmarshalText(text []byte) error {
+	d, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("Bad parameter: duration %q", text)
+	}
+	*this = Duration(d)
+	return nil
+}
+
+// 未通过-config指定时读取的配置文件
+const ConfigFileEnv = "BEEGE_CONFIG"
+
+// 最近一次加载使用的配置文件和命令行，重新加载时使用
+var source struct {
+	sync.Mutex
+	path  string
+	flags *flag.FlagSet
+}
+
+// 加载配置：默认值、配置文件、环境变量，最后是命令行中指定了的参数；
+// 配置文件按扩展名解析json、yaml或toml
+func Load(path string, flags *flag.FlagSet) (*Config, error) {
+	source.Lock()
+	source.path, source.flags = path, flags
+	source.Unlock()
+
+	c := Default()
+	if path == "" {
+		path = os.Getenv(ConfigFileEnv)
+	}
+	if path != "" {
+		if err := loadFile(c, path); err != nil {
+			return nil, err
+		}
+	}
+
+	fields := configFields(c)
+	for _, field := range fields {
+		if field.env == "" {
+			continue
+		}
+		if value, ok := os.LookupEnv(field.env); ok {
+			if err := field.set(value); err != nil {
+				return nil, fmt.Errorf("Bad parameter: %s=%s: %s", field.env, value, err)
+			}
+		}
+	}
+
+	if flags != nil {
+		var err error
+		flags.Visit(func(f *flag.Flag) {
+			for _, field := range fields {
+				if field.flag == f.Name && err == nil {
+					if e := field.set(f.Value.String()); e != nil {
+						err = fmt.Errorf("Bad parameter: -%s %s: %s", f.Name, f.Value, e)
+					}
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func loadFile(c *Config, path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// yaml和toml先解析为通用结构，再统一按json的规则填充配置
+	var generic map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &generic)
+	case ".toml":
+		err = toml.Unmarshal(content, &generic)
+	default:
+		return fmt.Errorf("Bad parameter: unknown config file format %s", path)
+	}
+	if err != nil {
+		return fmt.Errorf("Bad parameter: %s: %s", path, err)
+	}
+	if generic != nil {
+		if content, err = json.Marshal(generic); err != nil {
+			return fmt.Errorf("Bad parameter: %s: %s", path, err)
+		}
+	}
+
+	// 拼写错误的配置项直接报错，而不是被忽略
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(c); err != nil {
+		return fmt.Errorf("Bad parameter: %s: %s", path, err)
+	}
+	return nil
+}
+
+// 可以通过环境变量或命令行设置的配置项
+type configField struct {
+	// 配置文件中的路径，如Proxy.RetryAttempts
+	name  string
+	env   string
+	flag  string
+	usage string
+	// 重新加载时不生效，需要重启
+	restart bool
+	value   reflect.Value
+}
+
+func configFields(c *Config) []*configField {
+	var fields []*configField
+	var walk func(prefix string, v reflect.Value)
+	walk = func(prefix string, v reflect.Value) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			if sf.Type.Kind() == reflect.Struct {
+				walk(prefix+sf.Name+".", v.Field(i))
+				continue
+			}
+			fields = append(fields, &configField{
+				name:    prefix + sf.Name,
+				env:     sf.Tag.Get("env"),
+				flag:    sf.Tag.Get("flag"),
+				usage:   sf.Tag.Get("usage"),
+				restart: sf.Tag.Get("reload") == "restart",
+				value:   v.Field(i),
+			})
+		}
+	}
+	walk("", reflect.ValueOf(c).Elem())
+	return fields
+}
+
+// 配置项的字符串形式，用于显示默认值
+func (this *configField) String() string {
+	switch value := this.value.Interface().(type) {
+	case Duration:
+		return value.Duration().String()
+	case bool:
+		// 与flag包一致，false不显示为默认值
+		if value {
+			return "true"
+		}
+	case string, int, int64:
+		return fmt.Sprint(value)
+	}
+	return ""
+}
+
+// 从字符串设置配置项
+func (this *configField) set(value string) error {
+	switch target := this.value.Addr().Interface().(type) {
+	case *Duration:
+		return target.UnmarshalText([]byte(value))
+	case *map[string]string:
+		labels, err := ParseLabels(value)
+		if err != nil {
+			return err
+		}
+		*target = labels
+		return nil
+	case *map[string]*RateLimit:
+		limits, err := ParseRateLimits(value)
+		if err != nil {
+			return err
+		}
+		// 只覆盖指定的路由类别
+		merged := make(map[string]*RateLimit)
+		for class, limit := range *target {
+			merged[class] = limit
+		}
+		for class, limit := range limits {
+			merged[class] = limit
+		}
+		*target = merged
+		return nil
+	}
+
+	switch this.value.Kind() {
+	case reflect.String:
+		this.value.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		this.value.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		this.value.SetInt(n)
+	default:
+		return fmt.Errorf("unsupported type %s", this.value.Type())
+	}
+	return nil
+}
+
+// 命令行参数只记录取值，由Load按优先级应用
+type flagValue struct {
+	value  string
+	isBool bool
+}
+
+func (this *flagValue) String() string {
+	return this.value
+}
+
+func (this *flagValue) Set(value string) error {
+	this.value = value
+	return nil
+}
+
+func (this *flagValue) IsBoolFlag() bool {
+	return this.isBool
+}
+
+// 注册所有带flag标签的配置项
+func RegisterFlags(flags *flag.FlagSet) {
+	for _, field := range configFields(Default()) {
+		if field.flag == "" {
+			continue
+		}
+		value := &flagValue{value: field.String(), isBool: field.value.Kind() == reflect.Bool}
+		usage := field.usage
+		if field.env != "" {
+			usage = fmt.Sprintf("%s (env %s)", usage, field.env)
+		}
+		flags.Var(value, field.flag, usage)
+	}
+}
+
+// 解析"key=value,key2=value2"格式的标签
+func ParseLabels(value string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Bad parameter: label %s", pair)
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
+}
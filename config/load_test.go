@@ -0,0 +1,153 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func parseFlags(t *testing.T, args ...string) *flag.FlagSet {
+	flags := flag.NewFlagSet("beegecluster", flag.ContinueOnError)
+	RegisterFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return flags
+}
+
+func TestLoadDefaults(t *testing.T) {
+	t.Setenv(ConfigFileEnv, "")
+	c, err := Load("", parseFlags(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Proxy.RetryAttempts != 3 || c.Docker.StatusInterval.Duration() != 5*time.Second || c.Scheduler.Strategy != StrategySpread {
+		t.Fatalf("expected defaults, got %+v", c)
+	}
+}
+
+func TestLoadOrder(t *testing.T) {
+	path := writeConfig(t, "beege.json", `{
+		"JoinAddress": "file:4244",
+		"Proxy": {"RetryAttempts": 5, "BreakerThreshold": 7, "RetryBackoff": "250ms"},
+		"Log": {"Level": "debug"}
+	}`)
+	t.Setenv("BEEGE_RETRY_ATTEMPTS", "6")
+	t.Setenv("BEEGE_JOIN", "env:4244")
+	t.Setenv("BEEGE_LABELS", "zone=a,disk=ssd")
+
+	// 命令行中未指定的参数不覆盖配置文件和环境变量
+	c, err := Load(path, parseFlags(t, "-j", "flag:4244"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.JoinAddress != "flag:4244" {
+		t.Fatalf("expected flag to override env and file, got %s", c.JoinAddress)
+	}
+	if c.Proxy.RetryAttempts != 6 {
+		t.Fatalf("expected env to override file, got %d", c.Proxy.RetryAttempts)
+	}
+	if c.Proxy.BreakerThreshold != 7 || c.Proxy.RetryBackoff.Duration() != 250*time.Millisecond || c.Log.Level != "debug" {
+		t.Fatalf("expected file to override defaults, got %+v", c.Proxy)
+	}
+	if c.Proxy.MaxConnsPerHost != 128 {
+		t.Fatal("expected unset fields to keep the default")
+	}
+	if c.Labels["zone"] != "a" || c.Labels["disk"] != "ssd" {
+		t.Fatalf("unexpected labels %v", c.Labels)
+	}
+}
+
+func TestLoadFileFromEnv(t *testing.T) {
+	t.Setenv(ConfigFileEnv, writeConfig(t, "beege.json", `{"DataDir": "/data/beege"}`))
+	c, err := Load("", nil)
+	if err != nil || c.DataDir != "/data/beege" {
+		t.Fatalf("expected config file from %s, got %v", ConfigFileEnv, err)
+	}
+}
+
+func TestLoadRateLimitFlagMergesClasses(t *testing.T) {
+	t.Setenv(ConfigFileEnv, "")
+	c, err := Load("", parseFlags(t, "-ratelimit", "write=1:2:3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit := c.Proxy.RateLimits[RouteClassWrite]; limit.Rate != 1 || limit.Burst != 2 || limit.Concurrent != 3 {
+		t.Fatalf("unexpected write limit %+v", limit)
+	}
+	if limit := c.Proxy.RateLimits[RouteClassRead]; limit == nil || limit.Rate != 50 {
+		t.Fatalf("expected other classes to keep the default, got %+v", limit)
+	}
+}
+
+func TestLoadRejectsBadInput(t *testing.T) {
+	t.Setenv(ConfigFileEnv, "")
+	for name, content := range map[string]string{
+		"unknown.json":  `{"Proxy": {"RetryAttemps": 5}}`,
+		"duration.json": `{"Proxy": {"RetryBackoff": "soon"}}`,
+		"beege.ini":     `RetryAttempts=5`,
+	} {
+		if _, err := Load(writeConfig(t, name, content), nil); err == nil || !strings.HasPrefix(err.Error(), "Bad parameter") {
+			t.Fatalf("expected %s to be rejected, got %v", name, err)
+		}
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.json"), nil); err == nil {
+		t.Fatal("expected missing config file to be rejected")
+	}
+
+	t.Setenv("BEEGE_RETRY_ATTEMPTS", "many")
+	if _, err := Load("", nil); err == nil || !strings.Contains(err.Error(), "BEEGE_RETRY_ATTEMPTS") {
+		t.Fatalf("expected invalid env to be rejected, got %v", err)
+	}
+	os.Unsetenv("BEEGE_RETRY_ATTEMPTS")
+	if _, err := Load("", parseFlags(t, "-b", "x")); err == nil || !strings.Contains(err.Error(), "-b") {
+		t.Fatalf("expected invalid flag to be rejected, got %v", err)
+	}
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	c := Default()
+	c.Proxy.RetryAttempts = 0
+	c.Scheduler.Strategy = "random"
+	c.TLS.Verify = true
+	c.Log.Level = "verbose"
+	c.Proxy.RateLimits["admin"] = &RateLimit{}
+	c.Auth.Policy = os.DevNull
+
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("expected invalid config to be rejected")
+	}
+	for _, problem := range []string{"Proxy.RetryAttempts", "Scheduler.Strategy", "TLS.Verify requires TLS.CACert", "Log.Level", "unknown route class admin", "Auth.Policy requires Auth.ClusterSecret"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Fatalf("expected %q to be reported, got %s", problem, err)
+		}
+	}
+	if err = Default().Validate(); err != nil {
+		t.Fatalf("expected default config to be valid, got %s", err)
+	}
+}
+
+func TestDurationText(t *testing.T) {
+	var d Duration
+	if err := d.UnmarshalText([]byte("1m30s")); err != nil || d.Duration() != 90*time.Second {
+		t.Fatalf("unexpected duration %s %v", d.Duration(), err)
+	}
+	if text, _ := d.MarshalText(); string(text) != "1m30s" {
+		t.Fatalf("unexpected text %s", text)
+	}
+	if err := d.UnmarshalText([]byte("90")); err == nil {
+		t.Fatal("expected duration without unit to be rejected")
+	}
+}
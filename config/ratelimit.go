@@ -0,0 +1,58 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 每个客户端在一类路由上的限制，Rate为每秒请求数，Burst为突发请求数，
+// Concurrent为同时处理的请求数，为0时不限制
+type RateLimit struct {
+	Rate       float64
+	Burst      int
+	Concurrent int
+}
+
+const (
+	RouteClassRead   = "read"
+	RouteClassWrite  = "write"
+	RouteClassStream = "stream"
+)
+
+// 解析class=rate:burst:concurrent形式的限制，多个以逗号分隔
+func ParseRateLimits(value string) (map[string]*RateLimit, error) {
+	limits := make(map[string]*RateLimit)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Bad parameter: rate limit %s", item)
+		}
+		switch parts[0] {
+		case RouteClassRead, RouteClassWrite, RouteClassStream:
+		default:
+			return nil, fmt.Errorf("Bad parameter: unknown route class %s", parts[0])
+		}
+		fields := strings.Split(parts[1], ":")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("Bad parameter: rate limit %s", item)
+		}
+		rate, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil || rate < 0 {
+			return nil, fmt.Errorf("Bad parameter: rate limit %s", item)
+		}
+		burst, err := strconv.Atoi(fields[1])
+		if err != nil || burst < 0 {
+			return nil, fmt.Errorf("Bad parameter: rate limit %s", item)
+		}
+		concurrent, err := strconv.Atoi(fields[2])
+		if err != nil || concurrent < 0 {
+			return nil, fmt.Errorf("Bad parameter: rate limit %s", item)
+		}
+		limits[parts[0]] = &RateLimit{Rate: rate, Burst: burst, Concurrent: concurrent}
+	}
+	return limits, nil
+}
@@ -0,0 +1,90 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// 重新加载的结果
+type ReloadResult struct {
+	// 已经生效的配置项
+	Applied []string
+	// 已修改但需要重启才能生效的配置项，当前仍使用原值
+	Restart []string
+}
+
+// 模块应用新配置：先检查并准备，如读取证书，全部成功后再调用返回的函数使其生效；
+// 不需要处理时返回nil
+type Reloader func(old, c *Config) (func(), error)
+
+var reloaders struct {
+	sync.Mutex
+	list []Reloader
+}
+
+// 注册重新加载时应用配置的模块
+func OnReload(reloader Reloader) {
+	reloaders.Lock()
+	defer reloaders.Unlock()
+
+	reloaders.list = append(reloaders.list, reloader)
+}
+
+// 按启动时的配置文件和命令行重新读取配置，检查通过且所有模块准备完成后
+// 整体替换当前配置，任何一步失败时保持原配置不变
+func Reload() (*ReloadResult, error) {
+	reloaders.Lock()
+	defer reloaders.Unlock()
+
+	source.Lock()
+	path, flags := source.path, source.flags
+	source.Unlock()
+
+	c, err := Load(path, flags)
+	if err != nil {
+		return nil, err
+	}
+	old := Get()
+	result := &ReloadResult{Applied: []string{}, Restart: []string{}}
+
+	// 开启或关闭https需要重新创建监听，TLS配置整体保持原值
+	tlsToggled := tlsEnabled(&old.TLS) != tlsEnabled(&c.TLS)
+	oldFields := configFields(old)
+	for i, field := range configFields(c) {
+		previous := oldFields[i].value
+		if reflect.DeepEqual(field.value.Interface(), previous.Interface()) {
+			continue
+		}
+		if field.restart || (tlsToggled && strings.HasPrefix(field.name, "TLS.")) {
+			field.value.Set(previous)
+			result.Restart = append(result.Restart, field.name)
+			continue
+		}
+		result.Applied = append(result.Applied, field.name)
+	}
+	// 保留原值后再次检查，避免组合出无效的配置
+	if err = c.Validate(); err != nil {
+		return nil, err
+	}
+
+	var commits []func()
+	for _, reloader := range reloaders.list {
+		commit, err := reloader(old, c)
+		if err != nil {
+			return nil, err
+		}
+		if commit != nil {
+			commits = append(commits, commit)
+		}
+	}
+	Set(c)
+	for _, commit := range commits {
+		commit()
+	}
+	return result, nil
+}
+
+func tlsEnabled(c *TLSConfig) bool {
+	return c.Cert != "" || c.Verify
+}
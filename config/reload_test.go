@@ -0,0 +1,99 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// 从path加载并设为当前配置，测试结束后恢复原配置和模块
+func loadForReload(t *testing.T, path string) {
+	previous := Get()
+	reloaders.Lock()
+	registered := reloaders.list
+	reloaders.list = nil
+	reloaders.Unlock()
+	t.Cleanup(func() {
+		Set(previous)
+		reloaders.Lock()
+		reloaders.list = registered
+		reloaders.Unlock()
+	})
+
+	t.Setenv(ConfigFileEnv, "")
+	c, err := Load(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Set(c)
+}
+
+func TestReloadAppliesAndKeepsRestartFields(t *testing.T) {
+	path := writeConfig(t, "beege.json", `{"ServiceAddress": ":4243", "Proxy": {"RetryAttempts": 3}}`)
+	loadForReload(t, path)
+	started := Get()
+
+	os.WriteFile(path, []byte(`{"ServiceAddress": ":5243", "Proxy": {"RetryAttempts": 4}}`), 0600)
+	result, err := Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(result.Applied, ",") != "Proxy.RetryAttempts" || strings.Join(result.Restart, ",") != "ServiceAddress" {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	c := Get()
+	if c == started || c.Proxy.RetryAttempts != 4 || c.ServiceAddress != ":4243" {
+		t.Fatalf("expected reloadable fields to apply and restart fields to keep the old value, got %+v", c)
+	}
+	if started.Proxy.RetryAttempts != 3 {
+		t.Fatal("expected the previous config not to be modified")
+	}
+}
+
+func TestFailedReloadKeepsConfig(t *testing.T) {
+	path := writeConfig(t, "beege.json", `{"Proxy": {"RetryAttempts": 3}}`)
+	loadForReload(t, path)
+	started := Get()
+
+	os.WriteFile(path, []byte(`{"Proxy": {"RetryAttempts": 0}}`), 0600)
+	if _, err := Reload(); err == nil {
+		t.Fatal("expected invalid config to be rejected")
+	}
+
+	// 任何模块准备失败时都不生效，已准备好的模块也不提交
+	committed := false
+	OnReload(func(old, c *Config) (func(), error) {
+		return func() { committed = true }, nil
+	})
+	OnReload(func(old, c *Config) (func(), error) {
+		return nil, errors.New("Bad parameter: broken policy")
+	})
+	os.WriteFile(path, []byte(`{"Proxy": {"RetryAttempts": 4}}`), 0600)
+	if _, err := Reload(); err == nil {
+		t.Fatal("expected reloader error to be returned")
+	}
+	if Get() != started || committed {
+		t.Fatal("expected failed reload to keep the current config")
+	}
+}
+
+func TestReloadCommitsAfterSet(t *testing.T) {
+	path := writeConfig(t, "beege.json", `{"Log": {"Level": "info"}}`)
+	loadForReload(t, path)
+
+	var seen string
+	OnReload(func(old, c *Config) (func(), error) {
+		if old.Log.Level != "info" || c.Log.Level != "debug" {
+			t.Errorf("unexpected configs %s %s", old.Log.Level, c.Log.Level)
+		}
+		return func() { seen = Get().Log.Level }, nil
+	})
+	os.WriteFile(path, []byte(`{"Log": {"Level": "debug"}}`), 0600)
+	if _, err := Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if seen != "debug" {
+		t.Fatalf("expected commit to see the new config, got %q", seen)
+	}
+}
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// 检查配置，一次报告所有错误
+func (this *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	exists := func(name, path string) {
+		if path == "" {
+			return
+		}
+		if _, err := os.Stat(path); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+
+	check(this.DataDir != "", "DataDir must not be empty")
+	check(this.State.SnapshotInterval > 0, "State.SnapshotInterval must be positive")
+	check(this.State.StaleTimeout > 0, "State.StaleTimeout must be positive")
+	check(this.Docker.StatusInterval > 0, "Docker.StatusInterval must be positive")
+	check(this.Docker.ReconnectWait >= 0, "Docker.ReconnectWait must not be negative")
+	host := this.Agent.DockerHost
+	check(strings.HasPrefix(host, "unix://") || strings.HasPrefix(host, "tcp://") || strings.HasPrefix(host, "http://") ||
+		strings.HasPrefix(host, "https://"), "Agent.DockerHost must be a unix://, tcp:// or http(s):// address")
+	check(this.Cluster.BroadcastQueueSize > 0, "Cluster.BroadcastQueueSize must be positive")
+	check(this.Scheduler.Strategy == StrategySpread || this.Scheduler.Strategy == StrategyBinpack,
+		"Scheduler.Strategy must be spread or binpack")
+
+	check(this.Proxy.RetryAttempts >= 1, "Proxy.RetryAttempts must be at least 1")
+	check(this.Proxy.RetryBackoff >= 0, "Proxy.RetryBackoff must not be negative")
+	check(this.Proxy.BreakerThreshold >= 1, "Proxy.BreakerThreshold must be at least 1")
+	for name, d := range map[string]Duration{
+		"Proxy.BreakerCooldown":       this.Proxy.BreakerCooldown,
+		"Proxy.DialTimeout":           this.Proxy.DialTimeout,
+		"Proxy.TLSHandshakeTimeout":   this.Proxy.TLSHandshakeTimeout,
+		"Proxy.ResponseHeaderTimeout": this.Proxy.ResponseHeaderTimeout,
+		"Proxy.IdleConnTimeout":       this.Proxy.IdleConnTimeout,
+		"Proxy.Timeout":               this.Proxy.Timeout,
+		"Proxy.InspectTimeout":        this.Proxy.InspectTimeout,
+		"Server.ReadHeaderTimeout":    this.Server.ReadHeaderTimeout,
+		"Server.ReadTimeout":          this.Server.ReadTimeout,
+		"Server.WriteTimeout":         this.Server.WriteTimeout,
+		"Server.IdleTimeout":          this.Server.IdleTimeout,
+	} {
+		check(d >= 0, "%s must not be negative", name)
+	}
+	check(this.Proxy.FlushInterval > 0, "Proxy.FlushInterval must be positive")
+	check(this.Proxy.MaxIdleConnsPerHost >= 0, "Proxy.MaxIdleConnsPerHost must not be negative")
+	check(this.Proxy.MaxConnsPerHost >= 0, "Proxy.MaxConnsPerHost must not be negative")
+	for class, limit := range this.Proxy.RateLimits {
+		switch class {
+		case RouteClassRead, RouteClassWrite, RouteClassStream:
+			check(limit != nil && limit.Rate >= 0 && limit.Burst >= 0 && limit.Concurrent >= 0,
+				"Proxy.RateLimits.%s must not be negative", class)
+		default:
+			check(false, "Proxy.RateLimits: unknown route class %s", class)
+		}
+	}
+
+	check((this.TLS.Cert == "") == (this.TLS.Key == ""), "TLS.Cert and TLS.Key must be set together")
+	check(!this.TLS.Verify || this.TLS.CACert != "", "TLS.Verify requires TLS.CACert")
+	check(!this.TLS.Verify || this.TLS.Cert != "", "TLS.Verify requires TLS.Cert")
+	exists("TLS.Cert", this.TLS.Cert)
+	exists("TLS.Key", this.TLS.Key)
+	exists("TLS.CACert", this.TLS.CACert)
+	exists("Auth.Policy", this.Auth.Policy)
+	check(this.Auth.ClusterSecret == "" || len(this.Auth.ClusterSecret) >= 16, "Auth.ClusterSecret must be at least 16 characters")
+	// 转发时leader看到的是follower的证书，只有签名才能传递客户端证书认证的用户
+	check(this.Auth.Policy == "" || this.Auth.ClusterSecret != "", "Auth.Policy requires Auth.ClusterSecret")
+	exists("NotifyRules", this.NotifyRules)
+
+	check(this.Audit.MaxSize >= 0, "Audit.MaxSize must not be negative")
+	check(this.Audit.MaxFiles >= 1, "Audit.MaxFiles must be at least 1")
+
+	switch strings.ToLower(this.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		check(false, "Log.Level must be debug, info, warn or error")
+	}
+	switch strings.ToLower(this.Log.Format) {
+	case "", "text", "json":
+	default:
+		check(false, "Log.Format must be text or json")
+	}
+
+	export := this.Trace.Export
+	check(export == "" || strings.HasPrefix(export, "file://") || strings.HasPrefix(export, "http://") ||
+		strings.HasPrefix(export, "https://"), "Trace.Export must be a file:// path or an http(s):// url")
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Bad parameter: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
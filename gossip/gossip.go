@@ -0,0 +1,594 @@
+////////////////////////////////////////////////////////////
+/*    基于SWIM的成员管理，节点之间互相探测并传播加入和离开    */
+////////////////////////////////////////////////////////////
+
+package gossip
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hugb/beegecluster/logging"
+)
+
+var logger = logging.Logger("gossip")
+
+const (
+	Alive   = "alive"
+	Suspect = "suspect"
+	Dead    = "dead"
+	Left    = "left"
+)
+
+const (
+	probeInterval  = time.Second
+	ackTimeout     = 300 * time.Millisecond
+	suspectTimeout = 5 * time.Second
+	syncTimeout    = time.Second
+	// 死亡成员保留一段时间，防止旧消息使其复活
+	deadRetention = time.Minute
+	// 间接探测的节点数
+	indirectProbes = 3
+	// 每条更新的传播次数系数
+	retransmitMult = 3
+	// 每个消息最多附带的更新数
+	maxPiggyback  = 16
+	maxPacketSize = 65507
+)
+
+type Member struct {
+	Address     string
+	Role        string
+	Labels      map[string]string `json:",omitempty"`
+	Incarnation uint64
+	State       string
+	// 最后一次状态变化的时间
+	Updated int64 `json:"-"`
+	// 最后一次收到其消息的时间
+	LastSeen int64 `json:"-"`
+}
+
+type message struct {
+	Type    string
+	Seq     uint64
+	From    string
+	Target  string   `json:",omitempty"`
+	Updates []Member `json:",omitempty"`
+}
+
+type broadcast struct {
+	member    Member
+	transmits int
+}
+
+type Memberlist struct {
+	sync.Mutex
+
+	self    *Member
+	members map[string]*Member
+	conn    *net.UDPConn
+
+	seq  uint64
+	acks map[uint64]chan bool
+
+	queue []*broadcast
+
+	probeOrder []string
+	probeIndex int
+
+	listeners []func(Member)
+
+	// 被强制移出集群的成员，不再接受关于它的消息
+	forgotten map[string]bool
+}
+
+var Members *Memberlist
+
+// 在集群地址上监听udp，开始成员探测
+func Start(address, role string, labels map[string]string) error {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+	Members = &Memberlist{
+		// 以启动时间作为初始版本，重启后高于此前的死亡记录
+		self: &Member{
+			Address:     address,
+			Role:        role,
+			Labels:      labels,
+			Incarnation: uint64(time.Now().UnixNano()),
+			State:       Alive,
+			Updated:     time.Now().Unix(),
+		},
+		members: make(map[string]*Member),
+		conn:    conn,
+		acks:    make(map[uint64]chan bool),
+	}
+	Members.members[address] = Members.self
+
+	go Members.listen()
+	go Members.probeLoop()
+
+	return nil
+}
+
+// 成员状态变化时回调，回调在锁外执行
+func (this *Memberlist) OnChange(fct func(Member)) {
+	this.Lock()
+	defer this.Unlock()
+
+	this.listeners = append(this.listeners, fct)
+}
+
+// 通过任意一个已知成员加入，所有成员都不可达时返回错误
+func (this *Memberlist) Join(seeds []string) error {
+	var err error
+	for _, seed := range seeds {
+		if seed == "" || seed == this.self.Address {
+			continue
+		}
+		if err = this.sync(seed); err == nil {
+			logger.Info("Join cluster", "seed", seed)
+			return nil
+		}
+		logger.Warn("Join cluster error", "seed", seed, "error", err)
+	}
+	if err == nil {
+		err = fmt.Errorf("No seed to join")
+	}
+	return err
+}
+
+// 主动离开，通知其他成员
+func (this *Memberlist) Leave() {
+	this.Lock()
+	this.self.Incarnation++
+	this.self.State = Left
+	this.enqueue(*this.self)
+	targets := this.others()
+	this.Unlock()
+
+	for _, address := range targets {
+		this.send(address, &message{Type: "ping", From: this.self.Address})
+	}
+}
+
+// 得到指定角色的存活成员
+func (this *Memberlist) Alive(role string) []Member {
+	this.Lock()
+	defer this.Unlock()
+
+	var members []Member
+	for _, member := range this.members {
+		if member.Role == role && (member.State == Alive || member.State == Suspect) {
+			members = append(members, *member)
+		}
+	}
+	return members
+}
+
+// 得到成员信息
+func (this *Memberlist) Lookup(address string) (Member, bool) {
+	this.Lock()
+	defer this.Unlock()
+
+	member, ok := this.members[address]
+	if !ok {
+		return Member{}, false
+	}
+	return *member, true
+}
+
+// 得到所有成员
+func (this *Memberlist) List() []Member {
+	this.Lock()
+	defer this.Unlock()
+
+	members := make([]Member, 0, len(this.members))
+	for _, member := range this.members {
+		members = append(members, *member)
+	}
+	return members
+}
+
+// 与seed交换完整的成员列表
+func (this *Memberlist) sync(seed string) error {
+	this.Lock()
+	seq, ack := this.nextSeq()
+	this.Unlock()
+
+	defer this.removeAck(seq)
+
+	this.send(seed, &message{Type: "sync", Seq: seq, From: this.self.Address, Updates: this.all()})
+	select {
+	case <-ack:
+		return nil
+	case <-time.After(syncTimeout):
+		return fmt.Errorf("Sync with %s timeout", seed)
+	}
+}
+
+func (this *Memberlist) listen() {
+	buffer := make([]byte, maxPacketSize)
+	for {
+		n, _, err := this.conn.ReadFromUDP(buffer)
+		if err != nil {
+			logger.Error("Gossip read error", "error", err)
+			continue
+		}
+		m := &message{}
+		if err = json.Unmarshal(buffer[:n], m); err != nil {
+			logger.Warn("Gossip decode error", "error", err)
+			continue
+		}
+		this.handle(m)
+	}
+}
+
+func (this *Memberlist) handle(m *message) {
+	for _, update := range m.Updates {
+		this.merge(update)
+	}
+	this.Lock()
+	if member, ok := this.members[m.From]; ok {
+		member.LastSeen = time.Now().Unix()
+	}
+	this.Unlock()
+
+	switch m.Type {
+	case "ping":
+		this.send(m.From, &message{Type: "ack", Seq: m.Seq, From: this.self.Address})
+	case "ping_req":
+		// 代替请求者探测目标
+		go func() {
+			if this.probe(m.Target, ackTimeout) {
+				this.send(m.From, &message{Type: "ack", Seq: m.Seq, From: this.self.Address})
+			}
+		}()
+	case "ack", "sync_reply":
+		this.Lock()
+		ack, ok := this.acks[m.Seq]
+		this.Unlock()
+		if ok {
+			select {
+			case ack <- true:
+			default:
+			}
+		}
+	case "sync":
+		this.send(m.From, &message{Type: "sync_reply", Seq: m.Seq, From: this.self.Address, Updates: this.all()})
+	}
+}
+
+// 合并其他成员传来的状态
+func (this *Memberlist) merge(update Member) {
+	this.Lock()
+
+	if update.Address == this.self.Address {
+		// 有人怀疑我死了，提高版本号进行反驳
+		if update.State != Alive && this.self.State == Alive && update.Incarnation >= this.self.Incarnation {
+			this.self.Incarnation = update.Incarnation + 1
+			this.enqueue(*this.self)
+		}
+		this.Unlock()
+		return
+	}
+
+	if this.forgotten[update.Address] {
+		this.Unlock()
+		return
+	}
+	member, exists := this.members[update.Address]
+	if !exists {
+		if update.State == Dead || update.State == Left {
+			this.Unlock()
+			return
+		}
+		member = &Member{Address: update.Address, Role: update.Role}
+		this.members[update.Address] = member
+	} else if !supersedes(&update, member) {
+		this.Unlock()
+		return
+	}
+
+	changed := !exists || member.State != update.State
+	member.Labels = update.Labels
+	member.Incarnation = update.Incarnation
+	member.State = update.State
+	member.Updated = time.Now().Unix()
+	this.enqueue(*member)
+	if update.State == Suspect {
+		this.suspectTimer(member.Address, member.Incarnation)
+	}
+	current := *member
+	this.Unlock()
+
+	if changed {
+		this.notify(current)
+	}
+}
+
+// 判断更新是否比现有状态新
+func supersedes(update, member *Member) bool {
+	switch update.State {
+	case Alive:
+		return update.Incarnation > member.Incarnation
+	case Suspect:
+		if member.State == Alive {
+			return update.Incarnation >= member.Incarnation
+		}
+		return update.Incarnation > member.Incarnation
+	case Dead, Left:
+		if member.State == Dead || member.State == Left {
+			return update.Incarnation > member.Incarnation
+		}
+		return update.Incarnation >= member.Incarnation
+	}
+	return false
+}
+
+func (this *Memberlist) notify(member Member) {
+	this.Lock()
+	listeners := this.listeners
+	this.Unlock()
+
+	logger.Info("Member state changed", "node", member.Address, "role", member.Role, "state", member.State)
+	for _, listener := range listeners {
+		listener(member)
+	}
+}
+
+// 怀疑超时后宣告死亡，调用时需持有锁
+func (this *Memberlist) suspectTimer(address string, incarnation uint64) {
+	time.AfterFunc(suspectTimeout, func() {
+		this.expireSuspect(address, incarnation)
+	})
+}
+
+// 同一版本的怀疑在超时前没有被反驳时宣告死亡
+func (this *Memberlist) expireSuspect(address string, incarnation uint64) {
+	this.Lock()
+	member, ok := this.members[address]
+	if !ok || member.State != Suspect || member.Incarnation != incarnation {
+		this.Unlock()
+		return
+	}
+	member.State = Dead
+	member.Updated = time.Now().Unix()
+	this.enqueue(*member)
+	current := *member
+	this.Unlock()
+
+	this.notify(current)
+}
+
+func (this *Memberlist) probeLoop() {
+	tick := time.Tick(probeInterval)
+	for {
+		select {
+		case <-tick:
+			this.reap()
+			if target := this.nextTarget(); target != "" {
+				this.probeTarget(target)
+			}
+		}
+	}
+}
+
+// 探测一个成员，直接探测失败时请其他成员间接探测
+func (this *Memberlist) probeTarget(target string) {
+	if this.probe(target, ackTimeout) {
+		return
+	}
+
+	this.Lock()
+	seq, ack := this.nextSeq()
+	var helpers []string
+	for _, address := range this.others() {
+		if address != target && this.members[address].State == Alive {
+			helpers = append(helpers, address)
+		}
+	}
+	this.Unlock()
+
+	defer this.removeAck(seq)
+
+	for i, index := range rand.Perm(len(helpers)) {
+		if i >= indirectProbes {
+			break
+		}
+		this.send(helpers[index], &message{Type: "ping_req", Seq: seq, From: this.self.Address, Target: target})
+	}
+	select {
+	case <-ack:
+		return
+	case <-time.After(probeInterval - ackTimeout):
+	}
+
+	this.Lock()
+	member, ok := this.members[target]
+	if !ok || member.State != Alive {
+		this.Unlock()
+		return
+	}
+	member.State = Suspect
+	member.Updated = time.Now().Unix()
+	this.enqueue(*member)
+	this.suspectTimer(target, member.Incarnation)
+	current := *member
+	this.Unlock()
+
+	this.notify(current)
+}
+
+// 发送ping并等待ack
+func (this *Memberlist) probe(target string, timeout time.Duration) bool {
+	this.Lock()
+	seq, ack := this.nextSeq()
+	this.Unlock()
+
+	defer this.removeAck(seq)
+
+	this.send(target, &message{Type: "ping", Seq: seq, From: this.self.Address})
+	select {
+	case <-ack:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// 轮询选择下一个探测目标，每轮打乱顺序
+func (this *Memberlist) nextTarget() string {
+	this.Lock()
+	defer this.Unlock()
+
+	for i := 0; i < 2; i++ {
+		for this.probeIndex < len(this.probeOrder) {
+			address := this.probeOrder[this.probeIndex]
+			this.probeIndex++
+			if member, ok := this.members[address]; ok && (member.State == Alive || member.State == Suspect) {
+				return address
+			}
+		}
+		others := this.others()
+		this.probeOrder = make([]string, len(others))
+		for i, index := range rand.Perm(len(others)) {
+			this.probeOrder[i] = others[index]
+		}
+		this.probeIndex = 0
+	}
+	return ""
+}
+
+// 删除被强制移出集群的成员，之后忽略关于它的消息，直到重新允许
+func (this *Memberlist) Forget(address string) {
+	this.Lock()
+	defer this.Unlock()
+
+	if address == this.self.Address {
+		return
+	}
+	if this.forgotten == nil {
+		this.forgotten = make(map[string]bool)
+	}
+	this.forgotten[address] = true
+	delete(this.members, address)
+}
+
+// 重新接受被移出的成员
+func (this *Memberlist) Allow(address string) {
+	this.Lock()
+	defer this.Unlock()
+
+	delete(this.forgotten, address)
+}
+
+// 清除保留期已过的死亡成员
+func (this *Memberlist) reap() {
+	this.Lock()
+	defer this.Unlock()
+
+	now := time.Now().Unix()
+	for address, member := range this.members {
+		if (member.State == Dead || member.State == Left) && now-member.Updated > int64(deadRetention/time.Second) {
+			delete(this.members, address)
+		}
+	}
+}
+
+// 除自己外的成员，调用时需持有锁
+func (this *Memberlist) others() []string {
+	var addresses []string
+	for address := range this.members {
+		if address != this.self.Address {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+func (this *Memberlist) all() []Member {
+	this.Lock()
+	defer this.Unlock()
+
+	members := make([]Member, 0, len(this.members))
+	for _, member := range this.members {
+		members = append(members, *member)
+	}
+	return members
+}
+
+// 调用时需持有锁
+func (this *Memberlist) nextSeq() (uint64, chan bool) {
+	this.seq++
+	ack := make(chan bool, 1)
+	this.acks[this.seq] = ack
+	return this.seq, ack
+}
+
+func (this *Memberlist) removeAck(seq uint64) {
+	this.Lock()
+	defer this.Unlock()
+
+	delete(this.acks, seq)
+}
+
+// 将状态变化加入传播队列，调用时需持有锁
+func (this *Memberlist) enqueue(member Member) {
+	transmits := retransmitMult * int(math.Ceil(math.Log10(float64(len(this.members)+1))+1))
+	for _, b := range this.queue {
+		if b.member.Address == member.Address {
+			b.member = member
+			b.transmits = transmits
+			return
+		}
+	}
+	this.queue = append(this.queue, &broadcast{member: member, transmits: transmits})
+}
+
+// 取出需要附带在消息中传播的状态
+func (this *Memberlist) piggyback() []Member {
+	this.Lock()
+	defer this.Unlock()
+
+	var updates []Member
+	queue := this.queue[:0]
+	for _, b := range this.queue {
+		if len(updates) < maxPiggyback {
+			updates = append(updates, b.member)
+			b.transmits--
+		}
+		if b.transmits > 0 {
+			queue = append(queue, b)
+		}
+	}
+	this.queue = queue
+	return updates
+}
+
+func (this *Memberlist) send(address string, m *message) {
+	m.Updates = append(m.Updates, this.piggyback()...)
+	b, err := json.Marshal(m)
+	if err != nil {
+		logger.Error("Gossip encode error", "error", err)
+		return
+	}
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		logger.Warn("Gossip resolve error", "node", address, "error", err)
+		return
+	}
+	if _, err = this.conn.WriteToUDP(b, addr); err != nil {
+		logger.Warn("Gossip send error", "node", address, "error", err)
+	}
+}
@@ -0,0 +1,176 @@
+package gossip
+
+import (
+	"testing"
+	"time"
+)
+
+// 不监听网络的成员列表，只通过merge改变状态
+func newTestMemberlist(address string, incarnation uint64) (*Memberlist, *[]Member) {
+	m := &Memberlist{
+		self:    &Member{Address: address, Role: "controller", Incarnation: incarnation, State: Alive},
+		members: make(map[string]*Member),
+		acks:    make(map[uint64]chan bool),
+	}
+	m.members[address] = m.self
+	changes := &[]Member{}
+	m.OnChange(func(member Member) { *changes = append(*changes, member) })
+	return m, changes
+}
+
+func (this *Memberlist) queued(address string) (Member, bool) {
+	this.Lock()
+	defer this.Unlock()
+
+	for _, b := range this.queue {
+		if b.member.Address == address {
+			return b.member, true
+		}
+	}
+	return Member{}, false
+}
+
+func TestRefuteSuspicion(t *testing.T) {
+	m, _ := newTestMemberlist("a:4244", 5)
+
+	// 旧版本的怀疑不需要反驳
+	m.merge(Member{Address: "a:4244", State: Suspect, Incarnation: 4})
+	if _, ok := m.queued("a:4244"); ok || m.self.Incarnation != 5 {
+		t.Fatal("expected stale suspicion to be ignored")
+	}
+
+	m.merge(Member{Address: "a:4244", State: Suspect, Incarnation: 5})
+	refute, ok := m.queued("a:4244")
+	if !ok || refute.State != Alive || refute.Incarnation != 6 {
+		t.Fatalf("expected alive message with a higher incarnation, got %+v %v", refute, ok)
+	}
+	m.merge(Member{Address: "a:4244", State: Dead, Incarnation: 8})
+	if m.self.State != Alive || m.self.Incarnation != 9 {
+		t.Fatalf("expected death to be refuted too, got %+v", *m.self)
+	}
+}
+
+func TestRefutationClearsSuspicionOnPeers(t *testing.T) {
+	m, changes := newTestMemberlist("b:4244", 1)
+	m.merge(Member{Address: "a:4244", Role: "docker", State: Alive, Incarnation: 5})
+	m.merge(Member{Address: "a:4244", State: Suspect, Incarnation: 5})
+
+	// 同一版本的alive不能推翻怀疑，反驳必须提高版本
+	m.merge(Member{Address: "a:4244", Role: "docker", State: Alive, Incarnation: 5})
+	if member, _ := m.Lookup("a:4244"); member.State != Suspect {
+		t.Fatalf("expected member to stay suspect, got %s", member.State)
+	}
+	m.merge(Member{Address: "a:4244", State: Alive, Incarnation: 6})
+	if member, _ := m.Lookup("a:4244"); member.State != Alive {
+		t.Fatalf("expected refutation to clear suspicion, got %s", member.State)
+	}
+	// 反驳之后原来的怀疑超时不再生效
+	m.expireSuspect("a:4244", 5)
+	if member, _ := m.Lookup("a:4244"); member.State != Alive {
+		t.Fatalf("expected stale suspect timer to be ignored, got %s", member.State)
+	}
+	var states []string
+	for _, change := range *changes {
+		states = append(states, change.State)
+	}
+	if len(states) != 3 || states[0] != Alive || states[1] != Suspect || states[2] != Alive {
+		t.Fatalf("unexpected state changes %v", states)
+	}
+}
+
+func TestSuspectTimeoutDeclaresDead(t *testing.T) {
+	m, changes := newTestMemberlist("b:4244", 1)
+	m.merge(Member{Address: "a:4244", Role: "docker", State: Alive, Incarnation: 5})
+	m.merge(Member{Address: "a:4244", State: Suspect, Incarnation: 5})
+
+	m.expireSuspect("a:4244", 5)
+	if member, _ := m.Lookup("a:4244"); member.State != Dead {
+		t.Fatalf("expected unrefuted suspect to be dead, got %s", member.State)
+	}
+	if last := (*changes)[len(*changes)-1]; last.State != Dead {
+		t.Fatalf("expected listeners to be notified, got %s", last.State)
+	}
+	if len(m.Alive("docker")) != 0 {
+		t.Fatal("expected dead member not to be alive")
+	}
+
+	// 死亡的成员只能以更高的版本复活
+	m.merge(Member{Address: "a:4244", Role: "docker", State: Alive, Incarnation: 5})
+	if member, _ := m.Lookup("a:4244"); member.State != Dead {
+		t.Fatal("expected old alive message not to resurrect the member")
+	}
+	m.merge(Member{Address: "a:4244", State: Alive, Incarnation: 7})
+	if member, _ := m.Lookup("a:4244"); member.State != Alive {
+		t.Fatal("expected restarted member to rejoin")
+	}
+}
+
+func TestLeftMember(t *testing.T) {
+	m, _ := newTestMemberlist("b:4244", 1)
+	m.merge(Member{Address: "a:4244", Role: "docker", State: Alive, Incarnation: 5})
+
+	m.merge(Member{Address: "a:4244", State: Left, Incarnation: 6})
+	if member, _ := m.Lookup("a:4244"); member.State != Left {
+		t.Fatalf("expected member to have left, got %s", member.State)
+	}
+	// 离开之后迟到的怀疑和死亡消息不改变状态
+	m.merge(Member{Address: "a:4244", State: Suspect, Incarnation: 6})
+	m.merge(Member{Address: "a:4244", State: Dead, Incarnation: 6})
+	if member, _ := m.Lookup("a:4244"); member.State != Left {
+		t.Fatalf("expected left member to stay left, got %s", member.State)
+	}
+	// 未知成员的离开和死亡消息不会加入列表
+	m.merge(Member{Address: "c:4244", State: Left, Incarnation: 1})
+	m.merge(Member{Address: "d:4244", State: Dead, Incarnation: 1})
+	if _, ok := m.Lookup("c:4244"); ok {
+		t.Fatal("expected unknown left member to be ignored")
+	}
+	if _, ok := m.Lookup("d:4244"); ok {
+		t.Fatal("expected unknown dead member to be ignored")
+	}
+
+	// 保留期过后清除
+	m.Lock()
+	m.members["a:4244"].Updated = time.Now().Add(-2 * deadRetention).Unix()
+	m.Unlock()
+	m.reap()
+	if _, ok := m.Lookup("a:4244"); ok {
+		t.Fatal("expected left member to be reaped after the retention")
+	}
+}
+
+func TestLeaveAnnouncesHigherIncarnation(t *testing.T) {
+	m, _ := newTestMemberlist("a:4244", 5)
+	m.Leave()
+
+	left, ok := m.queued("a:4244")
+	if !ok || left.State != Left || left.Incarnation != 6 {
+		t.Fatalf("expected left message with a higher incarnation, got %+v %v", left, ok)
+	}
+	// 离开后不再反驳
+	m.merge(Member{Address: "a:4244", State: Suspect, Incarnation: 6})
+	if m.self.State != Left || m.self.Incarnation != 6 {
+		t.Fatalf("expected left node not to refute, got %+v", *m.self)
+	}
+}
+
+func TestForgottenMemberIsIgnored(t *testing.T) {
+	m, _ := newTestMemberlist("b:4244", 1)
+	m.merge(Member{Address: "a:4244", Role: "docker", State: Alive, Incarnation: 5})
+
+	m.Forget("a:4244")
+	if _, ok := m.Lookup("a:4244"); ok {
+		t.Fatal("expected forgotten member to be removed")
+	}
+	// 被移出的节点仍在宣告自己存活
+	m.merge(Member{Address: "a:4244", Role: "docker", State: Alive, Incarnation: 9})
+	if _, ok := m.Lookup("a:4244"); ok {
+		t.Fatal("expected forgotten member not to rejoin")
+	}
+
+	m.Allow("a:4244")
+	m.merge(Member{Address: "a:4244", Role: "docker", State: Alive, Incarnation: 10})
+	if member, ok := m.Lookup("a:4244"); !ok || member.State != Alive {
+		t.Fatal("expected allowed member to rejoin")
+	}
+}
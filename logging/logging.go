@@ -0,0 +1,118 @@
+////////////////////////////////////////////////////////////
+/*          分级的结构化日志，支持文本和json格式输出          */
+////////////////////////////////////////////////////////////
+
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+var (
+	// 运行时可以修改的日志级别
+	level = new(slog.LevelVar)
+	root  atomic.Pointer[slog.Logger]
+)
+
+func init() {
+	root.Store(slog.Default())
+}
+
+// 设置输出格式和级别，标准库log的输出也转为结构化日志
+func Init(format, name string) error {
+	return InitWriter(os.Stderr, format, name)
+}
+
+func InitWriter(w io.Writer, format, name string) error {
+	if err := SetLevel(name); err != nil {
+		return err
+	}
+	options := &slog.HandlerOptions{AddSource: true, Level: level}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", FormatText:
+		handler = slog.NewTextHandler(w, options)
+	case FormatJSON:
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		return fmt.Errorf("Bad parameter: unknown log format %s", format)
+	}
+	logger := slog.New(handler)
+	root.Store(logger)
+	slog.SetDefault(logger)
+	return nil
+}
+
+// 得到模块的日志，每条日志带有模块名；输出时才使用当前的配置，
+// 包初始化时创建的日志在Init之后同样生效
+func Logger(component string) *slog.Logger {
+	return slog.New(&lazyHandler{wrap: func(h slog.Handler) slog.Handler {
+		return h.WithAttrs([]slog.Attr{slog.String("component", component)})
+	}})
+}
+
+// 转发到当前根日志的handler，根日志变化后重新生成
+type lazyHandler struct {
+	wrap  func(slog.Handler) slog.Handler
+	cache atomic.Pointer[lazyCache]
+}
+
+type lazyCache struct {
+	root    *slog.Logger
+	handler slog.Handler
+}
+
+func (this *lazyHandler) handler() slog.Handler {
+	current := root.Load()
+	if cache := this.cache.Load(); cache != nil && cache.root == current {
+		return cache.handler
+	}
+	h := this.wrap(current.Handler())
+	this.cache.Store(&lazyCache{root: current, handler: h})
+	return h
+}
+
+func (this *lazyHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return this.handler().Enabled(ctx, l)
+}
+
+func (this *lazyHandler) Handle(ctx context.Context, r slog.Record) error {
+	return this.handler().Handle(ctx, r)
+}
+
+func (this *lazyHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &lazyHandler{wrap: func(h slog.Handler) slog.Handler {
+		return this.wrap(h).WithAttrs(attrs)
+	}}
+}
+
+func (this *lazyHandler) WithGroup(name string) slog.Handler {
+	return &lazyHandler{wrap: func(h slog.Handler) slog.Handler {
+		return this.wrap(h).WithGroup(name)
+	}}
+}
+
+// 修改日志级别：debug、info、warn或error
+func SetLevel(name string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(name)); err != nil {
+		return fmt.Errorf("Bad parameter: unknown log level %s", name)
+	}
+	level.Set(l)
+	return nil
+}
+
+func Level() string {
+	return strings.ToLower(level.Level().String())
+}
@@ -0,0 +1,43 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestLoggerCreatedBeforeInit(t *testing.T) {
+	previous := root.Load()
+	defer func() {
+		root.Store(previous)
+		slog.SetDefault(previous)
+		SetLevel("info")
+	}()
+
+	logger := Logger("cluster").With("node", "h1:4243")
+
+	var out bytes.Buffer
+	if err := InitWriter(&out, FormatJSON, "warn"); err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("hidden")
+	logger.Warn("shown")
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("expected a single json record, got %q: %s", out.String(), err)
+	}
+	if record["msg"] != "shown" || record["component"] != "cluster" || record["node"] != "h1:4243" {
+		t.Fatalf("unexpected record %v", record)
+	}
+}
+
+func TestInitRejectsUnknownFormat(t *testing.T) {
+	if err := InitWriter(&bytes.Buffer{}, "xml", "info"); err == nil {
+		t.Fatal("expected unknown format to be rejected")
+	}
+	if err := SetLevel("verbose"); err == nil {
+		t.Fatal("expected unknown level to be rejected")
+	}
+}
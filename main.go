@@ -1,23 +1,41 @@
 ///////////////////////////////////////////////////////////////////
 /*                          Controller                           */
 ///////////////////////////////////////////////////////////////////
-// 提供API路由选择，以及集群管理
+// 提供API路由选择，以及集群管理；以-agent运行时作为docker节点加入集群
 package main
 
 import (
+	_ "embed"
 	"flag"
+	"fmt"
+	"os"
+	"strings"
 
+	"github.com/hugb/beegecluster/config"
 	"github.com/hugb/beegecluster/module"
 )
 
+//go:embed VERSION
+var version string
+
 func main() {
-	var (
-		joinAddress    = flag.String("j", "", "Join Address")
-		serviceAddress = flag.String("p", "", "Service Address")
-		clusterAddress = flag.String("c", "", "Cluster Address")
-	)
+	configFile := flag.String("config", "", "Config file in json, yaml or toml (env "+config.ConfigFileEnv+")")
+	agent := flag.Bool("agent", false, "Run as a docker node agent managing the local docker")
+	config.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
+	c, err := config.Load(*configFile, flag.CommandLine)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	config.Version = strings.TrimSpace(version)
+
+	if *agent {
+		// 作为docker节点加入集群
+		module.StartAgentModule(c)
+		return
+	}
 	// 启动控制器模块
-	module.StartControllerrModule(*joinAddress, *serviceAddress, *clusterAddress)
+	module.StartControllerrModule(c)
 }
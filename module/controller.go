@@ -1,54 +1,166 @@
 package module
 
 import (
-	"log"
+	"os"
+	gosignal "os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/hugb/beegecluster/audit"
+	"github.com/hugb/beegecluster/auth"
 	"github.com/hugb/beegecluster/cluster"
 	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/notify"
 	"github.com/hugb/beegecluster/proxy"
+	"github.com/hugb/beegecluster/raft"
+	"github.com/hugb/beegecluster/trace"
 	"github.com/hugb/beegecluster/utils"
 )
 
+const (
+	// 退出时等待处理中请求的最长时间
+	drainTimeout = 30 * time.Second
+)
+
 // Dcoker模块
-func StartControllerrModule(joinAddress, serviceAddress, clusterAddress string) {
-	// 设置日志格式
-	log.SetFlags(log.Ldate | log.Lmicroseconds | log.Lshortfile)
+func StartControllerrModule(c *config.Config) {
 	// 参数检查
-	if serviceAddress == "" {
-		log.Fatal("Service address is required")
+	if c.ServiceAddress == "" {
+		fatal("Service address is required")
 	}
-	if clusterAddress == "" {
-		log.Fatal("Cluster address is required")
+	if c.ClusterAddress == "" {
+		fatal("Cluster address is required")
 	}
 	// 保存配置
-	config.JoinAddress = joinAddress
-	config.ServiceAddress = serviceAddress
-	config.ClusterAddress = clusterAddress
+	config.Set(c)
 	config.Role = config.ControllerRoleName
-	config.Controllers[clusterAddress] = time.Now().Unix()
+	config.Controllers[c.ClusterAddress] = time.Now().Unix()
+	// 设置日志格式和级别
+	initLogging()
+	// 集群内部通信的数据交换器
+	cluster.StartSwitcher()
+
+	// 从快照恢复集群状态
+	if c.StateStore != "" {
+		if err := restoreState(c.StateStore); err != nil {
+			fatal("Restore state error", "store", c.StateStore, "error", err)
+		}
+		go saveStateLoop()
+	}
+
+	if c.Audit.File != "" {
+		if err := audit.AuditServer.Open(c.Audit.File); err != nil {
+			fatal("Open audit log error", "file", c.Audit.File, "error", err)
+		}
+	}
+	if err := trace.Init(c.Trace.Export, c.ClusterAddress); err != nil {
+		fatal("Init trace export error", "target", c.Trace.Export, "error", err)
+	}
+	if c.Auth.Policy != "" {
+		if err := auth.AuthServer.LoadPolicy(c.Auth.Policy); err != nil {
+			fatal("Load auth policy error", "file", c.Auth.Policy, "error", err)
+		}
+	}
+	// 加载事件通知规则
+	if c.NotifyRules != "" {
+		if err := notify.NotifyServer.LoadRules(c.NotifyRules); err != nil {
+			fatal("Load notify rules error", "file", c.NotifyRules, "error", err)
+		}
+	}
 
 	// 集群内部通信服务器
 	go cluster.NewClusterServer()
 	// 注册内部通信命令处理函数
 	cluster.ClusterHandlers()
+	for cmd, fct := range raft.Handlers() {
+		if err := cluster.ClusterSwitcher.Register(cmd, fct); err != nil {
+			logger.Error("Register cluster handler failure", "cmd", cmd, "error", err)
+		}
+	}
 	// 与docker连接断开后处理
 	cluster.ClusterSwitcher.Register("disconnect", DockerDisconnection)
 
-	if config.JoinAddress != "" {
-		config.Controllers[joinAddress] = time.Now().Unix()
-		// 从接入点获取集群的结构
-		go cluster.ControllerJoinCluster()
+	// 从接入点获取集群的结构
+	go cluster.ControllerJoinCluster()
+
+	// 重新加载配置时需要处理的模块
+	registerReloaders()
+
+	// controller之间选举leader，集群状态由leader修改后复制
+	registerAppliers()
+	// 成员保存在raft日志中，没有接入点的controller创建集群，其他controller请求加入
+	raftDir := filepath.Join(c.DataDir, "raft-"+strings.Replace(c.ClusterAddress, ":", "_", -1))
+	if err := raft.Start(c.ClusterAddress, c.ServiceAddress, raftDir, c.JoinAddress == ""); err != nil {
+		fatal("Start raft error", "dir", raftDir, "error", err)
 	}
+	go raft.Join(raftSeeds)
+
+	// 收到退出信号后有序离开集群
+	done := make(chan bool)
+	go trapSignals(done)
 
 	// 启动代理服务器
 	proxy.NewProxyServer()
+	<-done
+}
+
+// 请求加入raft成员时尝试的controller：接入点和已知的controller
+func raftSeeds() []string {
+	seeds := strings.Split(config.Get().JoinAddress, ",")
+	config.NodesLock.RLock()
+	defer config.NodesLock.RUnlock()
+
+	for address := range config.Controllers {
+		seeds = append(seeds, address)
+	}
+	return seeds
+}
+
+// SIGTERM和SIGINT时通知集群、停止接收新请求并等待处理中的请求完成，
+// SIGQUIT时输出调用栈，SIGHUP时重新加载配置和证书
+func trapSignals(done chan bool) {
+	c := make(chan os.Signal, 1)
+	gosignal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP)
+	for sig := range c {
+		logger.Info("Received signal", "signal", sig)
+		if sig == syscall.SIGQUIT {
+			utils.DumpStacks()
+			continue
+		}
+		if sig == syscall.SIGHUP {
+			reloadConfig()
+			continue
+		}
+		cluster.Leave()
+		proxy.Shutdown(drainTimeout)
+		trace.Close(time.Second)
+		if stateStore != nil {
+			if err := saveState(); err != nil {
+				logger.Error("Save state error", "error", err)
+			}
+		}
+		logger.Info("Controller exit")
+		close(done)
+		return
+	}
 }
 
 // 我的小弟死了
 func DockerDisconnection(c *utils.Connection, data []byte) {
-	log.Println("docker:", string(data), "is offline.")
-	// 从生死簿中将他的名字抹去
-	delete(config.Dockers, string(data))
-	log.Println("dockers:", config.Dockers)
+	logger.Warn("Docker is offline", "node", string(data))
+	// 以leader与docker的连接为准，将他的名字从生死簿中抹去
+	if raft.IsLeader() {
+		go func() {
+			if err := raft.Propose("docker_remove", string(data)); err != nil {
+				logger.Error("Remove docker error", "node", string(data), "error", err)
+			}
+		}()
+	}
+	// 主动离开不需要告警
+	if !cluster.IsLeaving(string(data)) {
+		notify.NotifyServer.Notify(&notify.Event{Type: notify.DockerOffline, Node: string(data)})
+		audit.AuditServer.Record(&audit.Entry{Type: audit.NodeOffline, Node: string(data), Role: config.DockerRoleName})
+	}
 }
@@ -1,8 +1,10 @@
 package module
 
 import (
-	"log"
+	"os"
+	gosignal "os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/dotcloud/docker/engine"
@@ -24,36 +26,95 @@ func StartDockerModule(protoAddrs []string, joinAddress string, eng *engine.Engi
 		}
 	}
 
-	if joinAddress == "" {
-		log.Fatal("Join address is required")
+	// docker daemon的参数无法扩展，其他配置通过BEEGE_CONFIG指定的文件或环境变量设置
+	c, err := config.Load("", nil)
+	if err != nil {
+		fatal("Load config error", "error", err)
 	}
-	if clusterAddress == "" {
-		log.Fatal("Cluster address is required")
+	if joinAddress != "" {
+		c.JoinAddress = joinAddress
 	}
+	if clusterAddress != "" {
+		c.ClusterAddress = clusterAddress
+	}
+	// 进程由docker daemon自己的信号处理退出
+	joinDocker(c, cluster.NewEngineBackend(eng), false)
+}
+
+// 独立运行的docker节点，通过远程api管理本机的docker，
+// 使用与链接到dockerd时相同的集群协议
+func StartAgentModule(c *config.Config) {
+	backend, err := cluster.NewAPIBackend(c.Agent.DockerHost)
+	if err != nil {
+		fatal("Create docker client error", "error", err)
+	}
+	joinDocker(c, backend, true)
+}
 
-	// 设置日志格式
-	log.SetFlags(log.Ldate | log.Lmicroseconds | log.Lshortfile)
+func joinDocker(c *config.Config, backend cluster.DockerBackend, exit bool) {
+	if c.JoinAddress == "" {
+		fatal("Join address is required")
+	}
+	if c.ClusterAddress == "" {
+		fatal("Cluster address is required")
+	}
 
 	// 保存配置
-	config.JoinAddress = joinAddress
+	config.Set(c)
 	config.Role = config.DockerRoleName
-	config.ClusterAddress = clusterAddress
-	config.Dockers[clusterAddress] = time.Now().Unix()
-	config.Controllers[joinAddress] = time.Now().Unix()
+	config.Dockers[c.ClusterAddress] = time.Now().Unix()
+	// 设置日志格式和级别
+	initLogging()
+	// 集群内部通信的数据交换器
+	cluster.StartSwitcher()
+
+	// 确认可以访问docker
+	version, err := backend.Version()
+	if err != nil {
+		fatal("Connect docker error", "error", err)
+	}
+	logger.Info("Docker connected", "version", version.Version, "api", version.ApiVersion)
 
 	// 注册内部通信命令处理函数
 	cluster.ClusterHandlers()
 	// 与controller连接断开后，将向连接的所有controller广播
 	cluster.ClusterSwitcher.Register("disconnect", ControllerDisconnection)
 
+	go trapDockerSignals(exit)
+
 	// docker加入集群
-	cluster.DockerJoinCluster(eng)
+	cluster.DockerJoinCluster(backend)
+}
+
+// 收到退出信号时通知controller，独立运行时随后退出，SIGQUIT时输出调用栈
+func trapDockerSignals(exit bool) {
+	c := make(chan os.Signal, 1)
+	gosignal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
+	for sig := range c {
+		// os.Interrupt=ctrl+c
+		logger.Info("Received signal", "signal", sig)
+		if sig == syscall.SIGQUIT {
+			utils.DumpStacks()
+			continue
+		}
+		cluster.Leave()
+		if exit {
+			logger.Info("Agent exit")
+			os.Exit(0)
+		}
+	}
 }
 
 // controller连接到docker的连接断开，广播给其他controller
 func ControllerDisconnection(c *utils.Connection, data []byte) {
 	address := string(data)
-	log.Println("controller:", address, "is offline.")
+	logger.Warn("Controller is offline", "node", address)
+	config.NodesLock.Lock()
 	delete(config.Controllers, address)
+	config.NodesLock.Unlock()
+	// 主动离开的controller已通过成员管理告知其他controller
+	if cluster.IsLeaving(address) {
+		return
+	}
 	cluster.ClusterSwitcher.Broadcast(utils.PacketByes(append(data, " controller_offline"...)))
 }
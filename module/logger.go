@@ -0,0 +1,24 @@
+package module
+
+import (
+	"os"
+
+	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/logging"
+)
+
+var logger = logging.Logger("module")
+
+// 按配置初始化日志，各模块的日志在初始化后自动使用新的配置
+func initLogging() {
+	if err := logging.Init(config.Get().Log.Format, config.Get().Log.Level); err != nil {
+		logger.Error("Init logging error", "error", err)
+		os.Exit(1)
+	}
+}
+
+// 输出错误日志后退出
+func fatal(msg string, args ...interface{}) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,61 @@
+package module
+
+import (
+	"github.com/hugb/beegecluster/auth"
+	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/logging"
+	"github.com/hugb/beegecluster/notify"
+	"github.com/hugb/beegecluster/utils"
+)
+
+// 重新加载配置时需要重新读取文件或设置的模块，
+// 其余配置项在使用时读取当前配置，替换后即生效
+func registerReloaders() {
+	// 证书可能在原路径上更新，每次都重新读取
+	config.OnReload(func(old, c *config.Config) (func(), error) {
+		return utils.LoadCertificates(&c.TLS)
+	})
+	config.OnReload(func(old, c *config.Config) (func(), error) {
+		if c.Auth.Policy == "" {
+			if old.Auth.Policy == "" {
+				return nil, nil
+			}
+			return func() { auth.AuthServer.SetPolicy(nil) }, nil
+		}
+		policy, err := auth.LoadPolicy(c.Auth.Policy)
+		if err != nil {
+			return nil, err
+		}
+		return func() { auth.AuthServer.SetPolicy(policy) }, nil
+	})
+	config.OnReload(func(old, c *config.Config) (func(), error) {
+		if c.NotifyRules == "" {
+			if old.NotifyRules == "" {
+				return nil, nil
+			}
+			return func() { notify.NotifyServer.SetRules(nil) }, nil
+		}
+		rules, err := notify.LoadRules(c.NotifyRules)
+		if err != nil {
+			return nil, err
+		}
+		return func() { notify.NotifyServer.SetRules(rules) }, nil
+	})
+	// 配置未修改时保留通过api设置的日志级别
+	config.OnReload(func(old, c *config.Config) (func(), error) {
+		if c.Log.Level == old.Log.Level {
+			return nil, nil
+		}
+		return func() { logging.SetLevel(c.Log.Level) }, nil
+	})
+}
+
+// 重新加载配置，失败时保持原配置
+func reloadConfig() {
+	result, err := config.Reload()
+	if err != nil {
+		logger.Error("Reload config error", "error", err)
+		return
+	}
+	logger.Info("Config reloaded", "applied", result.Applied, "restart", result.Restart)
+}
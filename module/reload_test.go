@@ -0,0 +1,77 @@
+package module
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hugb/beegecluster/auth"
+	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/logging"
+)
+
+func authenticate(token string) (*auth.User, error) {
+	r := httptest.NewRequest("GET", "/info", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return auth.AuthServer.Authenticate(r)
+}
+
+func TestReloadPolicyAndLogLevel(t *testing.T) {
+	dir, secret := t.TempDir(), "0123456789abcdef"
+	policyFile, configFile := filepath.Join(dir, "policy.json"), filepath.Join(dir, "beege.json")
+	os.WriteFile(policyFile, []byte(`{"Users": [{"Name": "root", "Token": "old-token", "Roles": ["admin"]}]}`), 0600)
+	os.WriteFile(configFile, []byte(`{"Auth": {"Policy": "`+policyFile+`", "ClusterSecret": "`+secret+`"}, "Log": {"Level": "info"}}`), 0600)
+
+	previous, level := config.Get(), logging.Level()
+	defer config.Set(previous)
+	defer logging.SetLevel(level)
+	defer auth.AuthServer.SetPolicy(nil)
+
+	t.Setenv(config.ConfigFileEnv, "")
+	c, err := config.Load(configFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Set(c)
+	if err = auth.AuthServer.LoadPolicy(policyFile); err != nil {
+		t.Fatal(err)
+	}
+	registerReloaders()
+
+	// 策略文件无效时整个配置保持不变
+	os.WriteFile(policyFile, []byte(`{"Users": [{"Name": "root", "Roles": ["missing"]}]}`), 0600)
+	os.WriteFile(configFile, []byte(`{"Auth": {"Policy": "`+policyFile+`", "ClusterSecret": "`+secret+`"}, "Log": {"Level": "debug"}}`), 0600)
+	if _, err = config.Reload(); err == nil {
+		t.Fatal("expected invalid policy to fail the reload")
+	}
+	if config.Get() != c || logging.Level() != "info" {
+		t.Fatal("expected failed reload to keep the config and log level")
+	}
+	if user, err := authenticate("old-token"); err != nil || user.Name != "root" {
+		t.Fatalf("expected old policy to stay in use, got %v", err)
+	}
+
+	os.WriteFile(policyFile, []byte(`{"Users": [{"Name": "root", "Token": "new-token", "Roles": ["admin"]}]}`), 0600)
+	if _, err = config.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if logging.Level() != "debug" {
+		t.Fatalf("expected log level to be reloaded, got %s", logging.Level())
+	}
+	if _, err = authenticate("old-token"); err == nil {
+		t.Fatal("expected old token to be rejected after reload")
+	}
+	if user, err := authenticate("new-token"); err != nil || user.Name != "root" {
+		t.Fatalf("expected reloaded policy to be used, got %v", err)
+	}
+
+	// 删除策略后关闭认证
+	os.WriteFile(configFile, []byte(`{"Log": {"Level": "debug"}}`), 0600)
+	if _, err = config.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if auth.AuthServer.Enabled() {
+		t.Fatal("expected authentication to be disabled")
+	}
+}
@@ -0,0 +1,157 @@
+package module
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hugb/beegecluster/cluster"
+	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/gossip"
+	"github.com/hugb/beegecluster/raft"
+)
+
+// 由leader提交、各controller执行的集群状态修改
+func registerAppliers() {
+	m := map[string]raft.Applier{
+		"docker_admit":  admitDocker,
+		"docker_remove": removeDocker,
+		"docker_state":  setDockerState,
+		"node_evict":    evictNode,
+		"node_readmit":  readmitNode,
+	}
+	for op, fct := range m {
+		if err := raft.RegisterApplier(op, fct); err != nil {
+			logger.Error("Register applier failure", "op", op, "error", err)
+		}
+	}
+	raft.RegisterSnapshotter(stateSnapshotter{})
+}
+
+// docker加入集群，被移出的docker在重新允许之前不接纳
+func admitDocker(address string) error {
+	config.NodesLock.Lock()
+	defer config.NodesLock.Unlock()
+
+	if _, evicted := config.EvictedNodes[address]; evicted {
+		logger.Warn("Ignore admission of evicted docker", "node", address)
+		return nil
+	}
+
+	config.Dockers[address] = time.Now().Unix()
+	delete(config.StaleDockers, address)
+	logger.Info("Docker admitted", "node", address, "dockers", len(config.Dockers))
+	return nil
+}
+
+// docker离开集群
+func removeDocker(address string) error {
+	config.NodesLock.Lock()
+	defer config.NodesLock.Unlock()
+
+	delete(config.Dockers, address)
+	logger.Info("Docker removed", "node", address, "dockers", len(config.Dockers))
+	return nil
+}
+
+// 修改docker的调度状态，数据格式为"address state"，state为空时恢复调度
+func setDockerState(data string) error {
+	fields := strings.SplitN(data, " ", 2)
+	if len(fields) != 2 {
+		return fmt.Errorf("Bad parameter: %s", data)
+	}
+
+	config.NodesLock.Lock()
+	defer config.NodesLock.Unlock()
+
+	if fields[1] == "" {
+		delete(config.DockerStates, fields[0])
+	} else {
+		config.DockerStates[fields[0]] = fields[1]
+	}
+	logger.Info("Docker state changed", "node", fields[0], "state", fields[1])
+	return nil
+}
+
+// 强制移除节点
+func evictNode(address string) error {
+	config.NodesLock.Lock()
+	delete(config.Dockers, address)
+	delete(config.StaleDockers, address)
+	delete(config.DockerStates, address)
+	delete(config.Controllers, address)
+	delete(config.StaleControllers, address)
+	config.EvictedNodes[address] = time.Now().Unix()
+	config.NodesLock.Unlock()
+
+	cluster.ForgetNode(address)
+	logger.Warn("Node is evicted", "node", address)
+	return nil
+}
+
+// 重新允许被移出的节点加入，节点下次连接时加入集群
+func readmitNode(address string) error {
+	config.NodesLock.Lock()
+	delete(config.EvictedNodes, address)
+	config.NodesLock.Unlock()
+
+	if gossip.Members != nil {
+		gossip.Members.Allow(address)
+	}
+	logger.Info("Node is readmitted", "node", address)
+	return nil
+}
+
+// raft快照保存的集群状态，即appliers修改的节点表
+type replicatedState struct {
+	Dockers      map[string]int64
+	DockerStates map[string]string
+	EvictedNodes map[string]int64 `json:",omitempty"`
+}
+
+type stateSnapshotter struct{}
+
+func (stateSnapshotter) Snapshot() (string, error) {
+	config.NodesLock.RLock()
+	defer config.NodesLock.RUnlock()
+
+	b, err := json.Marshal(&replicatedState{Dockers: config.Dockers, DockerStates: config.DockerStates, EvictedNodes: config.EvictedNodes})
+	return string(b), err
+}
+
+// 用leader的快照替换节点表，快照中没有的docker视为已离开
+func (stateSnapshotter) Restore(data string) error {
+	state := &replicatedState{}
+	if err := json.Unmarshal([]byte(data), state); err != nil {
+		return err
+	}
+	if state.Dockers == nil {
+		state.Dockers = make(map[string]int64)
+	}
+	if state.DockerStates == nil {
+		state.DockerStates = make(map[string]string)
+	}
+	if state.EvictedNodes == nil {
+		state.EvictedNodes = make(map[string]int64)
+	}
+
+	config.NodesLock.Lock()
+	defer config.NodesLock.Unlock()
+
+	for address := range state.Dockers {
+		delete(config.StaleDockers, address)
+	}
+	config.Dockers, config.DockerStates = state.Dockers, state.DockerStates
+	if gossip.Members != nil {
+		for address := range config.EvictedNodes {
+			gossip.Members.Allow(address)
+		}
+		for address := range state.EvictedNodes {
+			gossip.Members.Forget(address)
+		}
+	}
+	config.EvictedNodes = state.EvictedNodes
+	logger.Info("Restored cluster state from raft snapshot", "dockers", len(config.Dockers))
+	return nil
+}
@@ -0,0 +1,42 @@
+package module
+
+import (
+	"testing"
+
+	"github.com/hugb/beegecluster/config"
+)
+
+func TestEvictedDockerIsNotAdmitted(t *testing.T) {
+	resetNodes(t)
+	address := "10.0.0.30:4243"
+	admitDocker(address)
+
+	evictNode(address)
+	if _, ok := config.Dockers[address]; ok {
+		t.Fatal("expected evicted docker to be removed")
+	}
+	// 存活的docker重新连接后不再加入
+	admitDocker(address)
+	if _, ok := config.Dockers[address]; ok {
+		t.Fatal("expected evicted docker not to be admitted again")
+	}
+
+	// 移出记录随快照复制到其他controller
+	data, err := stateSnapshotter{}.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.EvictedNodes = make(map[string]int64)
+	if err = (stateSnapshotter{}).Restore(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := config.EvictedNodes[address]; !ok {
+		t.Fatal("expected eviction to be restored from the snapshot")
+	}
+
+	readmitNode(address)
+	admitDocker(address)
+	if _, ok := config.Dockers[address]; !ok {
+		t.Fatal("expected readmitted docker to be admitted")
+	}
+}
@@ -0,0 +1,108 @@
+package module
+
+import (
+	"time"
+
+	"github.com/hugb/beegecluster/cluster"
+	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/registry"
+	"github.com/hugb/beegecluster/store"
+)
+
+var stateStore store.Store
+
+// 打开状态存储并从快照恢复
+func restoreState(address string) error {
+	var err error
+	if stateStore, err = store.Open(address); err != nil {
+		return err
+	}
+	state, err := stateStore.Load()
+	if err != nil || state == nil {
+		return err
+	}
+
+	config.NodesLock.Lock()
+	// 恢复的节点在重新连接之前都视为过期
+	for address, joined := range state.Dockers {
+		if _, exist := config.Dockers[address]; !exist {
+			config.StaleDockers[address] = joined
+		}
+	}
+	for address, joined := range state.Controllers {
+		if _, exist := config.Controllers[address]; !exist {
+			config.StaleControllers[address] = joined
+		}
+	}
+	for address, dockerState := range state.DockerStates {
+		config.DockerStates[address] = dockerState
+	}
+	config.NodesLock.Unlock()
+
+	registry.RegistryServer.Restore(state.Images, state.Containers)
+	cluster.RestoreEventCursors(state.Cursors)
+	time.AfterFunc(config.Get().State.StaleTimeout.Duration(), expireStale)
+
+	logger.Info("Restore state", "time", time.Unix(state.Time, 0), "dockers", len(state.Dockers),
+		"controllers", len(state.Controllers), "images", len(state.Images), "containers", len(state.Containers))
+	return nil
+}
+
+// 超过宽限期仍未重新连接的节点视为已离开，清除其镜像和容器
+func expireStale() {
+	config.NodesLock.Lock()
+	var nodes []string
+	for _, stale := range []map[string]int64{config.StaleDockers, config.StaleControllers} {
+		for address := range stale {
+			nodes = append(nodes, address)
+			delete(stale, address)
+		}
+	}
+	config.NodesLock.Unlock()
+
+	hosts := registry.RegistryServer.ExpireStale()
+	if len(nodes) > 0 || len(hosts) > 0 {
+		logger.Warn("Stale nodes expired", "nodes", nodes, "hosts", hosts)
+	}
+}
+
+// 定时保存快照，间隔可以重新加载
+func saveStateLoop() {
+	for {
+		time.Sleep(config.Get().State.SnapshotInterval.Duration())
+		if err := saveState(); err != nil {
+			logger.Error("Save state error", "error", err)
+		}
+	}
+}
+
+func saveState() error {
+	state := &store.State{
+		Time:         time.Now().Unix(),
+		Dockers:      make(map[string]int64),
+		Controllers:  make(map[string]int64),
+		DockerStates: make(map[string]string),
+	}
+
+	config.NodesLock.RLock()
+	// 过期的节点也要保存，以免其在重新连接前丢失
+	for _, nodes := range []map[string]int64{config.StaleDockers, config.Dockers} {
+		for address, joined := range nodes {
+			state.Dockers[address] = joined
+		}
+	}
+	for _, nodes := range []map[string]int64{config.StaleControllers, config.Controllers} {
+		for address, joined := range nodes {
+			state.Controllers[address] = joined
+		}
+	}
+	for address, dockerState := range config.DockerStates {
+		state.DockerStates[address] = dockerState
+	}
+	config.NodesLock.RUnlock()
+
+	state.Images, state.Containers = registry.RegistryServer.Snapshot()
+	state.Cursors = cluster.EventCursors()
+
+	return stateStore.Save(state)
+}
@@ -0,0 +1,75 @@
+package module
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/registry"
+	"github.com/hugb/beegecluster/resource"
+)
+
+// 替换节点列表，测试结束后还原
+func resetNodes(t *testing.T) {
+	config.NodesLock.Lock()
+	dockers, controllers := config.Dockers, config.Controllers
+	staleDockers, staleControllers := config.StaleDockers, config.StaleControllers
+	states, evicted := config.DockerStates, config.EvictedNodes
+	config.Dockers, config.Controllers = make(map[string]int64), make(map[string]int64)
+	config.StaleDockers, config.StaleControllers = make(map[string]int64), make(map[string]int64)
+	config.DockerStates, config.EvictedNodes = make(map[string]string), make(map[string]int64)
+	config.NodesLock.Unlock()
+	t.Cleanup(func() {
+		config.NodesLock.Lock()
+		config.Dockers, config.Controllers = dockers, controllers
+		config.StaleDockers, config.StaleControllers = staleDockers, staleControllers
+		config.DockerStates, config.EvictedNodes = states, evicted
+		config.NodesLock.Unlock()
+	})
+}
+
+func TestStateSurvivesRestart(t *testing.T) {
+	resetNodes(t)
+	previous := config.Get()
+	c := *previous
+	c.State.StaleTimeout = config.Duration(time.Hour)
+	config.Set(&c)
+	defer config.Set(previous)
+
+	host := "10.0.0.20:4243"
+	defer registry.RegistryServer.UnregisterImagesByHost(host)
+	config.Dockers[host] = 1
+	config.Controllers["10.0.0.21:4244"] = 2
+	registry.RegistryServer.RegisterImage("img-state", &resource.Image{Host: host, Created: 1})
+
+	address := filepath.Join(t.TempDir(), "state.json")
+	if err := restoreState(address); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟重启：节点和注册表都为空
+	resetNodes(t)
+	registry.RegistryServer.UnregisterImagesByHost(host)
+	if err := restoreState(address); err != nil {
+		t.Fatal(err)
+	}
+	if config.StaleDockers[host] != 1 || config.StaleControllers["10.0.0.21:4244"] != 2 || len(config.Dockers) != 0 {
+		t.Fatalf("expected restored nodes to be stale, got %v %v", config.StaleDockers, config.StaleControllers)
+	}
+	if registry.RegistryServer.GetHostByImageId("img-state") != host {
+		t.Fatal("expected restored image to be looked up as a last resort")
+	}
+
+	// 宽限期内没有重新连接的节点被清除
+	expireStale()
+	if len(config.StaleDockers) != 0 || len(config.StaleControllers) != 0 {
+		t.Fatal("expected stale nodes to expire")
+	}
+	if _, ok := registry.RegistryServer.LookupImage("img-state"); ok {
+		t.Fatal("expected images of expired hosts to be dropped")
+	}
+}
@@ -0,0 +1,34 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// 本地命令，事件内容从标准输入传入，主要字段同时以环境变量传入
+type Command struct {
+	Path string
+	Args []string
+}
+
+func (this *Command) Run(event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(this.Path, this.Args...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(),
+		"BEEGE_EVENT_TYPE="+event.Type,
+		"BEEGE_EVENT_NODE="+event.Node,
+		"BEEGE_EVENT_CONTAINER="+event.Container,
+		fmt.Sprintf("BEEGE_EVENT_EXIT_CODE=%d", event.ExitCode),
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err, output)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+////////////////////////////////////////////////////////////
+/*        集群事件通知，按规则投递到webhook或本地命令        */
+////////////////////////////////////////////////////////////
+
+package notify
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hugb/beegecluster/logging"
+)
+
+var logger = logging.Logger("notify")
+
+const (
+	DockerOffline     = "docker_offline"
+	ControllerOffline = "controller_offline"
+	ContainerDie      = "container_die"
+
+	maxQueueSize = 256
+	// 同时投递的数量，webhook超时或重试时其余投递在队列中等待
+	maxWorkers = 8
+)
+
+// 集群事件
+type Event struct {
+	Type      string
+	Node      string
+	Container string `json:",omitempty"`
+	ExitCode  int    `json:",omitempty"`
+	Message   string `json:",omitempty"`
+	Time      int64
+}
+
+type Notifier struct {
+	sync.RWMutex
+
+	rules []*Rule
+	queue chan *Event
+	// 待投递的事件，由固定数量的worker处理
+	deliveries chan *delivery
+	// 各规则下事件发生的时间，用于判断是否达到阈值
+	history map[string][]int64
+}
+
+// 按规则投递一个事件
+type delivery struct {
+	rule  *Rule
+	event *Event
+}
+
+var NotifyServer = &Notifier{
+	queue:      make(chan *Event, maxQueueSize),
+	deliveries: make(chan *delivery, maxQueueSize),
+	history:    make(map[string][]int64),
+}
+
+func init() {
+	go NotifyServer.run()
+	for i := 0; i < maxWorkers; i++ {
+		go NotifyServer.work()
+	}
+}
+
+// 加载通知规则
+func (this *Notifier) LoadRules(path string) error {
+	rules, err := LoadRules(path)
+	if err != nil {
+		return err
+	}
+	this.SetRules(rules)
+	return nil
+}
+
+func (this *Notifier) SetRules(rules []*Rule) {
+	this.Lock()
+	defer this.Unlock()
+
+	this.rules = rules
+	this.history = make(map[string][]int64)
+}
+
+// 提交事件，队列满时丢弃，不阻塞调用方
+func (this *Notifier) Notify(event *Event) {
+	if event.Time == 0 {
+		event.Time = time.Now().Unix()
+	}
+	select {
+	case this.queue <- event:
+	default:
+		logger.Warn("Notify queue is full, drop event", "type", event.Type, "node", event.Node)
+	}
+}
+
+func (this *Notifier) run() {
+	for event := range this.queue {
+		this.dispatch(event)
+	}
+}
+
+// 将匹配的规则放入投递队列，队列满时丢弃
+func (this *Notifier) dispatch(event *Event) {
+	for _, rule := range this.match(event) {
+		select {
+		case this.deliveries <- &delivery{rule: rule, event: event}:
+		default:
+			logger.Warn("Delivery queue is full, drop event", "rule", rule.Name, "type", event.Type, "node", event.Node)
+		}
+	}
+}
+
+func (this *Notifier) work() {
+	for d := range this.deliveries {
+		d.rule.deliver(d.event)
+	}
+}
+
+// 得到匹配事件且达到阈值的规则
+func (this *Notifier) match(event *Event) []*Rule {
+	this.Lock()
+	defer this.Unlock()
+
+	var rules []*Rule
+	for _, rule := range this.rules {
+		if !rule.Match(event) {
+			continue
+		}
+		if rule.Threshold <= 1 {
+			rules = append(rules, rule)
+			continue
+		}
+		// 在时间窗口内同一对象的事件达到阈值才通知，如容器反复崩溃
+		key := rule.Name + " " + event.Type + " " + event.Node + " " + event.Container
+		var times []int64
+		for _, t := range this.history[key] {
+			if event.Time-t < int64(rule.Window) {
+				times = append(times, t)
+			}
+		}
+		times = append(times, event.Time)
+		if len(times) >= rule.Threshold {
+			rules = append(rules, rule)
+			times = nil
+		}
+		this.history[key] = times
+	}
+	return rules
+}
@@ -0,0 +1,134 @@
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func shortBackoff(t *testing.T) {
+	previous := retryBackoff
+	retryBackoff = time.Millisecond
+	t.Cleanup(func() { retryBackoff = previous })
+}
+
+func TestWebhookSignsBody(t *testing.T) {
+	received := make(chan *Event, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Beege-Signature") != "sha256="+Sign("secret", body) {
+			t.Errorf("unexpected signature %q", r.Header.Get("X-Beege-Signature"))
+		}
+		if r.Header.Get("X-Beege-Event") != ContainerDie {
+			t.Errorf("unexpected event header %q", r.Header.Get("X-Beege-Event"))
+		}
+		event := &Event{}
+		json.Unmarshal(body, event)
+		received <- event
+	}))
+	defer server.Close()
+
+	webhook := &Webhook{Url: server.URL, Secret: "secret"}
+	if err := webhook.Send(&Event{Type: ContainerDie, Node: "h1:4243", Container: "c1", ExitCode: 137}); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-received; event.Container != "c1" || event.ExitCode != 137 {
+		t.Fatalf("unexpected event %+v", event)
+	}
+}
+
+func TestWebhookRetriesWithBackoff(t *testing.T) {
+	shortBackoff(t)
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	if err := (&Webhook{Url: server.URL}).Send(&Event{Type: DockerOffline}); err != nil {
+		t.Fatalf("expected webhook to succeed after retries: %s", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestWebhookGivesUpAfterRetries(t *testing.T) {
+	shortBackoff(t)
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	if err := (&Webhook{Url: server.URL, Retries: 2}).Send(&Event{Type: DockerOffline}); err == nil {
+		t.Fatal("expected webhook to fail")
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts with 2 retries, got %d", attempts)
+	}
+}
+
+func TestRuleMatchesEventsAndNodes(t *testing.T) {
+	rule := &Rule{Events: []string{ContainerDie}, Nodes: []string{"h1:4243"}}
+	if !rule.Match(&Event{Type: ContainerDie, Node: "h1:4243"}) {
+		t.Fatal("expected rule to match")
+	}
+	if rule.Match(&Event{Type: DockerOffline, Node: "h1:4243"}) || rule.Match(&Event{Type: ContainerDie, Node: "h2:4243"}) {
+		t.Fatal("expected rule not to match other events or nodes")
+	}
+	if !(&Rule{}).Match(&Event{Type: ControllerOffline, Node: "c1:4244"}) {
+		t.Fatal("expected empty rule to match everything")
+	}
+}
+
+func TestRuleThresholdWithinWindow(t *testing.T) {
+	n := &Notifier{history: make(map[string][]int64)}
+	n.SetRules([]*Rule{{Name: "crash", Events: []string{ContainerDie}, Threshold: 3, Window: 60}})
+
+	matched := 0
+	for _, at := range []int64{100, 120, 200, 210, 220} {
+		matched += len(n.match(&Event{Type: ContainerDie, Node: "h1:4243", Container: "c1", Time: at}))
+	}
+	// 100和120超出了200开始的窗口
+	if matched != 1 {
+		t.Fatalf("expected one notification, got %d", matched)
+	}
+	if len(n.match(&Event{Type: ContainerDie, Node: "h1:4243", Container: "c2", Time: 220})) != 0 {
+		t.Fatal("expected each container to be counted separately")
+	}
+}
+
+func TestDispatchDropsWhenQueueIsFull(t *testing.T) {
+	n := &Notifier{deliveries: make(chan *delivery, 2), history: make(map[string][]int64)}
+	n.SetRules([]*Rule{{Name: "all", Command: &Command{Path: "true"}}})
+
+	for i := 0; i < 5; i++ {
+		n.dispatch(&Event{Type: DockerOffline, Node: "h1:4243"})
+	}
+	if len(n.deliveries) != 2 {
+		t.Fatalf("expected queue to stay bounded, got %d", len(n.deliveries))
+	}
+}
+
+func TestLoadRulesValidates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	os.WriteFile(path, []byte(`[{"Events":["container_die"],"Webhook":{"Url":"http://hook"}}]`), 0600)
+	rules, err := LoadRules(path)
+	if err != nil || len(rules) != 1 || rules[0].Name != "rule0" {
+		t.Fatalf("unexpected rules %+v %v", rules, err)
+	}
+	os.WriteFile(path, []byte(`[{"Name":"empty"}]`), 0600)
+	if _, err = LoadRules(path); err == nil {
+		t.Fatal("expected rule without target to be rejected")
+	}
+}
@@ -0,0 +1,76 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// 通知规则，Events和Nodes为空时匹配所有
+type Rule struct {
+	Name   string
+	Events []string
+	Nodes  []string
+	// Window秒内发生Threshold次才通知
+	Threshold int
+	Window    int
+
+	Webhook *Webhook
+	Command *Command
+}
+
+// 从json文件加载规则
+func LoadRules(path string) ([]*Rule, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*Rule
+	if err = json.Unmarshal(content, &rules); err != nil {
+		return nil, err
+	}
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule%d", i)
+		}
+		if rule.Webhook == nil && rule.Command == nil {
+			return nil, fmt.Errorf("Bad parameter: rule %s has no webhook or command", rule.Name)
+		}
+		if rule.Webhook != nil && rule.Webhook.Url == "" {
+			return nil, fmt.Errorf("Bad parameter: rule %s webhook url is required", rule.Name)
+		}
+		if rule.Command != nil && rule.Command.Path == "" {
+			return nil, fmt.Errorf("Bad parameter: rule %s command path is required", rule.Name)
+		}
+	}
+	return rules, nil
+}
+
+func (this *Rule) Match(event *Event) bool {
+	return contains(this.Events, event.Type) && contains(this.Nodes, event.Node)
+}
+
+func (this *Rule) deliver(event *Event) {
+	if this.Webhook != nil {
+		if err := this.Webhook.Send(event); err != nil {
+			logger.Error("Rule webhook error", "rule", this.Name, "error", err)
+		}
+	}
+	if this.Command != nil {
+		if err := this.Command.Run(event); err != nil {
+			logger.Error("Rule command error", "rule", this.Name, "error", err)
+		}
+	}
+}
+
+func contains(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultRetries = 3
+	defaultTimeout = 5
+)
+
+// 第一次重试前等待的时间，之后每次加倍
+var retryBackoff = time.Second
+
+type Webhook struct {
+	Url string
+	// 用于对内容签名，接收方据此验证来源
+	Secret string
+	// 失败重试次数以及每次请求的超时秒数
+	Retries int
+	Timeout int
+}
+
+// 发送事件，失败时按指数退避重试
+func (this *Webhook) Send(event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	retries := this.Retries
+	if retries <= 0 {
+		retries = defaultRetries
+	}
+	timeout := this.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	client := &http.Client{Timeout: time.Duration(timeout) * time.Second}
+
+	backoff := retryBackoff
+	for i := 0; ; i++ {
+		if err = this.post(client, event, body); err == nil {
+			return nil
+		}
+		if i >= retries {
+			return err
+		}
+		logger.Warn("Webhook error, retry", "url", this.Url, "backoff", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (this *Webhook) post(client *http.Client, event *Event, body []byte) error {
+	request, err := http.NewRequest("POST", this.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Beege-Event", event.Type)
+	if this.Secret != "" {
+		request.Header.Set("X-Beege-Signature", "sha256="+Sign(this.Secret, body))
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", response.Status)
+	}
+	return nil
+}
+
+// 使用HMAC-SHA256对内容签名
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/logging"
+)
+
+// 当前controller生效的配置，不显示集群密钥
+func (this *Proxy) getAdminConfig(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	c := *config.Get()
+	if c.Auth.ClusterSecret != "" {
+		c.Auth.ClusterSecret = "******"
+	}
+	return writeJSON(w, http.StatusOK, &c)
+}
+
+// 重新读取配置文件、环境变量和命令行，应用可以在运行时修改的配置，
+// 返回已生效和需要重启才能生效的配置项
+func (this *Proxy) postAdminConfigReload(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	result, err := config.Reload()
+	if err != nil {
+		return err
+	}
+	logger.Info("Config reloaded", "applied", result.Applied, "restart", result.Restart)
+	return writeJSON(w, http.StatusOK, result)
+}
+
+// 当前controller的日志级别
+func (this *Proxy) getAdminLogLevel(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	return writeJSON(w, http.StatusOK, map[string]string{"Level": logging.Level()})
+}
+
+// 修改当前controller的日志级别，通过level参数或{"Level":"debug"}指定
+func (this *Proxy) putAdminLogLevel(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	level := r.URL.Query().Get("level")
+	if level == "" && r.ContentLength != 0 {
+		var body struct {
+			Level string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return fmt.Errorf("Bad parameter: %s", err)
+		}
+		level = body.Level
+	}
+	if level == "" {
+		return fmt.Errorf("Bad parameter: level is required")
+	}
+
+	previous := logging.Level()
+	if err := logging.SetLevel(level); err != nil {
+		return err
+	}
+	logger.Info("Log level changed", "from", previous, "to", logging.Level())
+	return writeJSON(w, http.StatusOK, map[string]string{"Level": logging.Level()})
+}
@@ -1,18 +1,33 @@
 package proxy
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"strconv"
 
+	"github.com/hugb/beegecluster/config"
 	"github.com/hugb/beegecluster/registry"
+	"github.com/hugb/beegecluster/resource"
+	"github.com/hugb/beegecluster/scheduler"
+	"github.com/hugb/beegecluster/trace"
 	"github.com/hugb/beegecluster/utils"
 )
 
 func (this *Proxy) getImagesJSON(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	host := utils.GetHostFromQueryParam(r)
-	if host == "" {
-		imagesBytes, err := json.Marshal(registry.RegistryServer.GetAllImages())
+	tenant := requestTenant(r)
+	// 租户只能看到共享的和自己命名空间下的镜像，由注册表过滤
+	if host == "" || tenant != "" {
+		var images resource.ImageArray
+		for _, image := range registry.RegistryServer.GetAllImages() {
+			if (host == "" || image.Host == host) && imageVisible(tenant, image) {
+				images = append(images, image)
+			}
+		}
+		imagesBytes, err := json.Marshal(images)
 		if err != nil {
 			fmt.Fprintf(w, "images json encode error: %s", err)
 		} else {
@@ -29,8 +44,241 @@ func (this *Proxy) getImagesByName(w http.ResponseWriter, r *http.Request, vars
 	if vars == nil {
 		return fmt.Errorf("Missing parameter")
 	}
+	if image, ok := registry.RegistryServer.LookupImage(vars["name"]); ok && !imageVisible(requestTenant(r), image) {
+		return fmt.Errorf("No such image: %s", vars["name"])
+	}
+
+	this.httpProxyHosts(lookupImageHosts(r, vars["name"]), w, r)
+
+	return nil
+}
+
+// 集群中的容器，租户只能看到自己的容器
+func (this *Proxy) getContainersJSON(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	host := utils.GetHostFromQueryParam(r)
+	tenant := requestTenant(r)
+	containers := resource.ContainerArray{}
+	for _, container := range registry.RegistryServer.GetAllContainers() {
+		if (host == "" || container.Host == host) && (tenant == "" || container.Tenant == tenant) {
+			containers = append(containers, container)
+		}
+	}
+	return writeJSON(w, http.StatusOK, containers)
+}
+
+// 创建容器，由调度器选择docker，也可通过host参数指定；
+// 租户创建的容器需满足配额，并打上租户标签
+func (this *Proxy) postContainersCreate(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body.Close()
+
+	var container map[string]interface{}
+	if err = json.Unmarshal(body, &container); err != nil {
+		return fmt.Errorf("Bad parameter: %s", err)
+	}
+	image, _ := container["Image"].(string)
+
+	tenant := requestTenant(r)
+	memory := containerMemory(container)
+	if tenant != "" {
+		labels, _ := container["Labels"].(map[string]interface{})
+		if labels == nil {
+			labels = make(map[string]interface{})
+		}
+		labels[config.TenantLabel] = tenant
+		labels[config.TenantMemoryLabel] = strconv.FormatInt(memory, 10)
+		container["Labels"] = labels
+		if body, err = json.Marshal(container); err != nil {
+			return err
+		}
+
+		reservation, err := reserveQuota(tenant, memory)
+		if err != nil {
+			return err
+		}
+		defer registry.RegistryServer.ReleaseContainerOwner(reservation)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+
+	host := utils.GetHostFromQueryParam(r)
+	if host == "" {
+		_, span := trace.Start(r.Context(), "scheduler.select")
+		host, err = scheduler.SelectHost(image)
+		span.SetAttribute("image", image)
+		span.SetAttribute("node", host)
+		span.Finish(err)
+		if err != nil {
+			return err
+		}
+	} else if !scheduler.Schedulable(host) {
+		return fmt.Errorf("Conflict: node %s is not schedulable", host)
+	}
+
+	if tenant == "" {
+		this.httpProxy(host, w, r)
+		return nil
+	}
+	status, response, err := this.proxyAndRead(host, w, r)
+	if err != nil || status != http.StatusCreated {
+		return err
+	}
+	var created struct {
+		Id string
+	}
+	if err = json.Unmarshal(response, &created); err == nil && created.Id != "" {
+		registry.RegistryServer.SetContainerOwner(created.Id, host, tenant, memory)
+	}
+	return nil
+}
 
-	this.httpProxy(registry.RegistryServer.GetHostByImageId(vars["name"]), w, r)
+// 容器的内存限制，新版本api在HostConfig中
+func containerMemory(container map[string]interface{}) int64 {
+	if memory, ok := container["Memory"].(float64); ok && memory > 0 {
+		return int64(memory)
+	}
+	if hostConfig, ok := container["HostConfig"].(map[string]interface{}); ok {
+		if memory, ok := hostConfig["Memory"].(float64); ok {
+			return int64(memory)
+		}
+	}
+	return 0
+}
+
+// 代理请求并返回响应内容，响应同时写给客户端
+func (this *Proxy) proxyAndRead(host string, w http.ResponseWriter, r *http.Request) (int, []byte, error) {
+	if err := negotiateVersion(host, r); err != nil {
+		return 0, nil, err
+	}
+
+	handler := requestHandler{request: r, response: w}
+	response, err := handler.httpRequest(this.pool, host)
+	if err != nil {
+		handler.badGateway()
+		return http.StatusBadGateway, nil, nil
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	w.Header().Set("X-Beege-Node", host)
+	w.WriteHeader(response.StatusCode)
+	w.Write(body)
+
+	return response.StatusCode, body, nil
+}
+
+// attach到容器，docker响应后劫持连接
+func (this *Proxy) postContainersAttach(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	if err := checkContainerTenant(r, vars["name"]); err != nil {
+		return err
+	}
+
+	this.streamProxy(lookupContainerHost(r, vars["name"]), w, r)
+
+	return nil
+}
+
+// 通过websocket attach到容器
+func (this *Proxy) getContainersAttachWs(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	if err := checkContainerTenant(r, vars["name"]); err != nil {
+		return err
+	}
+
+	this.httpProxy(lookupContainerHost(r, vars["name"]), w, r)
+
+	return nil
+}
+
+// 容器日志，follow模式下持续输出直到客户端断开
+func (this *Proxy) getContainersLogs(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	if err := checkContainerTenant(r, vars["name"]); err != nil {
+		return err
+	}
+
+	this.httpProxy(lookupContainerHost(r, vars["name"]), w, r)
+
+	return nil
+}
+
+// 在容器中创建exec实例，记录实例所在的docker
+func (this *Proxy) postContainersExec(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+
+	host := lookupContainerHost(r, vars["name"])
+	if host == "" {
+		return fmt.Errorf("No such container: %s", vars["name"])
+	}
+	if err := checkContainerTenant(r, vars["name"]); err != nil {
+		return err
+	}
+
+	status, body, err := this.proxyAndRead(host, w, r)
+	if err != nil || status != http.StatusCreated {
+		return err
+	}
+	var exec struct {
+		Id string
+	}
+	if err = json.Unmarshal(body, &exec); err == nil && exec.Id != "" {
+		registry.RegistryServer.RegisterExec(exec.Id, &resource.Exec{Container: vars["name"], Host: host})
+	}
+
+	return nil
+}
+
+// 启动exec实例，非detach模式下docker会劫持连接
+func (this *Proxy) postExecStart(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+
+	var options struct {
+		Detach bool
+	}
+	if len(body) > 0 {
+		if err = json.Unmarshal(body, &options); err != nil {
+			return fmt.Errorf("Bad parameter: %s", err)
+		}
+	}
+
+	exec, ok := registry.RegistryServer.LookupExec(vars["name"])
+	if !ok {
+		return fmt.Errorf("No such exec instance: %s", vars["name"])
+	}
+	if err = checkContainerTenant(r, exec.Container); err != nil {
+		return err
+	}
+	host := exec.Host
+	if options.Detach {
+		this.httpProxy(host, w, r)
+	} else {
+		this.streamProxy(host, w, r)
+	}
 
 	return nil
 }
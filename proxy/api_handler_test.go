@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hugb/beegecluster/registry"
+	"github.com/hugb/beegecluster/resource"
+)
+
+// 模拟docker的exec、attach和日志接口，attach和非detach的exec start劫持连接后回显
+func newStreamDocker(t *testing.T, execId string) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/exec"):
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"Id":"%s"}`, execId)
+		case strings.HasSuffix(r.URL.Path, "/logs"):
+			fmt.Fprint(w, "log line\n")
+		case strings.HasSuffix(r.URL.Path, "/start") || strings.HasSuffix(r.URL.Path, "/attach"):
+			var options struct{ Detach bool }
+			json.NewDecoder(r.Body).Decode(&options)
+			if options.Detach {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			conn, buffered, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			fmt.Fprint(conn, "HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.raw-stream\r\n\r\n")
+			io.Copy(conn, buffered)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+// 按路径调用代理的处理函数
+func newTestProxy(t *testing.T) string {
+	p := &Proxy{pool: newTransportPool()}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		vars := map[string]string{"name": parts[1]}
+		var err error
+		switch {
+		case parts[0] == "exec":
+			err = p.postExecStart(w, r, vars)
+		case parts[2] == "exec":
+			err = p.postContainersExec(w, r, vars)
+		case parts[2] == "attach":
+			err = p.postContainersAttach(w, r, vars)
+		case parts[2] == "logs":
+			err = p.getContainersLogs(w, r, vars)
+		}
+		if err != nil {
+			httpError(w, err)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// 发送会被劫持的请求，写入数据并关闭写方向，读出回显的内容
+func stream(t *testing.T, url, path, input string) string {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	body := `{"Detach":false}`
+	fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: docker\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", path, len(body), body)
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", response.StatusCode)
+	}
+	fmt.Fprint(conn, input)
+	conn.(*net.TCPConn).CloseWrite()
+	output, _ := ioutil.ReadAll(reader)
+	return string(output)
+}
+
+func TestExecRoutedToContainerDocker(t *testing.T) {
+	docker := newStreamDocker(t, "exec-routed")
+	container := strings.Repeat("e", 64)
+	registry.RegistryServer.RegisterContainer(container, &resource.Container{Host: docker})
+	defer registry.RegistryServer.UnregisterContainer(container)
+	defer registry.RegistryServer.UnregisterExec("exec-routed")
+	url := newTestProxy(t)
+
+	response, err := http.Post(url+"/containers/"+container+"/exec", "application/json", strings.NewReader(`{"Cmd":["sh"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusCreated || response.Header.Get("X-Beege-Node") != docker {
+		t.Fatalf("unexpected exec create response %d %s", response.StatusCode, response.Header.Get("X-Beege-Node"))
+	}
+	exec, ok := registry.RegistryServer.LookupExec("exec-routed")
+	if !ok || exec.Host != docker || exec.Container != container {
+		t.Fatalf("expected exec to be registered on the container docker, got %+v", exec)
+	}
+
+	if output := stream(t, url, "/exec/exec-routed/start", "echo hello"); output != "echo hello" {
+		t.Fatalf("expected stream to be forwarded, got %q", output)
+	}
+	response, err = http.Post(url+"/exec/exec-routed/start", "application/json", strings.NewReader(`{"Detach":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("expected detached exec to be proxied, got %d", response.StatusCode)
+	}
+
+	response, err = http.Post(url+"/exec/unknown/start", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected unknown exec to be not found, got %d", response.StatusCode)
+	}
+}
+
+func TestAttachAndLogsRoutedToContainerDocker(t *testing.T) {
+	docker := newStreamDocker(t, "")
+	container := strings.Repeat("a", 64)
+	registry.RegistryServer.RegisterContainer(container, &resource.Container{Host: docker})
+	defer registry.RegistryServer.UnregisterContainer(container)
+	url := newTestProxy(t)
+
+	if output := stream(t, url, "/containers/"+container[:12]+"/attach?stream=1&stdin=1", "input"); output != "input" {
+		t.Fatalf("expected attach to be forwarded, got %q", output)
+	}
+	response, err := http.Get(url + "/containers/" + container + "/logs?stdout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if string(body) != "log line\n" {
+		t.Fatalf("unexpected logs %q", body)
+	}
+}
+
+func TestIsStreamRequest(t *testing.T) {
+	for path, expected := range map[string]bool{
+		"/containers/abc/attach":       true,
+		"/v1.24/exec/abc/start":        true,
+		"/containers/abc/attach/ws":    false,
+		"/containers/abc/logs":         false,
+		"/v1.24/containers/abc/create": false,
+	} {
+		if isStreamRequest(httptest.NewRequest("POST", path, nil)) != expected {
+			t.Fatalf("unexpected stream detection for %s", path)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hugb/beegecluster/audit"
+	"github.com/hugb/beegecluster/auth"
+	"github.com/hugb/beegecluster/trace"
+)
+
+// 记录响应状态码，同时保留劫持和刷新的能力
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (this *statusRecorder) WriteHeader(code int) {
+	if this.status == 0 {
+		this.status = code
+	}
+	this.ResponseWriter.WriteHeader(code)
+}
+
+func (this *statusRecorder) Write(b []byte) (int, error) {
+	if this.status == 0 {
+		this.status = http.StatusOK
+	}
+	return this.ResponseWriter.Write(b)
+}
+
+func (this *statusRecorder) Flush() {
+	if flusher, ok := this.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (this *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := this.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer cannot hijack")
+	}
+	if this.status == 0 {
+		this.status = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
+
+func (this *statusRecorder) Unwrap() http.ResponseWriter {
+	return this.ResponseWriter
+}
+
+// 记录一次修改集群的api调用
+func auditRequest(r *http.Request, w *statusRecorder, forwardedFor string, started time.Time) {
+	entry := &audit.Entry{
+		Type:         audit.API,
+		RequestId:    trace.RequestId(r.Context()),
+		RemoteAddr:   r.RemoteAddr,
+		ForwardedFor: forwardedFor,
+		Forwarded:    r.Header.Get(auth.ForwardedHeader),
+		Method:       r.Method,
+		Path:         r.URL.Path,
+		Node:         w.Header().Get("X-Beege-Node"),
+		Status:       w.status,
+		Duration:     int64(time.Since(started) / time.Millisecond),
+	}
+	if user := auth.UserFromRequest(r); user != nil {
+		entry.User = user.Name
+	}
+
+	vars := mux.Vars(r)
+	path := r.URL.Path
+	if match := versionPrefix.FindString(path); match != "" {
+		path = path[len(match)-1:]
+	}
+	switch {
+	case strings.HasPrefix(path, "/containers/"):
+		entry.Container = vars["name"]
+	case strings.HasPrefix(path, "/images/"):
+		entry.Image = vars["name"]
+	case strings.HasPrefix(path, "/exec/"):
+		entry.Exec = vars["name"]
+	case strings.HasPrefix(path, "/nodes/"):
+		entry.Node = vars["id"]
+	}
+	audit.AuditServer.Record(entry)
+}
+
+// 查询审计日志，since和until为unix时间
+func (this *Proxy) getAudit(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := r.ParseForm(); err != nil {
+		return fmt.Errorf("Bad parameter: %s", err)
+	}
+	query := &audit.Query{
+		Type:      r.Form.Get("type"),
+		User:      r.Form.Get("user"),
+		RequestId: r.Form.Get("request"),
+		Node:      r.Form.Get("node"),
+		Container: r.Form.Get("container"),
+		Image:     r.Form.Get("image"),
+		Limit:     100,
+	}
+	for name, value := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if s := r.Form.Get(name); s != "" {
+			seconds, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return fmt.Errorf("Bad parameter: %s", name)
+			}
+			*value = time.Unix(seconds, 0)
+		}
+	}
+	if s := r.Form.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 0 {
+			return fmt.Errorf("Bad parameter: limit")
+		}
+		query.Limit = limit
+	}
+
+	entries, err := audit.AuditServer.Search(query)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, entries)
+}
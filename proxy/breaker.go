@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hugb/beegecluster/config"
+)
+
+// 每个后端的熔断状态，连续失败达到阈值后打开，冷却后允许一个请求试探
+type breaker struct {
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+var breakers = struct {
+	sync.Mutex
+	m map[string]*breaker
+}{m: make(map[string]*breaker)}
+
+func lookupBreaker(host string) *breaker {
+	b, ok := breakers.m[host]
+	if !ok {
+		b = &breaker{}
+		breakers.m[host] = b
+	}
+	return b
+}
+
+// 是否可以向该后端转发请求
+func breakerAllow(host string) bool {
+	breakers.Lock()
+	defer breakers.Unlock()
+
+	b := lookupBreaker(host)
+	if b.failures < config.Get().Proxy.BreakerThreshold {
+		return true
+	}
+	if b.probing || time.Since(b.openedAt) < config.Get().Proxy.BreakerCooldown.Duration() {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func breakerSuccess(host string) {
+	breakers.Lock()
+	defer breakers.Unlock()
+
+	b := lookupBreaker(host)
+	if b.failures >= config.Get().Proxy.BreakerThreshold {
+		logger.Info("Circuit breaker closed", "node", host)
+	}
+	b.failures, b.probing = 0, false
+}
+
+// 请求没有得到后端的结果，如版本不兼容或客户端取消，不计入成败，
+// 试探中的熔断器允许下一个请求继续试探
+func breakerRelease(host string) {
+	breakers.Lock()
+	defer breakers.Unlock()
+
+	lookupBreaker(host).probing = false
+}
+
+func breakerFailure(host string) {
+	breakers.Lock()
+	defer breakers.Unlock()
+
+	b := lookupBreaker(host)
+	b.failures++
+	if b.failures >= config.Get().Proxy.BreakerThreshold {
+		if !b.probing {
+			logger.Warn("Circuit breaker opened", "node", host, "failures", b.failures)
+		}
+		b.openedAt, b.probing = time.Now(), false
+	}
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hugb/beegecluster/config"
+)
+
+func setBreaker(t *testing.T, threshold int, cooldown time.Duration) {
+	previous := config.Get()
+	c := *previous
+	c.Proxy.BreakerThreshold = threshold
+	c.Proxy.BreakerCooldown = config.Duration(cooldown)
+	c.Proxy.RetryBackoff = 0
+	config.Set(&c)
+	t.Cleanup(func() { config.Set(previous) })
+}
+
+func TestBreakerOpensAndProbes(t *testing.T) {
+	setBreaker(t, 2, 50*time.Millisecond)
+	host := "10.0.0.50:4243"
+
+	breakerFailure(host)
+	if !breakerAllow(host) {
+		t.Fatal("expected breaker to stay closed below the threshold")
+	}
+	breakerFailure(host)
+	if breakerAllow(host) {
+		t.Fatal("expected breaker to open at the threshold")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !breakerAllow(host) {
+		t.Fatal("expected one probe after the cooldown")
+	}
+	if breakerAllow(host) {
+		t.Fatal("expected only one probe at a time")
+	}
+	// 试探失败后重新冷却
+	breakerFailure(host)
+	if breakerAllow(host) {
+		t.Fatal("expected failed probe to reopen the breaker")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	breakerAllow(host)
+	breakerSuccess(host)
+	if !breakerAllow(host) || !breakerAllow(host) {
+		t.Fatal("expected successful probe to close the breaker")
+	}
+}
+
+func TestBreakerReleaseAllowsNextProbe(t *testing.T) {
+	setBreaker(t, 1, 10*time.Millisecond)
+	host := "10.0.0.51:4243"
+
+	breakerFailure(host)
+	time.Sleep(20 * time.Millisecond)
+	if !breakerAllow(host) {
+		t.Fatal("expected one probe after the cooldown")
+	}
+	// 试探的请求没有到达后端，如版本不兼容
+	breakerRelease(host)
+	if !breakerAllow(host) {
+		t.Fatal("expected released probe to allow another probe")
+	}
+}
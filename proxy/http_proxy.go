@@ -1,53 +1,134 @@
 package proxy
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math"
 	"net"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 
+	"github.com/hugb/beegecluster/auth"
 	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/logging"
+	"github.com/hugb/beegecluster/raft"
+	"github.com/hugb/beegecluster/trace"
+	"github.com/hugb/beegecluster/utils"
 )
 
+var logger = logging.Logger("proxy")
+
 type Proxy struct {
-	*http.Transport
+	// 到各docker的连接池，tcp和websocket升级请求使用单独的连接
+	pool *transportPool
 }
 
+var (
+	server *http.Server
+	// 处理中的tcp和websocket连接
+	sessions sync.WaitGroup
+)
+
 type HttpApiFunc func(w http.ResponseWriter, r *http.Request, vars map[string]string) error
 
 func NewProxyServer() {
-	proxy := &Proxy{
-		Transport: &http.Transport{
-			ResponseHeaderTimeout: time.Duration(5) * time.Second,
-		},
-	}
+	proxy := &Proxy{pool: newTransportPool()}
 	route, err := proxy.createRouter()
 	if err != nil {
 		panic(err)
 	}
 
-	ln, err := net.Listen("tcp", config.ServiceAddress)
+	ln, err := net.Listen("tcp", config.Get().ServiceAddress)
 	if err != nil {
 		panic(err)
 	}
+	if utils.TLSEnabled() {
+		if err = utils.ReloadCertificates(); err != nil {
+			panic(err)
+		}
+		ln = tls.NewListener(ln, utils.ServerTLSConfig())
+	}
 
-	httpSrv := http.Server{Addr: config.ServiceAddress, Handler: route}
-	if err = httpSrv.Serve(ln); err != nil {
+	server = &http.Server{
+		Addr:              config.Get().ServiceAddress,
+		Handler:           route,
+		ReadHeaderTimeout: config.Get().Server.ReadHeaderTimeout.Duration(),
+		ReadTimeout:       config.Get().Server.ReadTimeout.Duration(),
+		WriteTimeout:      config.Get().Server.WriteTimeout.Duration(),
+		IdleTimeout:       config.Get().Server.IdleTimeout.Duration(),
+	}
+	if err = server.Serve(ln); err != nil && err != http.ErrServerClosed {
 		panic(err)
 	}
 }
 
+// 停止接收新请求，等待处理中的请求和劫持的连接完成，超时后直接返回
+func Shutdown(timeout time.Duration) {
+	if server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Error("Shutdown proxy server error", "error", err)
+	}
+	// 劫持的连接不受Shutdown管理
+	done := make(chan bool)
+	go func() {
+		sessions.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logger.Warn("Proxy sessions are not finished before deadline")
+	}
+}
+
 func (this *Proxy) createRouter() (*mux.Router, error) {
 	router := mux.NewRouter()
 	routerMap := map[string]map[string]HttpApiFunc{
 		"GET": {
-			"/images/json":           this.getImagesJSON,
-			"/images/{name:.*}/json": this.getImagesByName,
+			"/images/json":                    this.getImagesJSON,
+			"/containers/json":                this.getContainersJSON,
+			"/images/{name:.*}/json":          this.getImagesByName,
+			"/containers/{name:.*}/attach/ws": this.getContainersAttachWs,
+			"/containers/{name:.*}/logs":      this.getContainersLogs,
+			"/info":                           this.getInfo,
+			"/version":                        this.getVersion,
+			"/nodes":                          this.getNodes,
+			"/nodes/{id}":                     this.getNodesById,
+			"/proxy/pool":                     this.getProxyPool,
+			"/audit":                          this.getAudit,
+			"/admin/config":                   this.getAdminConfig,
+			"/admin/loglevel":                 this.getAdminLogLevel,
+		},
+		"POST": {
+			"/containers/create":           this.postContainersCreate,
+			"/containers/{name:.*}/attach": this.postContainersAttach,
+			"/containers/{name:.*}/exec":   this.postContainersExec,
+			"/exec/{name:.*}/start":        this.postExecStart,
+			"/nodes/{id}/cordon":           this.postNodesCordon,
+			"/nodes/{id}/uncordon":         this.postNodesUncordon,
+			"/nodes/{id}/drain":            this.postNodesDrain,
+			"/nodes/{id}/readmit":          this.postNodesReadmit,
+			"/admin/config/reload":         this.postAdminConfigReload,
+		},
+		"PUT": {
+			"/admin/loglevel": this.putAdminLogLevel,
+		},
+		"DELETE": {
+			"/nodes/{id}": this.deleteNodes,
 		},
-		"POST":   {},
-		"DELETE": {},
 	}
 	for method, routes := range routerMap {
 		for route, fct := range routes {
@@ -55,7 +136,7 @@ func (this *Proxy) createRouter() (*mux.Router, error) {
 			localRoute := route
 			localMethod := method
 
-			f := makeHttpHandler(localFct)
+			f := this.makeHttpHandler(localRoute, localFct)
 
 			if localRoute == "" {
 				router.Methods(localMethod).HandlerFunc(f)
@@ -69,18 +150,91 @@ func (this *Proxy) createRouter() (*mux.Router, error) {
 	return router, nil
 }
 
-func makeHttpHandler(handlerFunc HttpApiFunc) http.HandlerFunc {
+func (this *Proxy) makeHttpHandler(route string, handlerFunc HttpApiFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// todo:验证版本兼容性
+		// 分配请求id并开始追踪
+		r, span := startRequestSpan(w, r, route)
+		recorder := &statusRecorder{ResponseWriter: w}
+		w = recorder
+		defer func() {
+			finishRequestSpan(span, recorder.status)
+		}()
+		requestLogger(r).Debug("Handle request", "method", r.Method, "route", route, "path", r.URL.Path, "remote", r.RemoteAddr)
+
+		// 修改集群的请求记入审计日志
+		if r.Method != "GET" && r.Method != "HEAD" {
+			forwardedFor := r.Header.Get("X-Forwarded-For")
+			started := time.Now()
+			defer func() {
+				auditRequest(r, recorder, forwardedFor, started)
+			}()
+		}
+
+		// 认证之前按来源ip限制请求速率和并发数，认证失败的尝试同样受限
+		release, wait, err := limiter.Acquire(r)
+		if err != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			httpError(w, err)
+			return
+		}
+		defer release()
+
+		// 认证用户并检查其角色是否允许该请求
+		user, err := auth.AuthServer.Authenticate(r)
+		if err == nil {
+			err = auth.AuthServer.Authorize(user, r.Method, r.URL.Path)
+		}
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		r = auth.WithUser(r, user)
+		if user != nil {
+			span.SetAttribute("user", user.Name)
+		}
+
+		// 验证版本兼容性
+		if err := checkVersion(mux.Vars(r)["version"]); err != nil {
+			httpError(w, err)
+			return
+		}
 
 		// todo:处理所有api的公共业务逻辑
 
+		// 按路由设置超时，客户端断开时取消到docker的请求
+		r, cancel := withRequestTimeout(w, r)
+		defer cancel()
+
+		// 修改集群状态的请求只能由leader处理，管理当前controller的请求除外
+		if r.Method != "GET" && !raft.IsLeader() && !isLocalRequest(r) {
+			this.forwardToLeader(w, r)
+			return
+		}
+
 		if err := handlerFunc(w, r, mux.Vars(r)); err != nil {
+			requestLogger(r).Debug("Request failed", "method", r.Method, "route", route, "error", err)
 			httpError(w, err)
 		}
 	}
 }
 
+// follower将写请求转发给leader
+func (this *Proxy) forwardToLeader(w http.ResponseWriter, r *http.Request) {
+	_, leader := raft.Leader()
+	// 已经转发过一次，说明leader发生了变化，由客户端重试
+	if leader == "" || r.Header.Get(auth.ForwardedHeader) != "" {
+		httpError(w, fmt.Errorf("No leader elected"))
+		return
+	}
+	auth.SignForward(r, config.Get().ServiceAddress, auth.UserFromRequest(r))
+	// attach和exec start由leader劫持连接，需要转发原始连接
+	if isStreamRequest(r) {
+		this.streamProxy(leader, w, r)
+	} else {
+		this.httpProxy(leader, w, r)
+	}
+}
+
 // 根据错误生成不同的http错误响应
 func httpError(w http.ResponseWriter, err error) {
 	statusCode := http.StatusInternalServerError
@@ -92,10 +246,15 @@ func httpError(w http.ResponseWriter, err error) {
 		statusCode = http.StatusConflict
 	} else if strings.Contains(err.Error(), "Impossible") {
 		statusCode = http.StatusNotAcceptable
-	} else if strings.Contains(err.Error(), "Wrong login/password") {
+	} else if strings.Contains(err.Error(), "Wrong login/password") || strings.Contains(err.Error(), "Unauthorized") {
 		statusCode = http.StatusUnauthorized
-	} else if strings.Contains(err.Error(), "hasn't been activated") {
+		w.Header().Set("WWW-Authenticate", `Basic realm="beegecluster"`)
+	} else if strings.Contains(err.Error(), "hasn't been activated") || strings.Contains(err.Error(), "Forbidden") {
 		statusCode = http.StatusForbidden
+	} else if strings.Contains(err.Error(), "No leader") || strings.Contains(err.Error(), "Unavailable") {
+		statusCode = http.StatusServiceUnavailable
+	} else if strings.Contains(err.Error(), "Too many requests") {
+		statusCode = http.StatusTooManyRequests
 	}
 
 	http.Error(w, err.Error(), statusCode)
@@ -103,6 +262,11 @@ func httpError(w http.ResponseWriter, err error) {
 
 // 代理到后端web服务器
 func (this *Proxy) httpProxy(host string, w http.ResponseWriter, r *http.Request) {
+	this.httpProxyHosts([]string{host}, w, r)
+}
+
+// 代理到存有相同资源的一组后端，幂等请求失败时换下一个后端重试
+func (this *Proxy) httpProxyHosts(hosts []string, w http.ResponseWriter, r *http.Request) {
 	handler := requestHandler{request: r, response: w}
 	// 仅支持http1.0和1.1
 	if !isProtocolSupported(r) {
@@ -114,27 +278,131 @@ func (this *Proxy) httpProxy(host string, w http.ResponseWriter, r *http.Request
 		handler.heartbeat()
 		return
 	}
-	if host == "" {
+	if len(hosts) == 0 || hosts[0] == "" {
 		handler.missingRoute()
 		return
 	}
-	if isTcpUpgrade(r) {
-		handler.tcpRequest(host)
+	if isTcpUpgrade(r) || isWebSocketUpgrade(r) {
+		if err := negotiateVersion(hosts[0], r); err != nil {
+			httpError(w, err)
+			return
+		}
+		if isTcpUpgrade(r) {
+			handler.tcpRequest(hosts[0])
+		} else {
+			// websocket代理支持
+			handler.webSocketRequest(hosts[0])
+		}
 		return
 	}
-	// websocket代理支持
-	if isWebSocketUpgrade(r) {
-		handler.webSocketRequest(host)
+
+	attempts := 1
+	if isIdempotent(r) && config.Get().Proxy.RetryAttempts > 1 {
+		attempts = config.Get().Proxy.RetryAttempts
+	}
+	// 每次尝试前恢复请求，避免重复追加转发头或改写的版本
+	path := r.URL.Path
+	forwardedFor := r.Header["X-Forwarded-For"]
+	backoff := config.Get().Proxy.RetryBackoff.Duration()
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		_, span := trace.Start(r.Context(), "route.select")
+		host := selectUpstream(hosts, attempt)
+		span.SetAttribute("nodes", len(hosts))
+		span.SetAttribute("node", host)
+		span.SetAttribute("attempt", attempt)
+		span.Finish(nil)
+		if host == "" {
+			err = fmt.Errorf("Unavailable: all upstreams for %s are failing", r.URL.Path)
+			break
+		}
+		r.URL.Path = path
+		if forwardedFor == nil {
+			r.Header.Del("X-Forwarded-For")
+		} else {
+			r.Header["X-Forwarded-For"] = forwardedFor
+		}
+		if err = negotiateVersion(host, r); err != nil {
+			breakerRelease(host)
+			continue
+		}
+
+		var response *http.Response
+		if response, err = handler.httpRequest(this.pool, host); err != nil {
+			// 客户端取消不是后端的故障，也不再重试
+			if errors.Is(err, context.Canceled) || r.Context().Err() == context.Canceled {
+				breakerRelease(host)
+				return
+			}
+			requestLogger(r).Warn("Proxy request error", "method", r.Method, "path", r.URL.Path, "node", host, "error", err)
+			breakerFailure(host)
+			continue
+		}
+		breakerSuccess(host)
+		// 转发给leader时由leader设置实际处理的docker
+		if w.Header().Get("X-Beege-Node") == "" {
+			w.Header().Set("X-Beege-Node", host)
+		}
+		// follow模式的日志在客户端断开后需关闭与docker的连接
+		defer response.Body.Close()
+		handler.writeResponse(response)
 		return
 	}
 
-	if response, err := handler.httpRequest(this.Transport, host); err != nil {
-		handler.badGateway()
+	if strings.Contains(err.Error(), "Unavailable") || strings.Contains(err.Error(), "Bad parameter") {
+		httpError(w, err)
 	} else {
-		handler.writeResponse(response)
+		handler.badGateway()
 	}
 }
 
+// 从第start个后端开始，选择熔断器允许的后端
+func selectUpstream(hosts []string, start int) string {
+	for i := range hosts {
+		host := hosts[(start+i)%len(hosts)]
+		if breakerAllow(host) {
+			return host
+		}
+	}
+	return ""
+}
+
+var streamPattern = regexp.MustCompile(`^(/v[0-9.]+)?/(containers/[^/]+/attach|exec/[^/]+/start)$`)
+
+// docker会劫持连接的请求
+func isStreamRequest(request *http.Request) bool {
+	return request.Method == "POST" && streamPattern.MatchString(request.URL.Path)
+}
+
+// 没有请求体的GET和HEAD请求可以安全重试
+func isIdempotent(request *http.Request) bool {
+	return (request.Method == "GET" || request.Method == "HEAD") && request.ContentLength == 0
+}
+
+// 代理docker会劫持连接的api
+func (this *Proxy) streamProxy(host string, w http.ResponseWriter, r *http.Request) {
+	handler := requestHandler{request: r, response: w}
+	if host == "" {
+		handler.missingRoute()
+		return
+	}
+	if err := negotiateVersion(host, r); err != nil {
+		httpError(w, err)
+		return
+	}
+	handler.streamRequest(host)
+}
+
+// 管理接口只作用于接收请求的controller
+func isLocalRequest(request *http.Request) bool {
+	return strings.HasPrefix(versionPrefix.ReplaceAllString(request.URL.Path, "/"), "/admin/")
+}
+
 func isProtocolSupported(request *http.Request) bool {
 	return request.ProtoMajor == 1 && (request.ProtoMinor == 0 || request.ProtoMinor == 1)
 }
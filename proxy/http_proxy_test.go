@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 在本地端口启动代理服务器，测试结束后关闭
+func startServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go server.Serve(ln)
+	t.Cleanup(func() {
+		server.Close()
+		server = nil
+	})
+	return "http://" + ln.Addr().String()
+}
+
+func TestShutdownWaitsForSessions(t *testing.T) {
+	url := startServer(t)
+	if _, err := http.Get(url); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions.Add(1)
+	done := make(chan bool)
+	go func() {
+		Shutdown(5 * time.Second)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected shutdown to wait for hijacked sessions")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := http.Get(url); err == nil {
+		t.Fatal("expected new requests to be refused while shutting down")
+	}
+	sessions.Done()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected shutdown to finish after the session ended")
+	}
+}
+
+// 已关闭的端口，连接会被拒绝
+func deadHost(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ln.Addr().String()
+	ln.Close()
+	return address
+}
+
+func liveHost(t *testing.T, requests *int32) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		fmt.Fprint(w, "ok")
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestIdempotentRequestsFailOver(t *testing.T) {
+	setBreaker(t, 5, time.Minute)
+	var requests int32
+	dead, live := deadHost(t), liveHost(t, &requests)
+	p := &Proxy{pool: newTransportPool()}
+
+	w := httptest.NewRecorder()
+	p.httpProxyHosts([]string{dead, live}, w, httptest.NewRequest("GET", "/images/busybox/json", nil))
+	if w.Code != http.StatusOK || w.Header().Get("X-Beege-Node") != live {
+		t.Fatalf("expected request to fail over to %s, got %d %s", live, w.Code, w.Header().Get("X-Beege-Node"))
+	}
+
+	// 非幂等请求不重试
+	w = httptest.NewRecorder()
+	p.httpProxyHosts([]string{dead, live}, w, httptest.NewRequest("POST", "/images/create", strings.NewReader("{}")))
+	if w.Code != http.StatusBadGateway || requests != 1 {
+		t.Fatalf("expected post not to be retried, got %d after %d requests", w.Code, requests)
+	}
+}
+
+func TestClientCancelIsNotUpstreamFailure(t *testing.T) {
+	setBreaker(t, 1, time.Minute)
+	received := make(chan bool, 1)
+	docker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- true
+		<-r.Context().Done()
+	}))
+	defer docker.Close()
+	host := strings.TrimPrefix(docker.URL, "http://")
+	p := &Proxy{pool: newTransportPool()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+	p.httpProxyHosts([]string{host}, httptest.NewRecorder(), httptest.NewRequest("GET", "/events", nil).WithContext(ctx))
+	if !breakerAllow(host) {
+		t.Fatal("expected client cancellation not to open the breaker")
+	}
+}
+
+func TestOpenBreakerSkipsHost(t *testing.T) {
+	setBreaker(t, 1, time.Minute)
+	var requests int32
+	dead, live := deadHost(t), liveHost(t, &requests)
+	p := &Proxy{pool: newTransportPool()}
+
+	// 第一次失败后熔断，重试时没有可用的后端
+	w := httptest.NewRecorder()
+	p.httpProxyHosts([]string{dead}, w, httptest.NewRequest("GET", "/images/busybox/json", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected unavailable once the breaker is open, got %d", w.Code)
+	}
+	if breakerAllow(dead) {
+		t.Fatal("expected breaker to stay open during the cooldown")
+	}
+	// 熔断的后端在冷却期内不再尝试
+	w = httptest.NewRecorder()
+	p.httpProxyHosts([]string{dead, live}, w, httptest.NewRequest("POST", "/images/create", strings.NewReader("{}")))
+	if w.Code != http.StatusOK || requests != 1 {
+		t.Fatalf("expected open breaker to be skipped even without retries, got %d", w.Code)
+	}
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/hugb/beegecluster/cluster"
+	"github.com/hugb/beegecluster/scheduler"
+)
+
+// 列出所有集群成员
+func (this *Proxy) getNodes(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	return writeJSON(w, http.StatusOK, cluster.Nodes())
+}
+
+func (this *Proxy) getNodesById(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	node, exist := cluster.LookupNode(vars["id"])
+	if !exist {
+		return fmt.Errorf("No such node: %s", vars["id"])
+	}
+	return writeJSON(w, http.StatusOK, node)
+}
+
+// 强制将节点移出集群
+func (this *Proxy) deleteNodes(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	if err := cluster.EvictNode(r.Context(), vars["id"]); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// 重新允许被移出的节点加入集群
+func (this *Proxy) postNodesReadmit(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	if err := cluster.ReadmitNode(r.Context(), vars["id"]); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// 停止向docker调度容器
+func (this *Proxy) postNodesCordon(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	if err := scheduler.Cordon(r.Context(), vars["id"]); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// 恢复向docker调度容器
+func (this *Proxy) postNodesUncordon(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	if err := scheduler.Uncordon(r.Context(), vars["id"]); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// 停止调度并按策略停止或迁移docker上的容器，policy为stop或reschedule，
+// reschedule只迁移带有beege.reschedule=true标签或总是重启的容器
+func (this *Proxy) postNodesDrain(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	if err := r.ParseForm(); err != nil {
+		return fmt.Errorf("Bad parameter: %s", err)
+	}
+	if err := scheduler.Drain(r.Context(), vars["id"], r.Form.Get("policy")); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, err = w.Write(b)
+	return err
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/utils"
+)
+
+// 到某个后端的连接池统计
+type PoolStats struct {
+	Host string
+	// 发出的请求数，其中复用空闲连接的次数
+	Requests int64
+	Reused   int64
+	// 新建连接的次数和失败次数
+	Dials      int64
+	DialErrors int64
+	// 当前打开的连接数
+	Open int64
+}
+
+type upstream struct {
+	transport *http.Transport
+	stats     PoolStats
+}
+
+// 每个后端一个连接池，保持长连接以复用
+type transportPool struct {
+	sync.Mutex
+	upstreams map[string]*upstream
+}
+
+func newTransportPool() *transportPool {
+	return &transportPool{upstreams: make(map[string]*upstream)}
+}
+
+func (this *transportPool) lookup(host string) *upstream {
+	this.Lock()
+	defer this.Unlock()
+
+	u, ok := this.upstreams[host]
+	if !ok {
+		u = &upstream{stats: PoolStats{Host: host}}
+		dialer := &net.Dialer{Timeout: config.Get().Proxy.DialTimeout.Duration(), KeepAlive: 30 * time.Second}
+		u.transport = &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				atomic.AddInt64(&u.stats.Dials, 1)
+				conn, err := dialer.DialContext(ctx, network, address)
+				if err != nil {
+					atomic.AddInt64(&u.stats.DialErrors, 1)
+					return nil, err
+				}
+				atomic.AddInt64(&u.stats.Open, 1)
+				return &pooledConn{Conn: conn, open: &u.stats.Open}, nil
+			},
+			TLSClientConfig:       utils.ClientTLSConfig(),
+			TLSHandshakeTimeout:   config.Get().Proxy.TLSHandshakeTimeout.Duration(),
+			ResponseHeaderTimeout: config.Get().Proxy.ResponseHeaderTimeout.Duration(),
+			MaxIdleConnsPerHost:   config.Get().Proxy.MaxIdleConnsPerHost,
+			MaxConnsPerHost:       config.Get().Proxy.MaxConnsPerHost,
+			IdleConnTimeout:       config.Get().Proxy.IdleConnTimeout.Duration(),
+		}
+		this.upstreams[host] = u
+	}
+	return u
+}
+
+// 发送请求到后端，统计连接复用情况
+func (this *transportPool) RoundTrip(host string, request *http.Request) (*http.Response, error) {
+	u := this.lookup(host)
+	atomic.AddInt64(&u.stats.Requests, 1)
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&u.stats.Reused, 1)
+			}
+		},
+	}
+	return u.transport.RoundTrip(request.WithContext(httptrace.WithClientTrace(request.Context(), trace)))
+}
+
+// 所有后端的连接池统计，按地址排序
+func (this *transportPool) Stats() []PoolStats {
+	this.Lock()
+	defer this.Unlock()
+
+	stats := make([]PoolStats, 0, len(this.upstreams))
+	for host, u := range this.upstreams {
+		stats = append(stats, PoolStats{
+			Host:       host,
+			Requests:   atomic.LoadInt64(&u.stats.Requests),
+			Reused:     atomic.LoadInt64(&u.stats.Reused),
+			Dials:      atomic.LoadInt64(&u.stats.Dials),
+			DialErrors: atomic.LoadInt64(&u.stats.DialErrors),
+			Open:       atomic.LoadInt64(&u.stats.Open),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Host < stats[j].Host })
+	return stats
+}
+
+// 关闭所有空闲连接
+func (this *transportPool) CloseIdleConnections() {
+	this.Lock()
+	defer this.Unlock()
+
+	for _, u := range this.upstreams {
+		u.transport.CloseIdleConnections()
+	}
+}
+
+// 连接关闭时减少打开的连接数
+type pooledConn struct {
+	net.Conn
+	open   *int64
+	closed int32
+}
+
+func (this *pooledConn) Close() error {
+	if atomic.CompareAndSwapInt32(&this.closed, 0, 1) {
+		atomic.AddInt64(this.open, -1)
+	}
+	return this.Conn.Close()
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPoolReusesConnections(t *testing.T) {
+	var requests int32
+	host := liveHost(t, &requests)
+	pool := newTransportPool()
+
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest("GET", "http://"+host+"/version", nil)
+		r.RequestURI = ""
+		response, err := pool.RoundTrip(host, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(response.Body)
+		response.Body.Close()
+	}
+	stats := pool.Stats()
+	if len(stats) != 1 || stats[0].Host != host {
+		t.Fatalf("expected one pool per host, got %+v", stats)
+	}
+	if stats[0].Requests != 3 || stats[0].Dials != 1 || stats[0].Reused != 2 || stats[0].Open != 1 {
+		t.Fatalf("expected keep-alive connection to be reused, got %+v", stats[0])
+	}
+
+	pool.CloseIdleConnections()
+	if stats = pool.Stats(); stats[0].Open != 0 {
+		t.Fatalf("expected idle connection to be closed, got %d open", stats[0].Open)
+	}
+}
+
+func TestPoolCountsDialErrors(t *testing.T) {
+	host := deadHost(t)
+	pool := newTransportPool()
+
+	r := httptest.NewRequest("GET", "http://"+host+"/version", nil)
+	r.RequestURI = ""
+	if _, err := pool.RoundTrip(host, r); err == nil {
+		t.Fatal("expected dial error")
+	}
+	if stats := pool.Stats(); stats[0].Dials != 1 || stats[0].DialErrors != 1 || stats[0].Open != 0 {
+		t.Fatalf("unexpected stats %+v", stats[0])
+	}
+}
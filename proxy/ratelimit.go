@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hugb/beegecluster/auth"
+	"github.com/hugb/beegecluster/config"
+)
+
+const (
+	// 空闲多久的客户端状态会被清除
+	limiterIdleTimeout = 10 * time.Minute
+)
+
+// 一个客户端在一类路由上的令牌桶和处理中的请求数
+type bucket struct {
+	tokens   float64
+	last     time.Time
+	inflight int
+}
+
+type rateLimiter struct {
+	sync.Mutex
+	buckets map[string]*bucket
+}
+
+var limiter = &rateLimiter{buckets: make(map[string]*bucket)}
+
+func init() {
+	go limiter.cleanup()
+}
+
+// 路由类别：长时间运行的请求单独限制，其余按是否修改集群区分
+func routeClass(r *http.Request) string {
+	if requestTimeout(r) <= 0 {
+		return config.RouteClassStream
+	}
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return config.RouteClassRead
+	}
+	return config.RouteClassWrite
+}
+
+// 客户端标识为来源ip，在认证之前即可确定
+func clientIdentity(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// 取得处理请求的许可，成功时返回释放函数，被限制时返回需等待的时间
+func (this *rateLimiter) Acquire(r *http.Request) (func(), time.Duration, error) {
+	// 持有集群密钥的controller转发的请求已经在转发方限制
+	if auth.VerifiedForward(r) {
+		return func() {}, 0, nil
+	}
+	class := routeClass(r)
+	limit := config.Get().Proxy.RateLimits[class]
+	if limit == nil {
+		return func() {}, 0, nil
+	}
+	key := class + " " + clientIdentity(r)
+
+	this.Lock()
+	defer this.Unlock()
+
+	now := time.Now()
+	burst := math.Max(1, float64(limit.Burst))
+	b, ok := this.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		this.buckets[key] = b
+	}
+	if limit.Rate > 0 {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	}
+	b.last = now
+	if limit.Rate > 0 {
+		if b.tokens < 1 {
+			wait := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+			return nil, wait, fmt.Errorf("Too many requests: %s requests of %s exceed %g per second", class, clientIdentity(r), limit.Rate)
+		}
+	}
+	if limit.Concurrent > 0 && b.inflight >= limit.Concurrent {
+		return nil, time.Second, fmt.Errorf("Too many requests: %s has %d concurrent %s requests", clientIdentity(r), b.inflight, class)
+	}
+	if limit.Rate > 0 {
+		b.tokens--
+	}
+	b.inflight++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			this.Lock()
+			b.inflight--
+			this.Unlock()
+		})
+	}, 0, nil
+}
+
+// 定期清除空闲客户端的状态
+func (this *rateLimiter) cleanup() {
+	for range time.Tick(time.Minute) {
+		this.Lock()
+		for key, b := range this.buckets {
+			if b.inflight == 0 && time.Since(b.last) > limiterIdleTimeout {
+				delete(this.buckets, key)
+			}
+		}
+		this.Unlock()
+	}
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hugb/beegecluster/auth"
+	"github.com/hugb/beegecluster/config"
+)
+
+func setRateLimit(t *testing.T, secret string, limit *config.RateLimit) {
+	previous := config.Get()
+	c := *previous
+	c.Auth.ClusterSecret = secret
+	c.Proxy.RateLimits = map[string]*config.RateLimit{config.RouteClassWrite: limit}
+	config.Set(&c)
+	t.Cleanup(func() { config.Set(previous) })
+}
+
+func newRequest(remote string) *http.Request {
+	r := httptest.NewRequest("POST", "/containers/create", nil)
+	r.RemoteAddr = remote
+	return r
+}
+
+func TestRateLimitByClientIP(t *testing.T) {
+	setRateLimit(t, "", &config.RateLimit{Rate: 1, Burst: 2})
+	l := &rateLimiter{buckets: make(map[string]*bucket)}
+
+	for i := 0; i < 2; i++ {
+		release, _, err := l.Acquire(newRequest("10.0.0.1:5000"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+	}
+	// 同一ip的其他端口共用限额，与认证结果无关
+	r := newRequest("10.0.0.1:5001")
+	r.Header.Set("Authorization", "Bearer anything")
+	if _, wait, err := l.Acquire(r); err == nil || wait <= 0 {
+		t.Fatal("expected third request from the same ip to be limited")
+	}
+	if _, _, err := l.Acquire(newRequest("10.0.0.2:5000")); err != nil {
+		t.Fatalf("expected another ip to have its own limit: %s", err)
+	}
+}
+
+func TestRateLimitConcurrent(t *testing.T) {
+	setRateLimit(t, "", &config.RateLimit{Concurrent: 1})
+	l := &rateLimiter{buckets: make(map[string]*bucket)}
+
+	release, _, err := l.Acquire(newRequest("10.0.0.1:5000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = l.Acquire(newRequest("10.0.0.1:5000")); err == nil {
+		t.Fatal("expected second concurrent request to be limited")
+	}
+	release()
+	release()
+	if _, _, err = l.Acquire(newRequest("10.0.0.1:5000")); err != nil {
+		t.Fatalf("expected request after release to pass: %s", err)
+	}
+}
+
+func TestOnlyVerifiedForwardsBypassLimit(t *testing.T) {
+	setRateLimit(t, "0123456789abcdef", &config.RateLimit{Rate: 1, Burst: 1})
+	l := &rateLimiter{buckets: make(map[string]*bucket)}
+
+	// 伪造的转发头不能绕过限制
+	for i := 0; i < 2; i++ {
+		r := newRequest("10.0.0.1:5000")
+		r.Header.Set(auth.ForwardedHeader, "10.0.0.5:4243")
+		_, _, err := l.Acquire(r)
+		if i == 1 && err == nil {
+			t.Fatal("expected unsigned forward to be limited")
+		}
+	}
+	for i := 0; i < 3; i++ {
+		r := newRequest("10.0.0.5:6000")
+		auth.SignForward(r, "10.0.0.5:4243", &auth.User{Name: "root"})
+		if _, _, err := l.Acquire(r); err != nil {
+			t.Fatalf("expected signed forward to bypass the limit: %s", err)
+		}
+	}
+}
@@ -1,14 +1,27 @@
 package proxy
 
 import (
+	"bytes"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+
+	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/trace"
+	"github.com/hugb/beegecluster/utils"
+)
+
+const (
+	// 转发会话双向都没有数据的最长时间
+	forwardIdleTimeout = 30 * time.Minute
+	// 检查会话是否空闲的间隔
+	forwardCheckInterval = 10 * time.Second
 )
 
 type requestHandler struct {
@@ -56,7 +69,7 @@ func (this *requestHandler) tcpRequest(address string) {
 }
 
 func (this *requestHandler) webSocketRequest(address string) {
-	this.request.URL.Scheme = "http"
+	this.request.URL.Scheme = utils.UpstreamScheme(address)
 	this.request.URL.Host = address
 
 	if host, _, err := net.SplitHostPort(this.request.RemoteAddr); err == nil {
@@ -69,7 +82,9 @@ func (this *requestHandler) webSocketRequest(address string) {
 			strconv.FormatInt(time.Now().UnixNano()/1e6, 10))
 	}
 
+	span := this.startUpstreamSpan("proxy.websocket", address)
 	err := this.serveWebSocket(address)
+	span.Finish(err)
 	if err != nil {
 		body := fmt.Sprintf("%d %s: %s", http.StatusBadRequest,
 			http.StatusText(http.StatusBadRequest),
@@ -78,6 +93,32 @@ func (this *requestHandler) webSocketRequest(address string) {
 	}
 }
 
+// docker的attach和exec start在响应后劫持连接，转发请求后双向传输数据
+func (this *requestHandler) streamRequest(address string) {
+	this.request.URL.Scheme = utils.UpstreamScheme(address)
+	this.request.URL.Host = address
+
+	if host, _, err := net.SplitHostPort(this.request.RemoteAddr); err == nil {
+		xForwardFor := append(this.request.Header["X-Forwarded-For"], host)
+		this.request.Header.Set("X-Forwarded-For", strings.Join(xForwardFor, ", "))
+	}
+
+	if _, ok := this.request.Header[http.CanonicalHeaderKey("X-Request-Start")]; !ok {
+		this.request.Header.Set("X-Request-Start",
+			strconv.FormatInt(time.Now().UnixNano()/1e6, 10))
+	}
+
+	span := this.startUpstreamSpan("proxy.stream", address)
+	err := this.serveStream(address)
+	span.Finish(err)
+	if err != nil {
+		body := fmt.Sprintf("%d %s: %s", http.StatusBadGateway,
+			http.StatusText(http.StatusBadGateway),
+			"Stream request to endpoint failed.")
+		http.Error(this.response, body, http.StatusBadGateway)
+	}
+}
+
 func (this *requestHandler) badGateway() {
 	this.response.Header().Set("X-Cf-RouterError", "endpoint_failure")
 	body := fmt.Sprintf("%d %s: %s", http.StatusBadGateway,
@@ -86,28 +127,32 @@ func (this *requestHandler) badGateway() {
 	http.Error(this.response, body, http.StatusBadGateway)
 }
 
-func (this *requestHandler) httpRequest(transport *http.Transport, address string) (*http.Response, error) {
-	this.request.URL.Scheme = "http"
+func (this *requestHandler) httpRequest(pool *transportPool, address string) (*http.Response, error) {
+	this.request.URL.Scheme = utils.UpstreamScheme(address)
 	this.request.URL.Host = address
 
 	if host, _, err := net.SplitHostPort(this.request.RemoteAddr); err == nil {
 		xForwardFor := append(this.request.Header["X-Forwarded-For"], host)
 		this.request.Header.Set("X-Forwarded-For", strings.Join(xForwardFor, ", "))
 	} else {
-		log.Println("set X-Forwarded-For error:", err)
+		logger.Warn("Set X-Forwarded-For error", "remote", this.request.RemoteAddr, "error", err)
 	}
 
 	if _, ok := this.request.Header[http.CanonicalHeaderKey("X-Request-Start")]; !ok {
 		this.request.Header.Set("X-Request-Start", strconv.FormatInt(time.Now().UnixNano()/1e6, 10))
 	}
 
-	this.request.Close = true
+	// 与docker的连接由连接池保持，不转发客户端的连接头
 	this.request.Header.Del("Connection")
 
-	response, err := transport.RoundTrip(this.request)
+	span := this.startUpstreamSpan("proxy.upstream", address)
+	response, err := pool.RoundTrip(address, this.request)
 	if err != nil {
+		span.Finish(err)
 		return response, err
 	}
+	span.SetAttribute("http.status_code", response.StatusCode)
+	span.Finish(nil)
 
 	for k, vv := range response.Header {
 		for _, v := range vv {
@@ -124,16 +169,19 @@ func (this *requestHandler) writeResponse(response *http.Response) int64 {
 		return 0
 	}
 
+	_, span := trace.Start(this.request.Context(), "proxy.copy")
 	var dst io.Writer = this.response
 	if v, ok := this.response.(writeFlusher); ok {
-		u := NewMaxLatencyWriter(v, 50*time.Millisecond)
+		u := NewMaxLatencyWriter(v, config.Get().Proxy.FlushInterval.Duration())
 		defer u.Stop()
 		dst = u
 	}
 	written, err := io.Copy(dst, response.Body)
 	if err != nil {
-		log.Println("copy response error:", err)
+		logger.Warn("Copy response error", "path", this.request.URL.Path, "error", err)
 	}
+	span.SetAttribute("bytes", written)
+	span.Finish(err)
 	return written
 }
 
@@ -147,8 +195,12 @@ func (this *requestHandler) serveTcp(address string) error {
 	if err != nil {
 		return err
 	}
+	sessions.Add(1)
+	defer sessions.Done()
+	// 劫持的连接由forwardIO的空闲超时管理，取消服务端设置的读写超时
+	client.SetDeadline(time.Time{})
 
-	connection, err := net.Dial("tcp", address)
+	connection, err := dialUpstream(address)
 	if err != nil {
 		return err
 	}
@@ -171,8 +223,12 @@ func (this *requestHandler) serveWebSocket(address string) error {
 	if err != nil {
 		return err
 	}
+	sessions.Add(1)
+	defer sessions.Done()
+	// 劫持的连接由forwardIO的空闲超时管理，取消服务端设置的读写超时
+	client.SetDeadline(time.Time{})
 
-	connection, err := net.Dial("tcp", address)
+	connection, err := dialUpstream(address)
 	if err != nil {
 		return err
 	}
@@ -189,18 +245,149 @@ func (this *requestHandler) serveWebSocket(address string) error {
 	return nil
 }
 
+// 到docker或leader的请求，下游据traceparent延续同一个trace
+func (this *requestHandler) startUpstreamSpan(name, address string) *trace.Span {
+	_, span := trace.Start(this.request.Context(), name)
+	span.Kind = trace.KindClient
+	span.SetAttribute("node", address)
+	span.SetAttribute("http.method", this.request.Method)
+	span.SetAttribute("http.target", this.request.URL.RequestURI())
+	this.request.Header.Set(trace.TraceparentHeader, span.Traceparent())
+	return span
+}
+
+// 返回错误时连接尚未劫持，仍可以回复http错误
+func (this *requestHandler) serveStream(address string) error {
+	hijacker, ok := this.response.(http.Hijacker)
+	if !ok {
+		panic("response writer cannot hijack")
+	}
+
+	// 劫持后不能再读取请求体，先读出
+	if this.request.Body != nil {
+		body, err := ioutil.ReadAll(this.request.Body)
+		if err != nil {
+			return err
+		}
+		this.request.Body.Close()
+		this.request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		this.request.ContentLength = int64(len(body))
+	}
+
+	connection, err := dialUpstream(address)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	if err = this.request.Write(connection); err != nil {
+		return err
+	}
+
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return err
+	}
+	sessions.Add(1)
+	defer sessions.Done()
+	// 劫持的连接由forwardIO的空闲超时管理，取消服务端设置的读写超时
+	client.SetDeadline(time.Time{})
+	defer client.Close()
+
+	// 客户端在请求之后已发送的数据留在缓冲区中，需先转发
+	if n := buffered.Reader.Buffered(); n > 0 {
+		data, _ := buffered.Reader.Peek(n)
+		if _, err = connection.Write(data); err != nil {
+			logger.Warn("Forward buffered data error", "node", address, "error", err)
+			return nil
+		}
+	}
+
+	forwardIO(client, connection)
+
+	return nil
+}
+
+// 支持关闭写方向的连接，如*net.TCPConn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// 在a和b之间双向传输数据，一个方向结束后关闭对端的写方向，等待另一方向结束
 func forwardIO(a, b net.Conn) {
-	done := make(chan bool, 2)
+	var (
+		started = time.Now()
+		active  = started.UnixNano()
+		// a发往b和b发往a的字节数
+		sent, received int64
+	)
+	done := make(chan error, 2)
+
+	copy := func(dst, src net.Conn, counter *int64) {
+		var err error
+		buffer := make([]byte, 32*1024)
+		for {
+			n, readErr := src.Read(buffer)
+			if n > 0 {
+				atomic.StoreInt64(&active, time.Now().UnixNano())
+				if _, err = dst.Write(buffer[:n]); err != nil {
+					break
+				}
+				atomic.AddInt64(counter, int64(n))
+			}
+			if readErr != nil {
+				if readErr != io.EOF {
+					err = readErr
+				}
+				break
+			}
+		}
+		if err == nil {
+			// 源端已结束发送，通知对端不会再有数据
+			if closer, ok := dst.(closeWriter); ok {
+				err = closer.CloseWrite()
+			} else {
+				err = fmt.Errorf("half-close is not supported")
+			}
+		}
+		done <- err
+	}
 
-	copy := func(dst io.Writer, src io.Reader) {
-		if _, err := io.Copy(dst, src); nil != err {
-			log.Println(err)
+	go copy(b, a, &sent)
+	go copy(a, b, &received)
+
+	var (
+		reason  string
+		aborted bool
+	)
+	abort := func(why string) {
+		if !aborted {
+			aborted, reason = true, why
+			a.Close()
+			b.Close()
 		}
-		done <- true
 	}
 
-	go copy(a, b)
-	go copy(b, a)
+	ticker := time.NewTicker(forwardCheckInterval)
+	defer ticker.Stop()
+
+	for finished := 0; finished < 2; {
+		select {
+		case err := <-done:
+			finished++
+			if err != nil {
+				abort(err.Error())
+			}
+		case <-ticker.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&active))) > forwardIdleTimeout {
+				abort("idle timeout")
+			}
+		}
+	}
 
-	<-done
+	if reason == "" {
+		reason = "closed"
+	}
+	logger.Info("Session finished", "client", a.RemoteAddr(), "node", b.RemoteAddr(),
+		"duration", time.Since(started), "sent", sent, "received", received, "reason", reason)
 }
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// 一对相连的tcp连接
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := <-accepted
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	peer.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, peer
+}
+
+func TestForwardIOPropagatesHalfClose(t *testing.T) {
+	client, clientSide := tcpPair(t)
+	upstreamSide, upstream := tcpPair(t)
+
+	done := make(chan bool)
+	go func() {
+		forwardIO(clientSide, upstreamSide)
+		close(done)
+	}()
+
+	// 客户端发送完毕后关闭写方向，如docker attach的stdin结束
+	client.Write([]byte("stdin data"))
+	client.(*net.TCPConn).CloseWrite()
+	input, err := ioutil.ReadAll(upstream)
+	if err != nil || string(input) != "stdin data" {
+		t.Fatalf("expected upstream to see the end of input, got %q %v", input, err)
+	}
+
+	// 另一方向仍可继续传输
+	upstream.Write([]byte("remaining output"))
+	upstream.(*net.TCPConn).CloseWrite()
+	output, err := ioutil.ReadAll(client)
+	if err != nil || string(output) != "remaining output" {
+		t.Fatalf("expected output after half-close, got %q %v", output, err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected forwarding to finish after both directions closed")
+	}
+}
+
+func TestForwardIOAbortsWithoutHalfClose(t *testing.T) {
+	client, clientSide := tcpPair(t)
+	// net.Pipe不支持关闭写方向，一方结束后两端都关闭
+	upstreamSide, upstream := net.Pipe()
+	defer upstream.Close()
+
+	done := make(chan bool)
+	go func() {
+		forwardIO(clientSide, upstreamSide)
+		close(done)
+	}()
+	go ioutil.ReadAll(upstream)
+
+	client.(*net.TCPConn).CloseWrite()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected forwarding to be aborted")
+	}
+	if _, err := ioutil.ReadAll(client); err != nil {
+		t.Fatalf("expected client connection to be closed, got %v", err)
+	}
+}
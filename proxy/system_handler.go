@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+
+	"github.com/hugb/beegecluster/cluster"
+	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/resource"
+	"github.com/hugb/beegecluster/utils"
+)
+
+func (this *Proxy) getInfo(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	return writeJSON(w, http.StatusOK, clusterInfo(cluster.Nodes()))
+}
+
+// 整个集群的信息，容器、镜像、cpu和内存为所有docker之和
+func clusterInfo(nodes resource.NodeArray) map[string]interface{} {
+	var (
+		containers, images, ncpu, dockers int
+		memTotal                          uint64
+		status                            [][2]string
+	)
+	for _, node := range nodes {
+		if node.Role != config.DockerRoleName {
+			continue
+		}
+		dockers++
+		containers += node.Containers
+		images += node.Images
+		if node.State == cluster.NodeOnline && node.SystemInfo != nil {
+			ncpu += node.SystemInfo.NCPU
+			if node.SystemInfo.Mem != nil {
+				memTotal += node.SystemInfo.Mem.Total
+			}
+		}
+		state := node.State
+		if node.Schedule != "" {
+			state += ", " + node.Schedule
+		}
+		status = append(status,
+			[2]string{node.Address, state},
+			[2]string{"  Containers", fmt.Sprint(node.Containers)},
+			[2]string{"  Images", fmt.Sprint(node.Images)})
+	}
+	status = append([][2]string{{"Nodes", fmt.Sprint(dockers)}}, status...)
+
+	return map[string]interface{}{
+		"ID":                 config.Get().ClusterAddress,
+		"Name":               config.Get().ClusterAddress,
+		"Containers":         containers,
+		"Images":             images,
+		"NCPU":               ncpu,
+		"MemTotal":           memTotal,
+		"Driver":             "beegecluster",
+		"DriverStatus":       status,
+		"ExecutionDriver":    "beegecluster-" + config.Version,
+		"OperatingSystem":    "beegecluster",
+		"NGoroutines":        runtime.NumGoroutine(),
+		"IndexServerAddress": "https://index.docker.io/v1/",
+	}
+}
+
+func (this *Proxy) getVersion(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	return writeJSON(w, http.StatusOK, clusterVersion(cluster.Nodes()))
+}
+
+// 控制器版本以及所有在线docker都支持的api版本范围，
+// 没有共同支持的版本时报告最低的docker版本范围并给出警告
+func clusterVersion(nodes resource.NodeArray) *resource.Version {
+	version := &resource.Version{
+		Version:   config.Version,
+		GoVersion: runtime.Version(),
+		Os:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+	}
+	var lowest *resource.Version
+	for _, node := range nodes {
+		if node.Role != config.DockerRoleName || node.State != cluster.NodeOnline || node.Version == nil {
+			continue
+		}
+		if version.ApiVersion == "" || utils.CompareVersions(node.Version.ApiVersion, version.ApiVersion) < 0 {
+			version.ApiVersion = node.Version.ApiVersion
+			lowest = node.Version
+		}
+		if version.MinAPIVersion == "" || utils.CompareVersions(node.Version.MinAPIVersion, version.MinAPIVersion) > 0 {
+			version.MinAPIVersion = node.Version.MinAPIVersion
+		}
+	}
+	if lowest != nil && utils.CompareVersions(version.MinAPIVersion, version.ApiVersion) > 0 {
+		version.Warnings = append(version.Warnings, fmt.Sprintf("WARNING: online dockers have no common API version, requiring at least %s but some support at most %s",
+			version.MinAPIVersion, version.ApiVersion))
+		version.MinAPIVersion, version.ApiVersion = lowest.MinAPIVersion, lowest.ApiVersion
+	}
+	return version
+}
+
+// 到各docker的连接池统计
+func (this *Proxy) getProxyPool(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	return writeJSON(w, http.StatusOK, this.pool.Stats())
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hugb/beegecluster/cluster"
+	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/resource"
+	"github.com/hugb/beegecluster/utils"
+)
+
+func testNodes() resource.NodeArray {
+	return resource.NodeArray{
+		{Id: "c1:4244", Role: config.ControllerRoleName, Address: "c1:4244", State: cluster.NodeOnline},
+		{Id: "h1:4243", Role: config.DockerRoleName, Address: "h1:4243", State: cluster.NodeOnline, Containers: 2, Images: 3,
+			SystemInfo: &utils.SystemInfo{NCPU: 4, Mem: &utils.Mem{Total: 1024}},
+			Version:    &resource.Version{ApiVersion: "1.26", MinAPIVersion: "1.12"}},
+		{Id: "h2:4243", Role: config.DockerRoleName, Address: "h2:4243", State: cluster.NodeOnline, Schedule: config.DockerCordoned, Containers: 1, Images: 1,
+			SystemInfo: &utils.SystemInfo{NCPU: 2, Mem: &utils.Mem{Total: 512}},
+			Version:    &resource.Version{ApiVersion: "1.24", MinAPIVersion: "1.17"}},
+		// 离线的docker计入容器和镜像，不计入资源和版本
+		{Id: "h3:4243", Role: config.DockerRoleName, Address: "h3:4243", State: cluster.NodeOffline, Containers: 5,
+			SystemInfo: &utils.SystemInfo{NCPU: 8, Mem: &utils.Mem{Total: 4096}},
+			Version:    &resource.Version{ApiVersion: "1.10", MinAPIVersion: "1.0"}},
+	}
+}
+
+func TestClusterInfoSumsDockers(t *testing.T) {
+	info := clusterInfo(testNodes())
+	if info["Containers"] != 8 || info["Images"] != 4 || info["NCPU"] != 6 || info["MemTotal"] != uint64(1536) {
+		t.Fatalf("unexpected info %v", info)
+	}
+	status := info["DriverStatus"].([][2]string)
+	if status[0] != [2]string{"Nodes", "3"} {
+		t.Fatalf("expected docker count first, got %v", status[0])
+	}
+	if status[4] != [2]string{"h2:4243", "online, cordoned"} {
+		t.Fatalf("expected schedule state in node status, got %v", status[4])
+	}
+}
+
+func TestClusterVersionIsCommonRange(t *testing.T) {
+	version := clusterVersion(testNodes())
+	if version.ApiVersion != "1.24" || version.MinAPIVersion != "1.17" {
+		t.Fatalf("expected range supported by all online dockers, got %s-%s", version.MinAPIVersion, version.ApiVersion)
+	}
+	if version := clusterVersion(nil); version.ApiVersion != "" || version.Os == "" {
+		t.Fatalf("unexpected version without dockers %+v", version)
+	}
+	if len(version.Warnings) != 0 {
+		t.Fatalf("unexpected warnings %v", version.Warnings)
+	}
+}
+
+func TestClusterVersionWithoutCommonRange(t *testing.T) {
+	nodes := append(testNodes(), &resource.Node{Id: "h4:4243", Role: config.DockerRoleName, Address: "h4:4243", State: cluster.NodeOnline,
+		Version: &resource.Version{ApiVersion: "1.41", MinAPIVersion: "1.25"}})
+
+	// 范围不相交时报告最低的docker版本范围
+	version := clusterVersion(nodes)
+	if version.ApiVersion != "1.24" || version.MinAPIVersion != "1.17" {
+		t.Fatalf("expected lowest docker range, got %s-%s", version.MinAPIVersion, version.ApiVersion)
+	}
+	if len(version.Warnings) != 1 || !strings.Contains(version.Warnings[0], "no common API version") {
+		t.Fatalf("expected a warning, got %v", version.Warnings)
+	}
+}
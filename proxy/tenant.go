@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/hugb/beegecluster/auth"
+	"github.com/hugb/beegecluster/registry"
+	"github.com/hugb/beegecluster/resource"
+)
+
+var (
+	// 检查配额和预留需串行，避免并发创建超出配额
+	quotaLock sync.Mutex
+	// 预留的序号，创建中的容器以此在注册表中占用配额
+	reservations uint64
+)
+
+// 请求用户所属的租户，为空时不限制
+func requestTenant(r *http.Request) string {
+	if user := auth.UserFromRequest(r); user != nil {
+		return user.Tenant
+	}
+	return ""
+}
+
+// 容器是否属于请求的租户，不属于时按不存在处理
+func checkContainerTenant(r *http.Request, id string) error {
+	tenant := requestTenant(r)
+	if tenant == "" {
+		return nil
+	}
+	if container, ok := registry.RegistryServer.LookupContainer(id); ok && container.Tenant == tenant {
+		return nil
+	}
+	return fmt.Errorf("No such container: %s", id)
+}
+
+// 镜像的租户由仓库名的命名空间决定，如tenant/name，不属于任何租户的镜像共享
+func imageTenant(image *resource.Image) string {
+	for _, tag := range image.RepoTags {
+		if i := strings.Index(tag, "/"); i > 0 {
+			if namespace := tag[:i]; auth.AuthServer.Quota(namespace) != nil {
+				return namespace
+			}
+		}
+	}
+	return ""
+}
+
+func imageVisible(tenant string, image *resource.Image) bool {
+	if tenant == "" {
+		return true
+	}
+	owner := imageTenant(image)
+	return owner == "" || owner == tenant
+}
+
+// 检查配额并为创建中的容器预留，创建结束后由调用者释放；
+// 预留之后不再持有锁，各docker上的创建可以同时进行
+func reserveQuota(tenant string, memory int64) (string, error) {
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+
+	if err := checkQuota(tenant, memory); err != nil {
+		return "", err
+	}
+	reservations++
+	reservation := fmt.Sprintf("reservation-%d", reservations)
+	registry.RegistryServer.SetContainerOwner(reservation, "", tenant, memory)
+	return reservation, nil
+}
+
+// 创建容器前检查租户的配额，调用时需持有quotaLock
+func checkQuota(tenant string, memory int64) error {
+	quota := auth.AuthServer.Quota(tenant)
+	if quota == nil {
+		return nil
+	}
+	count, used := registry.RegistryServer.TenantUsage(tenant)
+	if quota.Containers > 0 && count >= quota.Containers {
+		return fmt.Errorf("Forbidden: tenant %s reached its quota of %d containers", tenant, quota.Containers)
+	}
+	if quota.Memory > 0 {
+		if memory <= 0 {
+			return fmt.Errorf("Bad parameter: tenant %s has a memory quota, memory limit is required", tenant)
+		}
+		if used+memory > quota.Memory {
+			return fmt.Errorf("Forbidden: tenant %s would use %d of %d bytes memory quota", tenant, used+memory, quota.Memory)
+		}
+	}
+	return nil
+}
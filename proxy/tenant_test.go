@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hugb/beegecluster/auth"
+	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/registry"
+	"github.com/hugb/beegecluster/resource"
+)
+
+func setTenants(t *testing.T) {
+	auth.AuthServer.SetPolicy(&auth.Policy{Tenants: map[string]*auth.Quota{
+		"acme":  {Containers: 1, Memory: 100},
+		"other": {},
+	}})
+	t.Cleanup(func() { auth.AuthServer.SetPolicy(nil) })
+}
+
+func tenantRequest(method, target, tenant, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	return auth.WithUser(r, &auth.User{Name: tenant + "-user", Tenant: tenant})
+}
+
+func TestImagesVisibleByNamespace(t *testing.T) {
+	setTenants(t)
+	shared := &resource.Image{RepoTags: []string{"busybox:latest"}}
+	own := &resource.Image{RepoTags: []string{"acme/app:1"}}
+	foreign := &resource.Image{RepoTags: []string{"other/app:1"}}
+	// 不是租户的命名空间视为共享
+	library := &resource.Image{RepoTags: []string{"library/app:1"}}
+
+	for _, image := range []*resource.Image{shared, own, library} {
+		if !imageVisible("acme", image) {
+			t.Fatalf("expected %v to be visible to acme", image.RepoTags)
+		}
+	}
+	if imageVisible("acme", foreign) {
+		t.Fatal("expected image of another tenant to be hidden")
+	}
+	if !imageVisible("", foreign) {
+		t.Fatal("expected requests without tenant to see every image")
+	}
+}
+
+func TestContainerTenantIsolation(t *testing.T) {
+	setTenants(t)
+	id := strings.Repeat("d", 64)
+	registry.RegistryServer.RegisterContainer(id, &resource.Container{Host: "h1:4243", Tenant: "acme"})
+	defer registry.RegistryServer.UnregisterContainer(id)
+
+	if err := checkContainerTenant(tenantRequest("GET", "/", "acme", ""), id[:12]); err != nil {
+		t.Fatalf("expected owner to access the container: %s", err)
+	}
+	if err := checkContainerTenant(tenantRequest("GET", "/", "other", ""), id); err == nil || !strings.HasPrefix(err.Error(), "No such container") {
+		t.Fatalf("expected container of another tenant to be hidden, got %v", err)
+	}
+	if err := checkContainerTenant(httptest.NewRequest("GET", "/", nil), id); err != nil {
+		t.Fatalf("expected request without tenant to access the container: %s", err)
+	}
+
+	p := &Proxy{pool: newTransportPool()}
+	w := httptest.NewRecorder()
+	p.getContainersJSON(w, tenantRequest("GET", "/containers/json", "other", ""), nil)
+	var containers []*resource.Container
+	json.Unmarshal(w.Body.Bytes(), &containers)
+	for _, container := range containers {
+		if container.Id == id {
+			t.Fatal("expected container list to be filtered by tenant")
+		}
+	}
+}
+
+func TestCreateContainerEnforcesQuota(t *testing.T) {
+	setTenants(t)
+	id := strings.Repeat("f", 64)
+	labels := make(chan map[string]string, 1)
+	docker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var container struct{ Labels map[string]string }
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &container)
+		labels <- container.Labels
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"Id":"%s"}`, id)
+	}))
+	defer docker.Close()
+	host := strings.TrimPrefix(docker.URL, "http://")
+	config.NodesLock.Lock()
+	config.Dockers[host] = 1
+	config.NodesLock.Unlock()
+	defer func() {
+		config.NodesLock.Lock()
+		delete(config.Dockers, host)
+		config.NodesLock.Unlock()
+		registry.RegistryServer.UnregisterContainersByHost(host)
+	}()
+	p := &Proxy{pool: newTransportPool()}
+
+	// 有内存配额时必须指定内存限制
+	err := p.postContainersCreate(httptest.NewRecorder(), tenantRequest("POST", "/containers/create?host="+host, "acme", `{"Image":"busybox"}`), nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "Bad parameter") {
+		t.Fatalf("expected memory limit to be required, got %v", err)
+	}
+	err = p.postContainersCreate(httptest.NewRecorder(), tenantRequest("POST", "/containers/create?host="+host, "acme", `{"Image":"busybox","HostConfig":{"Memory":200}}`), nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "Forbidden") {
+		t.Fatalf("expected memory quota to be enforced, got %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	if err = p.postContainersCreate(w, tenantRequest("POST", "/containers/create?host="+host, "acme", `{"Image":"busybox","Memory":50}`), nil); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusCreated || (<-labels)[config.TenantLabel] != "acme" {
+		t.Fatalf("expected container to be created with the tenant label, got %d", w.Code)
+	}
+	if count, memory := registry.RegistryServer.TenantUsage("acme"); count != 1 || memory != 50 {
+		t.Fatalf("expected created container to count against the quota, got %d %d", count, memory)
+	}
+	err = p.postContainersCreate(httptest.NewRecorder(), tenantRequest("POST", "/containers/create?host="+host, "acme", `{"Image":"busybox","Memory":10}`), nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "Forbidden") {
+		t.Fatalf("expected container quota to be enforced, got %v", err)
+	}
+}
+
+func TestCreateContainerReservesQuota(t *testing.T) {
+	setTenants(t)
+	started, release := make(chan bool), make(chan bool)
+	docker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+		http.Error(w, "no space left", http.StatusInternalServerError)
+	}))
+	defer docker.Close()
+	host := strings.TrimPrefix(docker.URL, "http://")
+	config.NodesLock.Lock()
+	config.Dockers[host] = 1
+	config.NodesLock.Unlock()
+	defer func() {
+		config.NodesLock.Lock()
+		delete(config.Dockers, host)
+		config.NodesLock.Unlock()
+	}()
+	p := &Proxy{pool: newTransportPool()}
+
+	done := make(chan error)
+	go func() {
+		done <- p.postContainersCreate(httptest.NewRecorder(), tenantRequest("POST", "/containers/create?host="+host, "acme", `{"Image":"busybox","Memory":50}`), nil)
+	}()
+	<-started
+	// 创建中的容器占用配额，检查不等待docker返回
+	err := p.postContainersCreate(httptest.NewRecorder(), tenantRequest("POST", "/containers/create?host="+host, "acme", `{"Image":"busybox","Memory":10}`), nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "Forbidden") {
+		t.Fatalf("expected pending create to count against the quota, got %v", err)
+	}
+	close(release)
+	<-done
+	if count, memory := registry.RegistryServer.TenantUsage("acme"); count != 0 || memory != 0 {
+		t.Fatalf("expected failed create to release the quota, got %d %d", count, memory)
+	}
+}
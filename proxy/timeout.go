@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/hugb/beegecluster/config"
+)
+
+// 路由的超时策略，timeout为0时不限制时间
+type timeoutPolicy struct {
+	method  string
+	pattern *regexp.Regexp
+	timeout func() time.Duration
+}
+
+func unlimited() time.Duration {
+	return 0
+}
+
+func inspectTimeout() time.Duration {
+	return config.Get().Proxy.InspectTimeout.Duration()
+}
+
+// 长时间运行或持续输出的api不限制时间，查询类api使用较短的时间
+var timeoutPolicies = []timeoutPolicy{
+	{"POST", regexp.MustCompile(`^/containers/[^/]+/(wait|attach)$`), unlimited},
+	{"GET", regexp.MustCompile(`^/containers/[^/]+/(attach/ws|logs|stats)$`), unlimited},
+	{"POST", regexp.MustCompile(`^/exec/[^/]+/start$`), unlimited},
+	{"POST", regexp.MustCompile(`^/images/(create|load)$`), unlimited},
+	{"POST", regexp.MustCompile(`^/images/.+/push$`), unlimited},
+	{"GET", regexp.MustCompile(`^/images/.+/get$`), unlimited},
+	{"POST", regexp.MustCompile(`^/(commit|build)$`), unlimited},
+	{"GET", regexp.MustCompile(`^/events$`), unlimited},
+	{"GET", regexp.MustCompile(`^/containers/[^/]+/(json|top)$`), inspectTimeout},
+	{"GET", regexp.MustCompile(`^/images/.+/json$`), inspectTimeout},
+}
+
+// 得到请求的超时时间，不匹配任何策略时使用默认值
+func requestTimeout(r *http.Request) time.Duration {
+	path := r.URL.Path
+	if match := versionPrefix.FindStringSubmatch(path); match != nil {
+		path = path[len(match[0])-1:]
+	}
+	for _, policy := range timeoutPolicies {
+		if policy.method == r.Method && policy.pattern.MatchString(path) {
+			return policy.timeout()
+		}
+	}
+	return config.Get().Proxy.Timeout.Duration()
+}
+
+// 按超时策略设置请求的context，客户端断开或超时都会取消到docker的请求；
+// 不限制时间的请求同时取消服务端的读写超时
+func withRequestTimeout(w http.ResponseWriter, r *http.Request) (*http.Request, context.CancelFunc) {
+	timeout := requestTimeout(r)
+	if timeout <= 0 {
+		controller := http.NewResponseController(w)
+		if err := controller.SetReadDeadline(time.Time{}); err != nil {
+			logger.Warn("Clear read deadline error", "path", r.URL.Path, "error", err)
+		}
+		if err := controller.SetWriteDeadline(time.Time{}); err != nil {
+			logger.Warn("Clear write deadline error", "path", r.URL.Path, "error", err)
+		}
+		ctx, cancel := context.WithCancel(r.Context())
+		return r.WithContext(ctx), cancel
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return r.WithContext(ctx), cancel
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hugb/beegecluster/config"
+)
+
+func setTimeouts(t *testing.T, timeout, inspect time.Duration) {
+	previous := config.Get()
+	c := *previous
+	c.Proxy.Timeout = config.Duration(timeout)
+	c.Proxy.InspectTimeout = config.Duration(inspect)
+	config.Set(&c)
+	t.Cleanup(func() { config.Set(previous) })
+}
+
+func TestRequestTimeoutByRoute(t *testing.T) {
+	setTimeouts(t, time.Minute, 5*time.Second)
+
+	for request, expected := range map[string]time.Duration{
+		"GET /containers/json":                time.Minute,
+		"POST /containers/create":             time.Minute,
+		"GET /containers/abc/json":            5 * time.Second,
+		"GET /v1.24/images/busybox:1/json":    5 * time.Second,
+		"GET /containers/abc/logs":            0,
+		"POST /v1.24/containers/abc/wait":     0,
+		"POST /exec/abc/start":                0,
+		"POST /images/create":                 0,
+		"POST /images/registry/app/push":      0,
+		"GET /events":                         0,
+		"POST /containers/abc/json":           time.Minute,
+		"GET /v1.24/containers/abc/attach/ws": 0,
+	} {
+		parts := strings.SplitN(request, " ", 2)
+		if timeout := requestTimeout(httptest.NewRequest(parts[0], parts[1], nil)); timeout != expected {
+			t.Fatalf("expected %s to time out after %s, got %s", request, expected, timeout)
+		}
+	}
+}
+
+func TestRequestTimeoutCancelsUpstream(t *testing.T) {
+	setTimeouts(t, 50*time.Millisecond, 50*time.Millisecond)
+	canceled := make(chan bool, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 读完请求体后服务端才能发现连接断开
+		ioutil.ReadAll(r.Body)
+		select {
+		case <-r.Context().Done():
+			canceled <- true
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer upstream.Close()
+	host := strings.TrimPrefix(upstream.URL, "http://")
+	p := &Proxy{pool: newTransportPool()}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, cancel := withRequestTimeout(w, r)
+		defer cancel()
+		p.httpProxyHosts([]string{host}, w, r)
+	}))
+	defer server.Close()
+
+	started := time.Now()
+	response, err := http.Post(server.URL+"/containers/create", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadGateway || time.Since(started) > 2*time.Second {
+		t.Fatalf("expected request to time out, got %d after %s", response.StatusCode, time.Since(started))
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("expected request to docker to be canceled")
+	}
+}
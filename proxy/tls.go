@@ -0,0 +1,18 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/utils"
+)
+
+// 为劫持的连接建立到后端的专用连接
+func dialUpstream(host string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: config.Get().Proxy.DialTimeout.Duration()}
+	if utils.UpstreamTLS(host) {
+		return tls.DialWithDialer(dialer, "tcp", host, utils.ClientTLSConfig())
+	}
+	return dialer.Dial("tcp", host)
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/hugb/beegecluster/registry"
+	"github.com/hugb/beegecluster/trace"
+)
+
+// 为请求分配请求id并开始追踪，客户端指定的X-Request-Id和traceparent会被沿用
+func startRequestSpan(w http.ResponseWriter, r *http.Request, route string) (*http.Request, *trace.Span) {
+	requestId := trace.NormalizeRequestId(r.Header.Get(trace.RequestIdHeader))
+	ctx := trace.WithRequestId(r.Context(), requestId)
+	ctx, span := trace.StartRemote(ctx, r.Method+" "+route, r.Header.Get(trace.TraceparentHeader))
+	span.SetAttribute("http.method", r.Method)
+	span.SetAttribute("http.route", route)
+	span.SetAttribute("http.target", r.URL.RequestURI())
+	span.SetAttribute("client.address", r.RemoteAddr)
+
+	// 转发到docker或leader的请求都带有请求id
+	r.Header.Set(trace.RequestIdHeader, requestId)
+	w.Header().Set(trace.RequestIdHeader, requestId)
+	return r.WithContext(ctx), span
+}
+
+// 请求结束，5xx视为失败
+func finishRequestSpan(span *trace.Span, status int) {
+	// 没有写响应时由http服务器返回200
+	if status == 0 {
+		status = http.StatusOK
+	}
+	span.SetAttribute("http.status_code", status)
+	var err error
+	if status >= http.StatusInternalServerError {
+		err = fmt.Errorf("%s", http.StatusText(status))
+	}
+	span.Finish(err)
+}
+
+// 请求的日志，带有请求id
+func requestLogger(r *http.Request) *slog.Logger {
+	return logger.With("request_id", trace.RequestId(r.Context()))
+}
+
+// 查找容器所在的docker
+func lookupContainerHost(r *http.Request, id string) string {
+	_, span := trace.Start(r.Context(), "route.lookup")
+	host := registry.RegistryServer.GetHostByContainerId(id)
+	span.SetAttribute("container", id)
+	span.SetAttribute("node", host)
+	span.Finish(nil)
+	return host
+}
+
+// 查找存有镜像的docker
+func lookupImageHosts(r *http.Request, id string) []string {
+	_, span := trace.Start(r.Context(), "route.lookup")
+	hosts := registry.RegistryServer.GetHostsByImageId(id)
+	span.SetAttribute("image", id)
+	span.SetAttribute("nodes", len(hosts))
+	span.Finish(nil)
+	return hosts
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hugb/beegecluster/trace"
+)
+
+func TestStartRequestSpanKeepsClientIds(t *testing.T) {
+	traceId, spanId := strings.Repeat("ab", 16), strings.Repeat("cd", 8)
+	r := httptest.NewRequest("GET", "/containers/json?all=1", nil)
+	r.Header.Set(trace.RequestIdHeader, "req-1")
+	r.Header.Set(trace.TraceparentHeader, "00-"+traceId+"-"+spanId+"-01")
+	w := httptest.NewRecorder()
+
+	r, span := startRequestSpan(w, r, "/containers/json")
+	if w.Header().Get(trace.RequestIdHeader) != "req-1" || r.Header.Get(trace.RequestIdHeader) != "req-1" {
+		t.Fatal("expected request id to be returned and forwarded")
+	}
+	if trace.RequestId(r.Context()) != "req-1" || trace.FromContext(r.Context()) != span {
+		t.Fatal("expected request id and span in the request context")
+	}
+	if span.TraceId != traceId || span.ParentId != spanId || span.Name != "GET /containers/json" {
+		t.Fatalf("expected client trace to be continued, got %+v", span)
+	}
+	if span.Attributes["http.target"] != "/containers/json?all=1" {
+		t.Fatalf("unexpected attributes %v", span.Attributes)
+	}
+}
+
+func TestStartRequestSpanReplacesInvalidRequestId(t *testing.T) {
+	r := httptest.NewRequest("GET", "/info", nil)
+	r.Header.Set(trace.RequestIdHeader, strings.Repeat("x", 200))
+	w := httptest.NewRecorder()
+
+	r, _ = startRequestSpan(w, r, "/info")
+	requestId := w.Header().Get(trace.RequestIdHeader)
+	if requestId == "" || len(requestId) > 128 || r.Header.Get(trace.RequestIdHeader) != requestId {
+		t.Fatalf("expected a new request id, got %q", requestId)
+	}
+}
+
+func TestFinishRequestSpanMarksServerErrors(t *testing.T) {
+	for status, failed := range map[int]bool{0: false, http.StatusNotFound: false, http.StatusBadGateway: true} {
+		_, span := startRequestSpan(httptest.NewRecorder(), httptest.NewRequest("GET", "/info", nil), "/info")
+		finishRequestSpan(span, status)
+		if (span.Error != "") != failed {
+			t.Fatalf("status %d: unexpected error %q", status, span.Error)
+		}
+		if status == 0 && span.Attributes["http.status_code"] != http.StatusOK {
+			t.Fatal("expected missing status to be recorded as 200")
+		}
+	}
+}
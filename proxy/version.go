@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/hugb/beegecluster/cluster"
+	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/resource"
+	"github.com/hugb/beegecluster/utils"
+)
+
+var versionPrefix = regexp.MustCompile(`^/v([0-9.]+)/`)
+
+func checkVersion(version string) error {
+	if version == "" {
+		return nil
+	}
+	return checkNodesVersion(cluster.DockerVersions(), version)
+}
+
+// 检查是否有在线的docker支持请求的api版本，没有docker报告版本时不做限制
+func checkNodesVersion(versions []*resource.Version, version string) error {
+	var min, max string
+	for _, node := range versions {
+		if supportsVersion(node.MinAPIVersion, node.ApiVersion, version) {
+			return nil
+		}
+		// 允许降级时，高于docker的版本也可以处理
+		if config.Get().DowngradeAPIVersion && utils.CompareVersions(version, node.ApiVersion) > 0 {
+			return nil
+		}
+		if min == "" || utils.CompareVersions(node.MinAPIVersion, min) < 0 {
+			min = node.MinAPIVersion
+		}
+		if max == "" || utils.CompareVersions(node.ApiVersion, max) > 0 {
+			max = node.ApiVersion
+		}
+	}
+	if len(versions) == 0 {
+		return nil
+	}
+	return fmt.Errorf("Bad parameter: client API version %s is not supported, nodes support %s to %s", version, min, max)
+}
+
+func supportsVersion(min, max, version string) bool {
+	return utils.CompareVersions(version, min) >= 0 && utils.CompareVersions(version, max) <= 0
+}
+
+func negotiateVersion(host string, r *http.Request) error {
+	return negotiateNodeVersion(host, cluster.NodeVersion(host), r)
+}
+
+// 代理到docker前检查其是否支持请求的版本，允许降级时将路径改写为docker支持的最高版本，
+// docker未报告版本时不做检查
+func negotiateNodeVersion(host string, version *resource.Version, r *http.Request) error {
+	match := versionPrefix.FindStringSubmatch(r.URL.Path)
+	if match == nil || version == nil {
+		return nil
+	}
+	if supportsVersion(version.MinAPIVersion, version.ApiVersion, match[1]) {
+		return nil
+	}
+	if !config.Get().DowngradeAPIVersion || utils.CompareVersions(match[1], version.ApiVersion) < 0 {
+		return fmt.Errorf("Bad parameter: client API version %s is not supported by %s, which supports %s to %s",
+			match[1], host, version.MinAPIVersion, version.ApiVersion)
+	}
+	r.URL.Path = "/v" + version.ApiVersion + r.URL.Path[len(match[0])-1:]
+	r.URL.RawPath = ""
+	return nil
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/resource"
+)
+
+func setDowngrade(t *testing.T, downgrade bool) {
+	previous := config.Get()
+	c := *previous
+	c.DowngradeAPIVersion = downgrade
+	config.Set(&c)
+	t.Cleanup(func() { config.Set(previous) })
+}
+
+func TestCheckVersionAgainstOnlineDockers(t *testing.T) {
+	setDowngrade(t, false)
+	nodes := []*resource.Version{{ApiVersion: "1.26", MinAPIVersion: "1.12"}, {ApiVersion: "1.24", MinAPIVersion: "1.17"}}
+
+	for _, version := range []string{"1.12", "1.20", "1.26"} {
+		if err := checkNodesVersion(nodes, version); err != nil {
+			t.Fatalf("expected %s to be supported: %s", version, err)
+		}
+	}
+	for _, version := range []string{"1.10", "1.27"} {
+		err := checkNodesVersion(nodes, version)
+		if err == nil || !strings.HasPrefix(err.Error(), "Bad parameter") || !strings.Contains(err.Error(), "1.12 to 1.26") {
+			t.Fatalf("expected %s to be rejected with the supported range, got %v", version, err)
+		}
+	}
+	if err := checkNodesVersion(nil, "1.99"); err != nil {
+		t.Fatalf("expected no restriction without reported versions, got %s", err)
+	}
+
+	setDowngrade(t, true)
+	if err := checkNodesVersion(nodes, "1.40"); err != nil {
+		t.Fatalf("expected newer version to be allowed when downgrading: %s", err)
+	}
+	if err := checkNodesVersion(nodes, "1.10"); err == nil {
+		t.Fatal("expected older version to be rejected even when downgrading")
+	}
+}
+
+func TestNegotiateNodeVersion(t *testing.T) {
+	setDowngrade(t, false)
+	version := &resource.Version{ApiVersion: "1.24", MinAPIVersion: "1.12"}
+
+	r := httptest.NewRequest("GET", "/v1.20/containers/json", nil)
+	if err := negotiateNodeVersion("h1:4243", version, r); err != nil || r.URL.Path != "/v1.20/containers/json" {
+		t.Fatalf("expected supported version to pass unchanged, got %s %v", r.URL.Path, err)
+	}
+	r = httptest.NewRequest("GET", "/containers/json", nil)
+	if err := negotiateNodeVersion("h1:4243", version, r); err != nil {
+		t.Fatalf("expected unversioned path to pass: %s", err)
+	}
+	r = httptest.NewRequest("GET", "/v1.30/containers/json", nil)
+	if err := negotiateNodeVersion("h1:4243", version, r); err == nil || !strings.Contains(err.Error(), "h1:4243") {
+		t.Fatalf("expected newer version to be rejected, got %v", err)
+	}
+
+	setDowngrade(t, true)
+	if err := negotiateNodeVersion("h1:4243", version, r); err != nil || r.URL.Path != "/v1.24/containers/json" {
+		t.Fatalf("expected path to be rewritten to the docker version, got %s %v", r.URL.Path, err)
+	}
+	r = httptest.NewRequest("GET", "/v1.10/containers/json", nil)
+	if err := negotiateNodeVersion("h1:4243", version, r); err == nil {
+		t.Fatal("expected older version not to be upgraded")
+	}
+	r = httptest.NewRequest("GET", "/v1.30/containers/json", nil)
+	if err := negotiateNodeVersion("h1:4243", nil, r); err != nil {
+		t.Fatalf("expected docker without version to be unchecked: %s", err)
+	}
+}
@@ -0,0 +1,157 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// 成员只通过提交的配置日志变更，gossip和故障检测不会影响多数派
+const (
+	// 成员配置，Data为全部成员的集群地址
+	opConfig = "raft_config"
+	// 转发给leader的成员变更请求，由leader转换为新的配置
+	opAddMember    = "raft_add_member"
+	opRemoveMember = "raft_remove_member"
+)
+
+// 当前controller是否为成员，非成员不参与选举和多数派
+func IsMember() bool {
+	if node == nil {
+		return true
+	}
+	node.Lock()
+	defer node.Unlock()
+
+	return node.members[node.id]
+}
+
+// 当前的全部成员
+func Members() []string {
+	if node == nil {
+		return nil
+	}
+	node.Lock()
+	defer node.Unlock()
+
+	return memberList(node.members)
+}
+
+// 请求leader将自己加入成员，直到成功；seeds为已知的controller，
+// 不是leader的controller会返回leader的地址
+func Join(seeds func() []string) {
+	if node == nil {
+		return
+	}
+	for !IsMember() {
+		targets := seeds()
+		for i := 0; i < len(targets); i++ {
+			address := targets[i]
+			if address == "" || address == node.id {
+				continue
+			}
+			node.Lock()
+			p := node.peer(address)
+			node.Unlock()
+
+			var reply proposeReply
+			err := p.propose(&proposeRequest{Op: opAddMember, Data: node.id}, &reply)
+			if err == nil && reply.Error == "" {
+				logger.Info("Joined raft cluster", "via", address)
+				return
+			}
+			if reply.Leader != "" && reply.Leader != address && len(targets) < 16 {
+				targets = append(targets, reply.Leader)
+			}
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// 将controller从成员中删除，提交后不再计入多数派
+func RemoveMember(ctx context.Context, address string) error {
+	if node == nil {
+		return nil
+	}
+	return node.propose(ctx, opRemoveMember, address)
+}
+
+// 每次只增加或删除一个成员，上一次变更提交之前不允许再次变更，
+// 成员没有变化时返回nil，调用时需持有锁
+func (this *Node) changeMembers(op, address string) (*Entry, error) {
+	if address == "" {
+		return nil, fmt.Errorf("Bad parameter: member address is empty")
+	}
+	// 本任期的日志提交之前，之前任期的配置可能还未生效
+	if this.entry(this.commitIndex).Term != this.term || this.configIndex > this.commitIndex {
+		return nil, fmt.Errorf("Conflict: membership change in progress")
+	}
+	members := make(map[string]bool)
+	for member := range this.members {
+		members[member] = true
+	}
+	switch op {
+	case opAddMember:
+		if members[address] {
+			return nil, nil
+		}
+		members[address] = true
+	case opRemoveMember:
+		if !members[address] {
+			return nil, nil
+		}
+		if len(members) == 1 {
+			return nil, fmt.Errorf("Impossible to remove the last member %s", address)
+		}
+		delete(members, address)
+	}
+	logger.Info("Change raft members", "members", memberList(members))
+	return this.appendEntry(opConfig, encodeMembers(members), "")
+}
+
+// 根据最后一条配置更新成员，追加或删除日志后调用，调用时需持有锁
+func (this *Node) updateMembers() {
+	this.members, this.configIndex = this.membersAt(this.lastIndex())
+}
+
+// 截止到index的成员配置及其序号
+func (this *Node) membersAt(index uint64) (map[string]bool, uint64) {
+	for i := index; i > this.snapshot.Index; i-- {
+		if entry := this.entry(i); entry.Op == opConfig {
+			return decodeMembers(entry.Data), i
+		}
+	}
+	members := make(map[string]bool)
+	for _, member := range this.snapshot.Members {
+		members[member] = true
+	}
+	return members, this.snapshot.Index
+}
+
+func encodeMembers(members map[string]bool) string {
+	b, _ := json.Marshal(memberList(members))
+	return string(b)
+}
+
+func decodeMembers(data string) map[string]bool {
+	var list []string
+	if err := json.Unmarshal([]byte(data), &list); err != nil {
+		logger.Error("Decode raft members error", "error", err)
+	}
+	members := make(map[string]bool)
+	for _, member := range list {
+		members[member] = true
+	}
+	return members
+}
+
+func memberList(members map[string]bool) []string {
+	list := make([]string, 0, len(members))
+	for member := range members {
+		list = append(list, member)
+	}
+	sort.Strings(list)
+	return list
+}
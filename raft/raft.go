@@ -0,0 +1,728 @@
+////////////////////////////////////////////////////////////
+/*     controller之间的一致性协议，由leader修改集群状态并复制     */
+////////////////////////////////////////////////////////////
+
+package raft
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/logging"
+	"github.com/hugb/beegecluster/trace"
+)
+
+var logger = logging.Logger("raft")
+
+const (
+	stateFollower = iota
+	stateCandidate
+	stateLeader
+)
+
+const (
+	heartbeatInterval  = 500 * time.Millisecond
+	minElectionTimeout = 1500 * time.Millisecond
+	maxElectionTimeout = 3000 * time.Millisecond
+	// 等待提案提交的最长时间
+	proposeTimeout = 5 * time.Second
+	// 每次复制的最大条数
+	maxAppendEntries = 32
+)
+
+// 快照之后已执行的日志超过此数量时重新生成快照并压缩日志
+var snapshotThreshold uint64 = 1024
+
+// 修改集群状态的操作，提交后由各controller执行
+type Applier func(data string) error
+
+// 状态机快照，用于压缩日志和让落后太多的controller追上
+type Snapshotter interface {
+	// 保存已执行的日志产生的状态
+	Snapshot() (string, error)
+	// 用快照替换当前状态
+	Restore(data string) error
+}
+
+type Entry struct {
+	Term  uint64
+	Index uint64
+	Op    string
+	Data  string
+	// 发起操作的api请求，便于在各controller的日志中关联
+	RequestId string `json:",omitempty"`
+}
+
+type Node struct {
+	sync.Mutex
+
+	id      string
+	service string
+	storage *storage
+
+	state    int
+	term     uint64
+	votedFor string
+	leader   string
+	// leader的服务地址，follower将写请求转发到此地址
+	leaderService string
+
+	// 最近的快照，log[0]为占位，序号和任期与快照相同，log[i]的序号为snapshot.Index+i
+	snapshot *Snapshot
+	log      []*Entry
+	// 当前的成员配置，为日志中最后一条配置，追加后即生效
+	members     map[string]bool
+	configIndex uint64
+	commitIndex uint64
+	lastApplied uint64
+	// 从leader收到、等待恢复到状态机的快照
+	restoring *Snapshot
+
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	peers      map[string]*peer
+
+	appliers    map[string]Applier
+	snapshotter Snapshotter
+	waiters     map[uint64]chan error
+
+	heartbeat  chan bool
+	applyReady chan bool
+}
+
+var node *Node
+
+var appliers = make(map[string]Applier)
+
+var snapshotter Snapshotter
+
+// 注册操作的执行函数，需在Start之前调用
+func RegisterApplier(op string, applier Applier) error {
+	if _, exists := appliers[op]; exists {
+		return fmt.Errorf("Can't overwrite applier for op %s", op)
+	}
+	appliers[op] = applier
+	return nil
+}
+
+// 注册状态机快照，需在Start之前调用，未注册时不压缩日志
+func RegisterSnapshotter(s Snapshotter) {
+	snapshotter = s
+}
+
+// 启动一致性协议，任期、日志和快照保存在dir；没有保存的状态且bootstrap时
+// 以自己为唯一成员创建集群，否则等待通过Join由leader加入成员
+func Start(clusterAddress, serviceAddress, dir string, bootstrap bool) error {
+	s, err := openStorage(dir)
+	if err != nil {
+		return err
+	}
+	n := &Node{
+		id:          clusterAddress,
+		service:     serviceAddress,
+		storage:     s,
+		nextIndex:   make(map[string]uint64),
+		matchIndex:  make(map[string]uint64),
+		peers:       make(map[string]*peer),
+		appliers:    appliers,
+		snapshotter: snapshotter,
+		waiters:     make(map[uint64]chan error),
+		heartbeat:   make(chan bool, 1),
+		applyReady:  make(chan bool, 1),
+	}
+	if err = n.load(bootstrap); err != nil {
+		s.close()
+		return err
+	}
+	node = n
+	go n.applyLoop()
+	n.kickApply()
+	go n.run()
+	return nil
+}
+
+func (this *Node) load(bootstrap bool) error {
+	state, err := this.storage.loadState()
+	if err != nil {
+		return err
+	}
+	this.term, this.votedFor = state.Term, state.VotedFor
+
+	snapshot, err := this.storage.loadSnapshot()
+	if err != nil {
+		return err
+	}
+	entries, err := this.storage.loadLog(snapshot.Index, snapshot.Term)
+	if err != nil {
+		return err
+	}
+	this.snapshot = snapshot
+	this.log = append([]*Entry{{Term: snapshot.Term, Index: snapshot.Index}}, entries...)
+	if snapshot.Index > 0 {
+		this.restoring = snapshot
+		this.commitIndex = snapshot.Index
+	}
+
+	// 全新的controller创建集群，第一条日志为只有自己的成员配置
+	if bootstrap && snapshot.Index == 0 && len(entries) == 0 && this.term == 0 {
+		entry := &Entry{Index: 1, Op: opConfig, Data: encodeMembers(map[string]bool{this.id: true})}
+		if err = this.storage.appendLog([]*Entry{entry}); err != nil {
+			return err
+		}
+		this.log = append(this.log, entry)
+		this.commitIndex = 1
+		logger.Info("Bootstrap raft cluster", "member", this.id)
+	}
+	this.updateMembers()
+	return nil
+}
+
+// 当前controller是否为leader，未启动协议时视为leader
+func IsLeader() bool {
+	if node == nil {
+		return true
+	}
+	node.Lock()
+	defer node.Unlock()
+
+	return node.state == stateLeader
+}
+
+// 得到leader的集群地址和服务地址
+func Leader() (string, string) {
+	if node == nil {
+		return config.Get().ClusterAddress, config.Get().ServiceAddress
+	}
+	node.Lock()
+	defer node.Unlock()
+
+	return node.leader, node.leaderService
+}
+
+// 提交操作，follower转发给leader，提交成功后返回
+func Propose(op, data string) error {
+	return ProposeContext(context.Background(), op, data)
+}
+
+// 提交api请求发起的操作，请求id和trace随日志复制和转发传递
+func ProposeContext(ctx context.Context, op, data string) error {
+	if trace.FromContext(ctx) != nil {
+		var span *trace.Span
+		ctx, span = trace.Start(ctx, "raft.propose")
+		span.SetAttribute("raft.op", op)
+		err := propose(ctx, op, data)
+		span.Finish(err)
+		return err
+	}
+	return propose(ctx, op, data)
+}
+
+func propose(ctx context.Context, op, data string) error {
+	if node == nil {
+		return apply(appliers, &Entry{Op: op, Data: data, RequestId: trace.RequestId(ctx)})
+	}
+	return node.propose(ctx, op, data)
+}
+
+func (this *Node) propose(ctx context.Context, op, data string) error {
+	this.Lock()
+	if this.state != stateLeader {
+		if this.leader == "" {
+			this.Unlock()
+			return fmt.Errorf("No leader elected")
+		}
+		p := this.peer(this.leader)
+		this.Unlock()
+		var reply proposeReply
+		request := &proposeRequest{Op: op, Data: data, RequestId: trace.RequestId(ctx)}
+		if span := trace.FromContext(ctx); span != nil {
+			request.Traceparent = span.Traceparent()
+		}
+		if err := p.propose(request, &reply); err != nil {
+			return err
+		}
+		if reply.Error != "" {
+			return fmt.Errorf("%s", reply.Error)
+		}
+		return nil
+	}
+
+	var entry *Entry
+	var err error
+	switch op {
+	case opAddMember, opRemoveMember:
+		entry, err = this.changeMembers(op, data)
+	default:
+		entry, err = this.appendEntry(op, data, trace.RequestId(ctx))
+	}
+	if err != nil || entry == nil {
+		this.Unlock()
+		return err
+	}
+	waiter := make(chan error, 1)
+	this.waiters[entry.Index] = waiter
+	this.Unlock()
+
+	go this.replicate()
+
+	select {
+	case err := <-waiter:
+		return err
+	case <-time.After(proposeTimeout):
+		this.Lock()
+		delete(this.waiters, entry.Index)
+		this.Unlock()
+		return fmt.Errorf("Propose %s timeout", op)
+	}
+}
+
+// 追加日志并同步到磁盘后才计入自己的复制进度，调用时需持有锁
+func (this *Node) appendEntry(op, data, requestId string) (*Entry, error) {
+	entry := &Entry{Term: this.term, Index: this.lastIndex() + 1, Op: op, Data: data, RequestId: requestId}
+	if err := this.storage.appendLog([]*Entry{entry}); err != nil {
+		return nil, err
+	}
+	this.log = append(this.log, entry)
+	this.matchIndex[this.id] = entry.Index
+	if op == opConfig {
+		this.updateMembers()
+	}
+	return entry, nil
+}
+
+// 得到序号对应的日志，序号不能早于快照，调用时需持有锁
+func (this *Node) entry(index uint64) *Entry {
+	return this.log[index-this.snapshot.Index]
+}
+
+func (this *Node) lastIndex() uint64 {
+	return this.snapshot.Index + uint64(len(this.log)-1)
+}
+
+func (this *Node) lastTerm() uint64 {
+	return this.log[len(this.log)-1].Term
+}
+
+func (this *Node) run() {
+	for {
+		this.Lock()
+		state := this.state
+		this.Unlock()
+
+		if state == stateLeader {
+			this.replicate()
+			time.Sleep(heartbeatInterval)
+			continue
+		}
+
+		timeout := minElectionTimeout +
+			time.Duration(rand.Int63n(int64(maxElectionTimeout-minElectionTimeout)))
+		select {
+		case <-this.heartbeat:
+		case <-time.After(timeout):
+			this.election()
+		}
+	}
+}
+
+func (this *Node) peer(address string) *peer {
+	p, ok := this.peers[address]
+	if !ok {
+		p = &peer{address: address}
+		this.peers[address] = p
+	}
+	return p
+}
+
+// 成员中超过半数同意，不在成员中的controller不计入
+func quorum(members map[string]bool, agree func(address string) bool) bool {
+	count := 0
+	for address := range members {
+		if agree(address) {
+			count++
+		}
+	}
+	return count > len(members)/2
+}
+
+// 发起选举，只有成员才能参选
+func (this *Node) election() {
+	this.Lock()
+	if !this.members[this.id] {
+		this.Unlock()
+		return
+	}
+	this.state = stateCandidate
+	this.term++
+	this.votedFor = this.id
+	this.leader, this.leaderService = "", ""
+	// 投票写入磁盘后才能计入自己的一票
+	if err := this.save(); err != nil {
+		logger.Error("Save raft state error", "error", err)
+		this.state = stateFollower
+		this.Unlock()
+		return
+	}
+	term := this.term
+	request := &voteRequest{
+		Term:         term,
+		Candidate:    this.id,
+		LastLogIndex: this.lastIndex(),
+		LastLogTerm:  this.lastTerm(),
+	}
+	members := make(map[string]bool)
+	var peers []*peer
+	for address := range this.members {
+		members[address] = true
+		if address != this.id {
+			peers = append(peers, this.peer(address))
+		}
+	}
+	this.Unlock()
+
+	logger.Info("Start election", "term", term)
+
+	votes := make(chan string, len(peers))
+	for _, p := range peers {
+		go func(p *peer) {
+			var reply voteReply
+			if err := p.call("raft_vote", request, &reply); err != nil {
+				votes <- ""
+				return
+			}
+			this.Lock()
+			if reply.Term > this.term {
+				this.stepDown(reply.Term)
+			}
+			this.Unlock()
+			if reply.Granted {
+				votes <- p.address
+			} else {
+				votes <- ""
+			}
+		}(p)
+	}
+
+	granted := map[string]bool{this.id: true}
+	won := func() bool {
+		return quorum(members, func(address string) bool { return granted[address] })
+	}
+	for i := 0; i < len(peers) && !won(); i++ {
+		if address := <-votes; address != "" {
+			granted[address] = true
+		}
+	}
+
+	this.Lock()
+	defer this.Unlock()
+
+	if this.state != stateCandidate || this.term != term || !won() {
+		return
+	}
+	logger.Info("Become leader", "term", term, "votes", len(granted))
+	this.state = stateLeader
+	this.leader, this.leaderService = this.id, this.service
+	for address := range this.members {
+		this.nextIndex[address] = this.lastIndex() + 1
+		this.matchIndex[address] = 0
+	}
+	// 提交一条本任期的空操作，以便提交之前任期的日志
+	if _, err := this.appendEntry("", "", ""); err != nil {
+		logger.Error("Append raft log error", "error", err)
+		this.stepDown(this.term)
+	}
+}
+
+// 发现更高的任期或其他leader，转为follower，调用时需持有锁
+func (this *Node) stepDown(term uint64) {
+	if this.state == stateLeader {
+		logger.Info("Step down from leader", "term", term)
+	}
+	this.state = stateFollower
+	if term > this.term {
+		this.term = term
+		this.votedFor = ""
+		if err := this.save(); err != nil {
+			logger.Error("Save raft state error", "error", err)
+		}
+	}
+	// 未提交的提案由新leader决定，通知等待者失败
+	for index, waiter := range this.waiters {
+		waiter <- fmt.Errorf("Leadership lost")
+		delete(this.waiters, index)
+	}
+}
+
+// 向所有成员复制日志，同时作为心跳
+func (this *Node) replicate() {
+	this.Lock()
+	var peers []string
+	for address := range this.members {
+		if address != this.id {
+			peers = append(peers, address)
+		}
+	}
+	// 只有自己一个成员时直接提交
+	if len(peers) == 0 && this.state == stateLeader {
+		this.advanceCommit()
+	}
+	this.Unlock()
+
+	for _, address := range peers {
+		go this.replicateTo(address)
+	}
+}
+
+func (this *Node) replicateTo(address string) {
+	this.Lock()
+	if this.state != stateLeader {
+		this.Unlock()
+		return
+	}
+	p := this.peer(address)
+	if p.inflight {
+		this.Unlock()
+		return
+	}
+	p.inflight = true
+	next, ok := this.nextIndex[address]
+	if !ok || next == 0 {
+		next = this.lastIndex() + 1
+		this.nextIndex[address] = next
+	}
+	// 需要的日志已经压缩，发送快照
+	if next <= this.snapshot.Index {
+		this.Unlock()
+		this.sendSnapshot(p)
+		return
+	}
+	prev := next - 1
+	request := &appendRequest{
+		Term:          this.term,
+		Leader:        this.id,
+		LeaderService: this.service,
+		PrevLogIndex:  prev,
+		PrevLogTerm:   this.entry(prev).Term,
+		LeaderCommit:  this.commitIndex,
+	}
+	for i := next; i <= this.lastIndex() && len(request.Entries) < maxAppendEntries; i++ {
+		request.Entries = append(request.Entries, this.entry(i))
+	}
+	this.Unlock()
+
+	var reply appendReply
+	err := p.call("raft_append", request, &reply)
+
+	this.Lock()
+	defer this.Unlock()
+
+	p.inflight = false
+	if err != nil {
+		return
+	}
+	if reply.Term > this.term {
+		this.stepDown(reply.Term)
+		return
+	}
+	if this.state != stateLeader || this.term != request.Term {
+		return
+	}
+	if reply.Success {
+		this.matchIndex[address] = reply.MatchIndex
+		this.nextIndex[address] = reply.MatchIndex + 1
+		this.advanceCommit()
+	} else {
+		// follower日志不一致，回退后重试
+		next = reply.MatchIndex + 1
+		if next > prev {
+			next = prev
+		}
+		if next < 1 {
+			next = 1
+		}
+		this.nextIndex[address] = next
+	}
+}
+
+func (this *Node) sendSnapshot(p *peer) {
+	this.Lock()
+	request := &snapshotRequest{
+		Term:          this.term,
+		Leader:        this.id,
+		LeaderService: this.service,
+		Snapshot:      this.snapshot,
+	}
+	this.Unlock()
+
+	var reply appendReply
+	err := p.call("raft_snapshot", request, &reply)
+
+	this.Lock()
+	defer this.Unlock()
+
+	p.inflight = false
+	if err != nil {
+		logger.Warn("Send snapshot error", "node", p.address, "error", err)
+		return
+	}
+	if reply.Term > this.term {
+		this.stepDown(reply.Term)
+		return
+	}
+	if this.state != stateLeader || this.term != request.Term || !reply.Success {
+		return
+	}
+	this.matchIndex[p.address] = reply.MatchIndex
+	this.nextIndex[p.address] = reply.MatchIndex + 1
+	this.advanceCommit()
+}
+
+// 多数成员已复制的本任期日志即可提交，调用时需持有锁
+func (this *Node) advanceCommit() {
+	for index := this.lastIndex(); index > this.commitIndex; index-- {
+		if this.entry(index).Term != this.term {
+			break
+		}
+		if quorum(this.members, func(address string) bool { return this.matchIndex[address] >= index }) {
+			this.commitIndex = index
+			break
+		}
+	}
+	this.kickApply()
+	// 移除自己的配置提交后交出leader，不再参与选举
+	if this.state == stateLeader && !this.members[this.id] && this.commitIndex >= this.configIndex {
+		logger.Info("Removed from raft members, step down")
+		// 已提交的提案不算失败
+		for index, waiter := range this.waiters {
+			if index <= this.commitIndex {
+				waiter <- nil
+				delete(this.waiters, index)
+			}
+		}
+		this.stepDown(this.term)
+		this.leader, this.leaderService = "", ""
+	}
+}
+
+func (this *Node) kickApply() {
+	select {
+	case this.applyReady <- true:
+	default:
+	}
+}
+
+// 依次执行已提交的日志，执行时不持有锁，慢的applier不会阻塞心跳和复制
+func (this *Node) applyLoop() {
+	for range this.applyReady {
+		for this.applyPending() {
+		}
+	}
+}
+
+// 恢复收到的快照或执行一批已提交的日志，没有可执行的内容时返回false
+func (this *Node) applyPending() bool {
+	this.Lock()
+	if snapshot := this.restoring; snapshot != nil {
+		this.restoring = nil
+		this.Unlock()
+		if this.snapshotter != nil {
+			if err := this.snapshotter.Restore(snapshot.Data); err != nil {
+				logger.Error("Restore snapshot error", "index", snapshot.Index, "error", err)
+			}
+		}
+		this.Lock()
+		if snapshot.Index > this.lastApplied {
+			this.lastApplied = snapshot.Index
+		}
+		this.Unlock()
+		return true
+	}
+	var entries []*Entry
+	for index := this.lastApplied + 1; index <= this.commitIndex; index++ {
+		entries = append(entries, this.entry(index))
+	}
+	this.Unlock()
+	if len(entries) == 0 {
+		return false
+	}
+
+	for _, entry := range entries {
+		err := apply(this.appliers, entry)
+		if err != nil {
+			logger.Error("Apply error", "op", entry.Op, "request_id", entry.RequestId, "error", err)
+		}
+		this.Lock()
+		if entry.Index > this.lastApplied {
+			this.lastApplied = entry.Index
+		}
+		if waiter, ok := this.waiters[entry.Index]; ok {
+			waiter <- err
+			delete(this.waiters, entry.Index)
+		}
+		this.Unlock()
+	}
+	this.compact()
+	return true
+}
+
+func apply(appliers map[string]Applier, entry *Entry) error {
+	// leader上任时的空操作和成员配置
+	if entry.Op == "" || entry.Op == opConfig {
+		return nil
+	}
+	applier, exists := appliers[entry.Op]
+	if !exists {
+		return fmt.Errorf("No such op: %s", entry.Op)
+	}
+	return applier(entry.Data)
+}
+
+// 已执行的日志足够多时保存快照并删除之前的日志；只在执行日志的goroutine中调用，
+// 快照的状态与lastApplied一致
+func (this *Node) compact() {
+	if this.snapshotter == nil {
+		return
+	}
+	this.Lock()
+	index := this.lastApplied
+	if index < this.snapshot.Index+snapshotThreshold || this.restoring != nil {
+		this.Unlock()
+		return
+	}
+	this.Unlock()
+
+	data, err := this.snapshotter.Snapshot()
+	if err != nil {
+		logger.Error("Snapshot state error", "error", err)
+		return
+	}
+
+	this.Lock()
+	defer this.Unlock()
+
+	// 期间收到了leader更新的快照
+	if index <= this.snapshot.Index || this.restoring != nil {
+		return
+	}
+	members, _ := this.membersAt(index)
+	snapshot := &Snapshot{Index: index, Term: this.entry(index).Term, Members: memberList(members), Data: data}
+	if err = this.storage.saveSnapshot(snapshot); err != nil {
+		logger.Error("Save raft snapshot error", "error", err)
+		return
+	}
+	this.log = append([]*Entry{{Term: snapshot.Term, Index: snapshot.Index}}, this.log[index-this.snapshot.Index+1:]...)
+	this.snapshot = snapshot
+	if err = this.storage.rewriteLog(this.log[1:]); err != nil {
+		logger.Error("Compact raft log error", "error", err)
+	}
+	logger.Info("Compact raft log", "index", index)
+}
+
+// 调用时需持有锁
+func (this *Node) save() error {
+	return this.storage.saveState(&persistentState{Term: this.term, VotedFor: this.votedFor})
+}
@@ -0,0 +1,319 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hugb/beegecluster/utils"
+)
+
+type testSnapshotter struct {
+	state    string
+	restored chan string
+}
+
+func (this *testSnapshotter) Snapshot() (string, error) {
+	return this.state, nil
+}
+
+func (this *testSnapshotter) Restore(data string) error {
+	this.state = data
+	if this.restored != nil {
+		this.restored <- data
+	}
+	return nil
+}
+
+// 不启动选举循环的节点，由测试驱动
+func newTestNode(t *testing.T, dir, id string, bootstrap bool, applied chan string) *Node {
+	s, err := openStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &Node{
+		id:          id,
+		service:     id,
+		storage:     s,
+		nextIndex:   make(map[string]uint64),
+		matchIndex:  make(map[string]uint64),
+		peers:       make(map[string]*peer),
+		appliers:    map[string]Applier{"set": func(data string) error { applied <- data; return nil }},
+		snapshotter: &testSnapshotter{},
+		waiters:     make(map[uint64]chan error),
+		heartbeat:   make(chan bool, 1),
+		applyReady:  make(chan bool, 1),
+	}
+	if err = n.load(bootstrap); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.close() })
+	return n
+}
+
+func useNode(t *testing.T, n *Node) {
+	node = n
+	t.Cleanup(func() { node = nil })
+}
+
+func TestSingleMemberCommitsAndRestarts(t *testing.T) {
+	dir := t.TempDir()
+	applied := make(chan string, 10)
+	n := newTestNode(t, dir, "a:1", true, applied)
+
+	n.election()
+	if n.state != stateLeader || n.term != 1 {
+		t.Fatalf("expected single member to become leader, state %d term %d", n.state, n.term)
+	}
+	done := make(chan error, 1)
+	go func() { done <- n.propose(context.Background(), "set", "x") }()
+	// 代替applyLoop执行已提交的日志
+	for proposed := false; !proposed; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			proposed = true
+		case <-n.applyReady:
+			n.applyPending()
+		case <-time.After(time.Second):
+			t.Fatal("proposal was not committed")
+		}
+	}
+	select {
+	case data := <-applied:
+		if data != "x" {
+			t.Fatalf("unexpected applied data %s", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("entry was not applied")
+	}
+
+	restarted := newTestNode(t, dir, "a:1", true, applied)
+	if restarted.term != 1 || restarted.votedFor != "a:1" {
+		t.Fatalf("expected term and vote to survive restart, got %d %s", restarted.term, restarted.votedFor)
+	}
+	if restarted.lastIndex() != 3 || restarted.entry(3).Data != "x" {
+		t.Fatalf("expected log to survive restart, last index %d", restarted.lastIndex())
+	}
+	if !restarted.members["a:1"] || len(restarted.members) != 1 {
+		t.Fatalf("unexpected members %v", restarted.members)
+	}
+}
+
+func TestNonMemberDoesNotStartElection(t *testing.T) {
+	n := newTestNode(t, t.TempDir(), "b:1", false, nil)
+	n.election()
+	if n.state != stateFollower || n.term != 0 {
+		t.Fatalf("expected non member to stay follower, state %d term %d", n.state, n.term)
+	}
+}
+
+func TestQuorumCountsOnlyMembers(t *testing.T) {
+	members := map[string]bool{"a": true, "b": true, "c": true}
+	agree := func(addresses ...string) func(string) bool {
+		return func(address string) bool {
+			for _, a := range addresses {
+				if a == address {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	if !quorum(members, agree("a", "b")) {
+		t.Fatal("expected 2 of 3 to be a quorum")
+	}
+	if quorum(members, agree("a", "x", "y")) {
+		t.Fatal("expected votes from non members to be ignored")
+	}
+	if quorum(map[string]bool{"b": true, "c": true}, agree("a", "b")) {
+		t.Fatal("expected a removed leader not to count itself")
+	}
+}
+
+func TestMembershipChangesOneAtATime(t *testing.T) {
+	n := newTestNode(t, t.TempDir(), "a:1", true, nil)
+	n.election()
+
+	n.Lock()
+	defer n.Unlock()
+
+	// 本任期的空操作提交之前不允许变更
+	if _, err := n.changeMembers(opAddMember, "b:1"); err == nil {
+		t.Fatal("expected change before committing in the term to fail")
+	}
+	n.advanceCommit()
+	entry, err := n.changeMembers(opAddMember, "b:1")
+	if err != nil || entry == nil {
+		t.Fatalf("expected member to be added, got %v %v", entry, err)
+	}
+	if !n.members["b:1"] {
+		t.Fatal("expected new configuration to take effect when appended")
+	}
+	if _, err = n.changeMembers(opAddMember, "c:1"); err == nil {
+		t.Fatal("expected second change to wait for the first to commit")
+	}
+	// b尚未复制，单独一个成员不能提交
+	n.advanceCommit()
+	if n.commitIndex >= entry.Index {
+		t.Fatal("expected configuration to need b's acknowledgement")
+	}
+	n.matchIndex["b:1"] = entry.Index
+	n.advanceCommit()
+	if n.commitIndex != entry.Index {
+		t.Fatalf("expected configuration to commit, commit index %d", n.commitIndex)
+	}
+	if entry, _ = n.changeMembers(opAddMember, "b:1"); entry != nil {
+		t.Fatal("expected adding an existing member to be a no-op")
+	}
+}
+
+// 通过内存连接调用处理函数，返回响应的数据
+func call(t *testing.T, handler func(*utils.Connection, []byte), request interface{}, reply interface{}) {
+	b, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		handler(&utils.Connection{Conn: server}, b)
+		server.Close()
+	}()
+	client.SetDeadline(time.Now().Add(time.Second))
+	length, data, err := (&utils.Connection{Conn: client}).Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, payload := utils.CmdDecode(length, data)
+	if err = json.Unmarshal(payload, reply); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAppendIsPersistedBeforeAck(t *testing.T) {
+	dir := t.TempDir()
+	n := newTestNode(t, dir, "b:1", false, nil)
+	useNode(t, n)
+
+	config := &Entry{Term: 1, Index: 1, Op: opConfig, Data: `["a:1","b:1"]`}
+	request := &appendRequest{Term: 1, Leader: "a:1", Entries: []*Entry{config, {Term: 1, Index: 2, Op: "set", Data: "x"}}}
+	var reply appendReply
+	call(t, handleAppend, request, &reply)
+	if !reply.Success || reply.MatchIndex != 2 {
+		t.Fatalf("unexpected reply %+v", reply)
+	}
+	if !n.members["b:1"] {
+		t.Fatal("expected configuration from the leader to make b a member")
+	}
+
+	entries, err := n.storage.loadLog(0, 0)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("expected acknowledged entries on disk, got %v %v", entries, err)
+	}
+
+	// 新leader的日志覆盖冲突的未提交日志
+	request = &appendRequest{Term: 2, Leader: "a:1", PrevLogIndex: 1, PrevLogTerm: 1,
+		Entries: []*Entry{{Term: 2, Index: 2, Op: "set", Data: "y"}}}
+	call(t, handleAppend, request, &reply)
+	if !reply.Success || n.entry(2).Data != "y" {
+		t.Fatalf("expected conflicting entry to be replaced, reply %+v", reply)
+	}
+	if entries, _ = n.storage.loadLog(0, 0); len(entries) != 2 || entries[1].Data != "y" {
+		t.Fatalf("expected truncation on disk, got %v", entries)
+	}
+
+	// 前一条日志不一致时拒绝
+	request = &appendRequest{Term: 2, Leader: "a:1", PrevLogIndex: 5, PrevLogTerm: 2}
+	call(t, handleAppend, request, &reply)
+	if reply.Success || reply.MatchIndex != 2 {
+		t.Fatalf("expected gap to be rejected, reply %+v", reply)
+	}
+}
+
+func TestCompactAndInstallSnapshot(t *testing.T) {
+	previous := snapshotThreshold
+	snapshotThreshold = 3
+	defer func() { snapshotThreshold = previous }()
+
+	applied := make(chan string, 10)
+	leader := newTestNode(t, t.TempDir(), "a:1", true, applied)
+	leader.snapshotter.(*testSnapshotter).state = "state-at-5"
+	leader.election()
+	leader.Lock()
+	for _, data := range []string{"1", "2", "3"} {
+		leader.appendEntry("set", data, "")
+	}
+	leader.advanceCommit()
+	leader.Unlock()
+	for leader.applyPending() {
+	}
+
+	if leader.snapshot.Index != 5 || len(leader.log) != 1 {
+		t.Fatalf("expected log to be compacted at 5, snapshot %d entries %d", leader.snapshot.Index, len(leader.log)-1)
+	}
+	restarted := newTestNode(t, leader.storage.dir, "a:1", true, applied)
+	if restarted.snapshot.Index != 5 || restarted.lastIndex() != 5 || !restarted.members["a:1"] {
+		t.Fatalf("expected snapshot to survive restart, got %+v", restarted.snapshot)
+	}
+
+	restored := make(chan string, 1)
+	follower := newTestNode(t, t.TempDir(), "b:1", false, applied)
+	follower.snapshotter = &testSnapshotter{restored: restored}
+	useNode(t, follower)
+	var reply appendReply
+	call(t, handleSnapshot, &snapshotRequest{Term: 1, Leader: "a:1", Snapshot: leader.snapshot}, &reply)
+	if !reply.Success || reply.MatchIndex != 5 {
+		t.Fatalf("unexpected reply %+v", reply)
+	}
+	for follower.applyPending() {
+	}
+	if data := <-restored; data != "state-at-5" || follower.lastApplied != 5 {
+		t.Fatalf("expected snapshot to be restored, got %s at %d", data, follower.lastApplied)
+	}
+
+	// 快照之后的日志可以继续复制
+	request := &appendRequest{Term: 1, Leader: "a:1", PrevLogIndex: 4, PrevLogTerm: 1,
+		Entries: []*Entry{{Term: 1, Index: 5}, {Term: 1, Index: 6, Op: "set", Data: "4"}}}
+	call(t, handleAppend, request, &reply)
+	if !reply.Success || reply.MatchIndex != 6 || follower.lastIndex() != 6 {
+		t.Fatalf("expected append after snapshot, reply %+v", reply)
+	}
+}
+
+// leader等待提交的时间超过普通调用的超时，转发的提案仍然等到结果
+func TestForwardedProposeOutlastsCallTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		c := &utils.Connection{Conn: conn}
+		length, data, err := c.Read()
+		if err != nil {
+			return
+		}
+		if cmd, _ := utils.CmdDecode(length, data); cmd != "raft_propose" {
+			return
+		}
+		time.Sleep(callTimeout + 200*time.Millisecond)
+		b, _ := json.Marshal(&proposeReply{})
+		c.SendCommandBytes("raft_propose_reply", b)
+	}()
+
+	p := &peer{address: ln.Addr().String()}
+	var reply proposeReply
+	if err = p.propose(&proposeRequest{Op: "set", Data: "a"}, &reply); err != nil || reply.Error != "" {
+		t.Fatalf("expected forwarded propose to wait for the leader, got %v %s", err, reply.Error)
+	}
+}
@@ -0,0 +1,374 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hugb/beegecluster/trace"
+	"github.com/hugb/beegecluster/utils"
+)
+
+const (
+	dialTimeout = time.Second
+	callTimeout = 2 * time.Second
+	// 转发的提案需等待leader提交，长于leader等待提交的时间，
+	// 避免follower先超时返回后重试，而leader仍然提交了同一操作
+	proposeCallTimeout = proposeTimeout + callTimeout
+	// 单个数据包的最大长度
+	maxPacketSize = 65535
+)
+
+type voteRequest struct {
+	Term         uint64
+	Candidate    string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type voteReply struct {
+	Term    uint64
+	Granted bool
+}
+
+type appendRequest struct {
+	Term          uint64
+	Leader        string
+	LeaderService string
+	PrevLogIndex  uint64
+	PrevLogTerm   uint64
+	Entries       []*Entry
+	LeaderCommit  uint64
+}
+
+type appendReply struct {
+	Term    uint64
+	Success bool
+	// 成功时为已复制到的序号，失败时为follower的最后序号
+	MatchIndex uint64
+}
+
+type proposeRequest struct {
+	Op   string
+	Data string
+	// follower转发api请求发起的操作时，带上请求id和trace
+	RequestId   string `json:",omitempty"`
+	Traceparent string `json:",omitempty"`
+}
+
+type proposeReply struct {
+	Error string
+	// 不是leader时返回已知的leader，便于加入集群时重试
+	Leader string `json:",omitempty"`
+}
+
+// follower需要的日志已经压缩时，leader发送快照
+type snapshotRequest struct {
+	Term          uint64
+	Leader        string
+	LeaderService string
+	Snapshot      *Snapshot
+}
+
+// 到其他controller的连接，请求和响应依次进行
+type peer struct {
+	sync.Mutex
+
+	address    string
+	connection *utils.Connection
+	// 是否有正在进行的复制，由Node的锁保护
+	inflight bool
+}
+
+func (this *peer) call(cmd string, request, reply interface{}) error {
+	return this.callWithin(cmd, request, reply, callTimeout)
+}
+
+// 将提案转发给leader并等待提交
+func (this *peer) propose(request *proposeRequest, reply *proposeReply) error {
+	return this.callWithin("raft_propose", request, reply, proposeCallTimeout)
+}
+
+func (this *peer) callWithin(cmd string, request, reply interface{}, timeout time.Duration) error {
+	this.Lock()
+	defer this.Unlock()
+
+	b, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	if len(b)+len(cmd)+1 > maxPacketSize {
+		return fmt.Errorf("Request %s is too large", cmd)
+	}
+
+	if this.connection == nil {
+		conn, err := net.DialTimeout("tcp", this.address, dialTimeout)
+		if err != nil {
+			return err
+		}
+		this.connection = &utils.Connection{Conn: conn}
+	}
+	conn := this.connection.Conn
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err = this.connection.SendCommandBytes(cmd, b); err != nil {
+		this.close()
+		return err
+	}
+	// 连接也会收到controller的广播，跳过非响应的数据
+	for {
+		length, data, err := this.connection.Read()
+		if err != nil {
+			this.close()
+			return err
+		}
+		replyCmd, payload := utils.CmdDecode(length, data)
+		if replyCmd == cmd+"_reply" {
+			return json.Unmarshal(payload, reply)
+		}
+	}
+}
+
+func (this *peer) close() {
+	this.connection.Conn.Close()
+	this.connection = nil
+}
+
+// 集群内部通信命令处理函数
+func Handlers() map[string]func(c *utils.Connection, data []byte) {
+	return map[string]func(c *utils.Connection, data []byte){
+		"raft_vote":     handleVote,
+		"raft_append":   handleAppend,
+		"raft_propose":  handlePropose,
+		"raft_snapshot": handleSnapshot,
+	}
+}
+
+func reply(c *utils.Connection, cmd string, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		logger.Error("Encode reply error", "cmd", cmd, "error", err)
+		return
+	}
+	c.SendCommandBytes(cmd, b)
+}
+
+// 投票请求
+func handleVote(c *utils.Connection, data []byte) {
+	request := &voteRequest{}
+	if node == nil || json.Unmarshal(data, request) != nil {
+		return
+	}
+
+	node.Lock()
+	defer node.Unlock()
+
+	if request.Term > node.term {
+		node.stepDown(request.Term)
+	}
+	// 只投给日志至少与自己一样新的候选人
+	upToDate := request.LastLogTerm > node.lastTerm() ||
+		(request.LastLogTerm == node.lastTerm() && request.LastLogIndex >= node.lastIndex())
+	granted := request.Term == node.term && upToDate &&
+		(node.votedFor == "" || node.votedFor == request.Candidate)
+	if granted {
+		node.votedFor = request.Candidate
+		if err := node.save(); err != nil {
+			logger.Error("Save raft state error", "error", err)
+			granted = false
+		} else {
+			node.resetElection()
+		}
+	}
+	reply(c, "raft_vote_reply", &voteReply{Term: node.term, Granted: granted})
+}
+
+// 日志复制及心跳
+func handleAppend(c *utils.Connection, data []byte) {
+	request := &appendRequest{}
+	if node == nil || json.Unmarshal(data, request) != nil {
+		return
+	}
+
+	node.Lock()
+	defer node.Unlock()
+
+	if request.Term < node.term {
+		reply(c, "raft_append_reply", &appendReply{Term: node.term})
+		return
+	}
+	if request.Term > node.term || node.state != stateFollower {
+		node.stepDown(request.Term)
+	}
+	node.follow(request.Leader, request.LeaderService, request.Term)
+
+	// 快照之前的日志已提交，与leader一致，从快照之后比较
+	entries := request.Entries
+	prevIndex, prevTerm := request.PrevLogIndex, request.PrevLogTerm
+	if prevIndex < node.snapshot.Index {
+		skip := node.snapshot.Index - prevIndex
+		if uint64(len(entries)) <= skip {
+			entries = nil
+		} else {
+			entries = entries[skip:]
+		}
+		prevIndex, prevTerm = node.snapshot.Index, node.snapshot.Term
+	}
+
+	// 前一条日志不一致，由leader回退后重试
+	if prevIndex > node.lastIndex() || node.entry(prevIndex).Term != prevTerm {
+		match := node.lastIndex()
+		if prevIndex <= match {
+			match = prevIndex - 1
+		}
+		reply(c, "raft_append_reply", &appendReply{Term: node.term, MatchIndex: match})
+		return
+	}
+
+	// 先写入磁盘再修改内存中的日志，写入失败时不确认
+	newLog, truncated := node.log, false
+	var appended []*Entry
+	for _, entry := range entries {
+		position := entry.Index - node.snapshot.Index
+		if position < uint64(len(newLog)) {
+			if newLog[position].Term == entry.Term {
+				continue
+			}
+			// 删除冲突及之后的日志
+			newLog = append([]*Entry(nil), newLog[:position]...)
+			truncated = true
+		}
+		newLog = append(newLog, entry)
+		appended = append(appended, entry)
+	}
+	var err error
+	if truncated {
+		err = node.storage.rewriteLog(newLog[1:])
+	} else {
+		err = node.storage.appendLog(appended)
+	}
+	if err != nil {
+		logger.Error("Persist raft log error", "error", err)
+		reply(c, "raft_append_reply", &appendReply{Term: node.term, MatchIndex: prevIndex})
+		return
+	}
+	node.log = newLog
+	if truncated || len(appended) > 0 {
+		node.updateMembers()
+	}
+
+	match := prevIndex + uint64(len(entries))
+	if request.LeaderCommit > node.commitIndex && match > node.commitIndex {
+		node.commitIndex = request.LeaderCommit
+		if node.commitIndex > match {
+			node.commitIndex = match
+		}
+		node.kickApply()
+	}
+	reply(c, "raft_append_reply", &appendReply{Term: node.term, Success: true, MatchIndex: match})
+}
+
+// leader发送的快照，替换落后的日志并等待恢复到状态机
+func handleSnapshot(c *utils.Connection, data []byte) {
+	request := &snapshotRequest{}
+	if node == nil || json.Unmarshal(data, request) != nil || request.Snapshot == nil {
+		return
+	}
+
+	node.Lock()
+	defer node.Unlock()
+
+	if request.Term < node.term {
+		reply(c, "raft_snapshot_reply", &appendReply{Term: node.term})
+		return
+	}
+	if request.Term > node.term || node.state != stateFollower {
+		node.stepDown(request.Term)
+	}
+	node.follow(request.Leader, request.LeaderService, request.Term)
+
+	snapshot := request.Snapshot
+	// 已经提交到快照之后，日志与leader一致
+	if snapshot.Index <= node.commitIndex {
+		reply(c, "raft_snapshot_reply", &appendReply{Term: node.term, Success: true, MatchIndex: snapshot.Index})
+		return
+	}
+	if err := node.storage.saveSnapshot(snapshot); err != nil {
+		logger.Error("Save raft snapshot error", "error", err)
+		reply(c, "raft_snapshot_reply", &appendReply{Term: node.term})
+		return
+	}
+	// 快照之后与快照衔接的日志保留，否则全部丢弃
+	var rest []*Entry
+	if snapshot.Index <= node.lastIndex() && node.entry(snapshot.Index).Term == snapshot.Term {
+		rest = node.log[snapshot.Index-node.snapshot.Index+1:]
+	}
+	node.log = append([]*Entry{{Term: snapshot.Term, Index: snapshot.Index}}, rest...)
+	node.snapshot = snapshot
+	if err := node.storage.rewriteLog(node.log[1:]); err != nil {
+		logger.Error("Compact raft log error", "error", err)
+	}
+	node.commitIndex = snapshot.Index
+	node.restoring = snapshot
+	node.updateMembers()
+	node.kickApply()
+	logger.Info("Installed raft snapshot", "index", snapshot.Index, "leader", request.Leader)
+	reply(c, "raft_snapshot_reply", &appendReply{Term: node.term, Success: true, MatchIndex: snapshot.Index})
+}
+
+// follower转发过来的提案，等待提交期间不阻塞该连接上的其他请求
+func handlePropose(c *utils.Connection, data []byte) {
+	request := &proposeRequest{}
+	if node == nil || json.Unmarshal(data, request) != nil {
+		return
+	}
+	go proposeForward(c, request)
+}
+
+func proposeForward(c *utils.Connection, request *proposeRequest) {
+	response := &proposeReply{}
+	ctx := trace.WithRequestId(context.Background(), request.RequestId)
+	if request.Traceparent != "" {
+		var span *trace.Span
+		ctx, span = trace.StartRemote(ctx, "raft.handle_propose", request.Traceparent)
+		span.SetAttribute("raft.op", request.Op)
+		defer func() {
+			var err error
+			if response.Error != "" {
+				err = fmt.Errorf("%s", response.Error)
+			}
+			span.Finish(err)
+		}()
+	}
+
+	node.Lock()
+	isLeader, leader := node.state == stateLeader, node.leader
+	node.Unlock()
+	// 避免在controller之间来回转发
+	if !isLeader {
+		response.Error, response.Leader = "Not leader", leader
+	} else if err := node.propose(ctx, request.Op, request.Data); err != nil {
+		response.Error = err.Error()
+	}
+	reply(c, "raft_propose_reply", response)
+}
+
+// 记录当前的leader并重置选举计时，调用时需持有锁
+func (this *Node) follow(leader, service string, term uint64) {
+	if this.leader != leader {
+		logger.Info("Leader changed", "leader", leader, "term", term)
+	}
+	this.leader, this.leaderService = leader, service
+	this.resetElection()
+}
+
+// 收到leader消息或投票后重置选举计时，调用时需持有锁
+func (this *Node) resetElection() {
+	select {
+	case this.heartbeat <- true:
+	default:
+	}
+}
@@ -0,0 +1,193 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// 持久化的任期和投票，重启后不会在同一任期重复投票
+type persistentState struct {
+	Term     uint64
+	VotedFor string
+}
+
+// 快照包含截止到Index的成员配置和状态机
+type Snapshot struct {
+	Index   uint64
+	Term    uint64
+	Members []string
+	Data    string
+}
+
+// 保存在数据目录下：state.json为任期和投票，snapshot.json为快照，
+// log.jsonl为快照之后的日志，每行一条；写入后都会fsync
+type storage struct {
+	dir string
+	log *os.File
+}
+
+func openStorage(dir string) (*storage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, "log.jsonl"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &storage{dir: dir, log: file}, nil
+}
+
+func (this *storage) loadState() (*persistentState, error) {
+	state := &persistentState{}
+	return state, this.loadJSON("state.json", state)
+}
+
+func (this *storage) saveState(state *persistentState) error {
+	return this.saveJSON("state.json", state)
+}
+
+// 没有快照时返回序号为0的空快照
+func (this *storage) loadSnapshot() (*Snapshot, error) {
+	snapshot := &Snapshot{}
+	return snapshot, this.loadJSON("snapshot.json", snapshot)
+}
+
+func (this *storage) saveSnapshot(snapshot *Snapshot) error {
+	return this.saveJSON("snapshot.json", snapshot)
+}
+
+// 读取快照之后的日志，崩溃时写了一半的最后一行被丢弃；安装快照后
+// 来不及重写的旧日志任期早于快照，同样丢弃
+func (this *storage) loadLog(after, afterTerm uint64) ([]*Entry, error) {
+	file, err := os.Open(filepath.Join(this.dir, "log.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []*Entry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxPacketSize*2)
+	for scanner.Scan() {
+		entry := &Entry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			break
+		}
+		// 只保留与快照衔接的连续日志
+		if entry.Index <= after {
+			continue
+		}
+		if entry.Index != after+uint64(len(entries))+1 || entry.Term < afterTerm {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// 追加日志并同步到磁盘
+func (this *storage) appendLog(entries []*Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	var content []byte
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		content = append(append(content, line...), '\n')
+	}
+	if _, err := this.log.Write(content); err != nil {
+		return err
+	}
+	return this.log.Sync()
+}
+
+// 删除冲突的日志或压缩后重写整个日志文件
+func (this *storage) rewriteLog(entries []*Entry) error {
+	path := filepath.Join(this.dir, "log.jsonl")
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		if _, err = file.Write(append(line, '\n')); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	file.Close()
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if err = syncDir(this.dir); err != nil {
+		return err
+	}
+	this.log.Close()
+	this.log, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+func (this *storage) close() error {
+	return this.log.Close()
+}
+
+func (this *storage) loadJSON(name string, v interface{}) error {
+	content, err := ioutil.ReadFile(filepath.Join(this.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+// 先写临时文件并同步，再改名，避免崩溃时损坏
+func (this *storage) saveJSON(name string, v interface{}) error {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(this.dir, name)
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(content); err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(this.dir)
+}
+
+// 改名后同步目录，保证新文件名已写入磁盘
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,74 @@
+package raft
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStorageReloadsLogAndState(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.saveState(&persistentState{Term: 3, VotedFor: "a:1"}); err != nil {
+		t.Fatal(err)
+	}
+	entries := []*Entry{{Term: 1, Index: 1, Op: "x"}, {Term: 2, Index: 2, Op: "y"}}
+	if err = s.appendLog(entries); err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+
+	// 崩溃时写了一半的最后一行
+	file, err := os.OpenFile(filepath.Join(dir, "log.jsonl"), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"Term":2,"Ind`)
+	file.Close()
+
+	s, err = openStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	state, err := s.loadState()
+	if err != nil || state.Term != 3 || state.VotedFor != "a:1" {
+		t.Fatalf("unexpected state %+v %v", state, err)
+	}
+	loaded, err := s.loadLog(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 2 || loaded[1].Op != "y" {
+		t.Fatalf("expected 2 entries, got %d", len(loaded))
+	}
+}
+
+func TestStorageSkipsEntriesCoveredBySnapshot(t *testing.T) {
+	s, err := openStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	s.appendLog([]*Entry{{Term: 1, Index: 1}, {Term: 1, Index: 2}, {Term: 1, Index: 3}, {Term: 2, Index: 4}})
+	entries, err := s.loadLog(2, 1)
+	if err != nil || len(entries) != 2 || entries[0].Index != 3 {
+		t.Fatalf("expected entries after the snapshot, got %v %v", entries, err)
+	}
+	// 安装快照后未重写的旧日志任期早于快照
+	if entries, _ = s.loadLog(2, 3); len(entries) != 0 {
+		t.Fatalf("expected stale entries to be dropped, got %d", len(entries))
+	}
+
+	if err = s.rewriteLog([]*Entry{{Term: 2, Index: 4}}); err != nil {
+		t.Fatal(err)
+	}
+	s.appendLog([]*Entry{{Term: 2, Index: 5}})
+	if entries, _ = s.loadLog(3, 1); len(entries) != 2 || entries[1].Index != 5 {
+		t.Fatalf("expected rewritten log to be appendable, got %v", entries)
+	}
+}
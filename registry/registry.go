@@ -2,21 +2,40 @@ package registry
 
 import (
 	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/hugb/beegecluster/logging"
 	"github.com/hugb/beegecluster/resource"
 )
 
+var logger = logging.Logger("registry")
+
 type Registry struct {
 	sync.RWMutex
 
 	images     map[string]*resource.Image
 	containers map[string]*resource.Container
+	execs      map[string]*resource.Exec
+	// 同一镜像可能存在于多台主机
+	imageHosts map[string]map[string]bool
+	// 通过controller创建的容器所属的租户，docker全量上报时保留仍存在的容器
+	owners map[string]*resource.Container
+	// 从快照恢复、尚未重新连接的主机，其镜像和容器只在没有其他选择时使用
+	staleHosts map[string]bool
 }
 
+// 刚创建的容器可能不在此前开始的全量上报中，记录租户后这段时间内不清除
+const ownerGracePeriod = time.Minute
+
 var RegistryServer = &Registry{
 	images:     make(map[string]*resource.Image),
 	containers: make(map[string]*resource.Container),
+	execs:      make(map[string]*resource.Exec),
+	imageHosts: make(map[string]map[string]bool),
+	owners:     make(map[string]*resource.Container),
+	staleHosts: make(map[string]bool),
 }
 
 func (this *Registry) RegisterImage(id string, image *resource.Image) {
@@ -24,6 +43,10 @@ func (this *Registry) RegisterImage(id string, image *resource.Image) {
 	defer this.Unlock()
 
 	this.images[id] = image
+	if this.imageHosts[id] == nil {
+		this.imageHosts[id] = make(map[string]bool)
+	}
+	this.imageHosts[id][image.Host] = true
 }
 
 func (this *Registry) UnregisterImage(id string) {
@@ -31,15 +54,59 @@ func (this *Registry) UnregisterImage(id string) {
 	defer this.Unlock()
 
 	delete(this.images, id)
+	delete(this.imageHosts, id)
+}
+
+// 删除某台主机上的镜像，其他主机上仍有该镜像时保留
+func (this *Registry) UnregisterImageFromHost(id, host string) {
+	this.Lock()
+	defer this.Unlock()
+
+	this.removeImageHost(id, host)
+}
+
+// 删除某台主机上的所有镜像
+func (this *Registry) UnregisterImagesByHost(host string) {
+	this.Lock()
+	defer this.Unlock()
+
+	for id, hosts := range this.imageHosts {
+		if hosts[host] {
+			this.removeImageHost(id, host)
+		}
+	}
+}
+
+// 调用时需持有锁
+func (this *Registry) removeImageHost(id, host string) {
+	hosts := this.imageHosts[id]
+	delete(hosts, host)
+	if len(hosts) == 0 {
+		delete(this.images, id)
+		delete(this.imageHosts, id)
+		return
+	}
+	// 记录的主机被删除，改为其他仍有该镜像的主机
+	if image, ok := this.images[id]; ok && image.Host == host {
+		copied := *image
+		for other := range hosts {
+			copied.Host = other
+			break
+		}
+		this.images[id] = &copied
+	}
 }
 
+// 所有已确认的镜像，过期主机上的镜像不列出
 func (this *Registry) GetAllImages() resource.ImageArray {
 	this.RLock()
 	defer this.RUnlock()
 
 	var images resource.ImageArray
 	for _, value := range this.images {
-		images = append(images, value)
+		if !value.Stale {
+			images = append(images, value)
+		}
 	}
 
 	sort.Sort(images)
@@ -55,36 +122,191 @@ func (this *Registry) LookupImage(id string) (*resource.Image, bool) {
 	return image, ok
 }
 
+// 将镜像名解析为ID，名称没有标签时按latest查找，找不到时返回空
+func (this *Registry) ResolveImage(name string) string {
+	this.RLock()
+	defer this.RUnlock()
+
+	if _, ok := this.images[name]; ok {
+		return name
+	}
+	tagged := name
+	if strings.LastIndex(name, ":") <= strings.LastIndex(name, "/") {
+		tagged += ":latest"
+	}
+	for id, image := range this.images {
+		for _, tag := range image.RepoTags {
+			if tag == tagged {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+// 存有镜像的主机，优先选择已确认的主机
 func (this *Registry) GetHostByImageId(id string) string {
-	if image, ok := this.LookupImage(id); ok {
-		return image.Host
-	} else {
-		return ""
+	if hosts := this.GetHostsByImageId(id); len(hosts) > 0 {
+		return hosts[0]
 	}
+	return ""
+}
+
+// 获取所有存有该镜像的主机，记录的主机排在最前，过期的主机排在最后
+func (this *Registry) GetHostsByImageId(id string) []string {
+	this.RLock()
+	defer this.RUnlock()
+
+	image, ok := this.images[id]
+	if !ok {
+		return nil
+	}
+	var others []string
+	for host := range this.imageHosts[id] {
+		if host != image.Host {
+			others = append(others, host)
+		}
+	}
+	sort.Strings(others)
+	hosts := append([]string{image.Host}, others...)
+	sort.SliceStable(hosts, func(i, j int) bool {
+		return !this.staleHosts[hosts[i]] && this.staleHosts[hosts[j]]
+	})
+	return hosts
 }
 
 func (this *Registry) RegisterContainer(id string, container *resource.Container) {
 	this.Lock()
 	defer this.Unlock()
 
+	this.registerContainer(id, container)
+}
+
+// 调用时需持有锁
+func (this *Registry) registerContainer(id string, container *resource.Container) {
+	container.Id = id
+	if owner, ok := this.owners[id]; ok && container.Tenant == "" {
+		container.Tenant, container.Memory = owner.Tenant, owner.Memory
+	} else if container.Tenant != "" {
+		this.owners[id] = &resource.Container{Host: container.Host, Tenant: container.Tenant, Memory: container.Memory}
+	}
 	this.containers[id] = container
 	this.containers[id[0:12]] = container
 }
 
+// 记录容器所属的租户，docker上报的创建事件可能在此之前或之后到达
+func (this *Registry) SetContainerOwner(id, host, tenant string, memory int64) {
+	this.Lock()
+	defer this.Unlock()
+
+	this.owners[id] = &resource.Container{Host: host, Tenant: tenant, Memory: memory, Created: time.Now().Unix()}
+	logger.Debug("Set container owner", "container", id, "node", host, "tenant", tenant, "memory", memory)
+	// 替换为副本，已经取得的容器信息不会被并发修改
+	if container, ok := this.containers[id]; ok {
+		copied := *container
+		copied.Tenant, copied.Memory = tenant, memory
+		this.containers[id] = &copied
+		this.containers[id[0:12]] = &copied
+	}
+}
+
+// 删除租户记录，用于释放创建失败的容器预留的配额
+func (this *Registry) ReleaseContainerOwner(id string) {
+	this.Lock()
+	defer this.Unlock()
+
+	delete(this.owners, id)
+}
+
+// 租户拥有的容器数和内存限制总和
+func (this *Registry) TenantUsage(tenant string) (int, int64) {
+	this.RLock()
+	defer this.RUnlock()
+
+	var (
+		count  int
+		memory int64
+	)
+	for _, owner := range this.owners {
+		if owner.Tenant == tenant {
+			count++
+			memory += owner.Memory
+		}
+	}
+	return count, memory
+}
+
 func (this *Registry) UnregisterContainer(id string) {
 	this.Lock()
 	defer this.Unlock()
 
 	delete(this.containers, id)
+	delete(this.owners, id)
+	if len(id) > 12 {
+		delete(this.containers, id[0:12])
+	}
+	// 容器删除后其exec实例也不再可用
+	for execId, exec := range this.execs {
+		if exec.Container == id || (len(id) > 12 && exec.Container == id[0:12]) {
+			delete(this.execs, execId)
+		}
+	}
+}
+
+// 节点被移出集群，删除其上的所有容器及租户记录
+func (this *Registry) UnregisterContainersByHost(host string) {
+	this.Lock()
+	defer this.Unlock()
+
+	this.removeContainersByHost(host)
+	for id, owner := range this.owners {
+		if owner.Host == host {
+			delete(this.owners, id)
+		}
+	}
+	logger.Debug("Unregister containers", "node", host)
+}
+
+// docker全量上报的容器替换该主机原有的容器，已不存在的容器的租户记录一并清除
+func (this *Registry) SyncContainersByHost(host string, containers map[string]*resource.Container) {
+	this.Lock()
+	defer this.Unlock()
+
+	this.removeContainersByHost(host)
+	deadline := time.Now().Add(-ownerGracePeriod).Unix()
+	for id, owner := range this.owners {
+		if _, exists := containers[id]; !exists && owner.Host == host && owner.Created < deadline {
+			delete(this.owners, id)
+		}
+	}
+	for id, container := range containers {
+		this.registerContainer(id, container)
+	}
+	logger.Debug("Sync containers", "node", host, "count", len(containers))
 }
 
+// 调用时需持有锁
+func (this *Registry) removeContainersByHost(host string) {
+	for id, container := range this.containers {
+		if container.Host == host {
+			delete(this.containers, id)
+		}
+	}
+	for id, exec := range this.execs {
+		if exec.Host == host {
+			delete(this.execs, id)
+		}
+	}
+}
+
+// 所有已确认的容器，过期主机上的容器不列出
 func (this *Registry) GetAllContainers() resource.ContainerArray {
 	this.RLock()
 	defer this.RUnlock()
 
 	var containers resource.ContainerArray
 	for index, value := range this.containers {
-		if len(index) == 12 {
+		if len(index) == 12 && !value.Stale {
 			containers = append(containers, value)
 		}
 	}
@@ -94,6 +316,34 @@ func (this *Registry) GetAllContainers() resource.ContainerArray {
 	return containers
 }
 
+// 各主机上的镜像数
+func (this *Registry) CountImagesByHost() map[string]int {
+	this.RLock()
+	defer this.RUnlock()
+
+	counts := make(map[string]int)
+	for _, hosts := range this.imageHosts {
+		for host := range hosts {
+			counts[host]++
+		}
+	}
+	return counts
+}
+
+// 各主机上的容器数
+func (this *Registry) CountContainersByHost() map[string]int {
+	this.RLock()
+	defer this.RUnlock()
+
+	counts := make(map[string]int)
+	for id, container := range this.containers {
+		if len(id) != 12 {
+			counts[container.Host]++
+		}
+	}
+	return counts
+}
+
 // 根据容器ID得到容器信息
 func (this *Registry) LookupContainer(id string) (*resource.Container, bool) {
 	this.RLock()
@@ -111,3 +361,114 @@ func (this *Registry) GetHostByContainerId(id string) string {
 		return ""
 	}
 }
+
+func (this *Registry) RegisterExec(id string, exec *resource.Exec) {
+	this.Lock()
+	defer this.Unlock()
+
+	this.execs[id] = exec
+}
+
+func (this *Registry) UnregisterExec(id string) {
+	this.Lock()
+	defer this.Unlock()
+
+	delete(this.execs, id)
+}
+
+func (this *Registry) LookupExec(id string) (*resource.Exec, bool) {
+	this.RLock()
+	defer this.RUnlock()
+
+	exec, ok := this.execs[id]
+	return exec, ok
+}
+
+// 导出所有镜像和容器，容器只保留完整ID
+func (this *Registry) Snapshot() (map[string]*resource.Image, map[string]*resource.Container) {
+	this.RLock()
+	defer this.RUnlock()
+
+	images := make(map[string]*resource.Image)
+	for id, image := range this.images {
+		copied := *image
+		images[id] = &copied
+	}
+	containers := make(map[string]*resource.Container)
+	for id, container := range this.containers {
+		if len(id) != 12 {
+			copied := *container
+			containers[id] = &copied
+		}
+	}
+	return images, containers
+}
+
+// 从快照恢复，恢复的数据标记为过期，直到docker重新上报
+func (this *Registry) Restore(images map[string]*resource.Image, containers map[string]*resource.Container) {
+	for id, image := range images {
+		image.Stale = true
+		this.RegisterImage(id, image)
+		this.markStale(image.Host)
+	}
+	for id, container := range containers {
+		if len(id) < 12 {
+			continue
+		}
+		container.Stale = true
+		this.RegisterContainer(id, container)
+		this.markStale(container.Host)
+	}
+	logger.Debug("Restore registry", "images", len(images), "containers", len(containers))
+}
+
+func (this *Registry) markStale(host string) {
+	this.Lock()
+	defer this.Unlock()
+
+	this.staleHosts[host] = true
+}
+
+// 清除仍未重新连接的主机上的镜像、容器和租户记录，返回这些主机
+func (this *Registry) ExpireStale() []string {
+	this.Lock()
+	defer this.Unlock()
+
+	var hosts []string
+	for host := range this.staleHosts {
+		for id, hostSet := range this.imageHosts {
+			if hostSet[host] {
+				this.removeImageHost(id, host)
+			}
+		}
+		this.removeContainersByHost(host)
+		for id, owner := range this.owners {
+			if owner.Host == host {
+				delete(this.owners, id)
+			}
+		}
+		hosts = append(hosts, host)
+	}
+	this.staleHosts = make(map[string]bool)
+	sort.Strings(hosts)
+	return hosts
+}
+
+// docker重新连接，其上的镜像和容器已经确认
+func (this *Registry) ConfirmHost(host string) {
+	this.Lock()
+	defer this.Unlock()
+
+	delete(this.staleHosts, host)
+	for _, image := range this.images {
+		if image.Host == host {
+			image.Stale = false
+		}
+	}
+	for _, container := range this.containers {
+		if container.Host == host {
+			container.Stale = false
+		}
+	}
+	logger.Debug("Confirm registry", "node", host)
+}
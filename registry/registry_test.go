@@ -0,0 +1,118 @@
+package registry
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hugb/beegecluster/resource"
+)
+
+func newTestRegistry() *Registry {
+	return &Registry{
+		images:     make(map[string]*resource.Image),
+		containers: make(map[string]*resource.Container),
+		execs:      make(map[string]*resource.Exec),
+		imageHosts: make(map[string]map[string]bool),
+		owners:     make(map[string]*resource.Container),
+		staleHosts: make(map[string]bool),
+	}
+}
+
+func containerId(c string) string {
+	return strings.Repeat(c, 64)
+}
+
+func TestSyncKeepsOwnersOfReportedContainers(t *testing.T) {
+	r := newTestRegistry()
+	a, b := containerId("a"), containerId("b")
+	r.SetContainerOwner(a, "h1:4243", "t1", 100)
+	r.SetContainerOwner(b, "h1:4243", "t1", 200)
+	// 超过宽限期的记录
+	for _, owner := range r.owners {
+		owner.Created = time.Now().Add(-2 * ownerGracePeriod).Unix()
+	}
+
+	r.SyncContainersByHost("h1:4243", map[string]*resource.Container{a: {Host: "h1:4243"}})
+	if count, memory := r.TenantUsage("t1"); count != 1 || memory != 100 {
+		t.Fatalf("expected owner of removed container to be pruned, got %d %d", count, memory)
+	}
+	if container, ok := r.LookupContainer(a[:12]); !ok || container.Tenant != "t1" {
+		t.Fatalf("expected resynced container to keep its tenant, got %v", container)
+	}
+}
+
+func TestSyncKeepsRecentOwners(t *testing.T) {
+	r := newTestRegistry()
+	a := containerId("a")
+	// 创建后docker的全量上报还未包含该容器
+	r.SetContainerOwner(a, "h1:4243", "t1", 100)
+	r.SyncContainersByHost("h1:4243", map[string]*resource.Container{})
+	if count, _ := r.TenantUsage("t1"); count != 1 {
+		t.Fatal("expected recently created owner to be kept")
+	}
+}
+
+func TestUnregisterHostDropsOwners(t *testing.T) {
+	r := newTestRegistry()
+	a, b := containerId("a"), containerId("b")
+	r.RegisterContainer(a, &resource.Container{Host: "h1:4243", Tenant: "t1", Memory: 100})
+	r.RegisterContainer(b, &resource.Container{Host: "h2:4243", Tenant: "t1", Memory: 200})
+
+	r.UnregisterContainersByHost("h1:4243")
+	if count, memory := r.TenantUsage("t1"); count != 1 || memory != 200 {
+		t.Fatalf("expected only the other host's owner to remain, got %d %d", count, memory)
+	}
+	if _, ok := r.LookupContainer(a); ok {
+		t.Fatal("expected container to be unregistered")
+	}
+}
+
+func TestStaleHostsAreDeprioritised(t *testing.T) {
+	r := newTestRegistry()
+	a := containerId("a")
+	r.Restore(map[string]*resource.Image{"img": {Host: "h1:4243"}},
+		map[string]*resource.Container{a: {Host: "h1:4243"}})
+
+	if len(r.GetAllImages()) != 0 || len(r.GetAllContainers()) != 0 {
+		t.Fatal("expected restored entries to be hidden until confirmed")
+	}
+	// 已确认的主机也有该镜像时优先选择
+	r.RegisterImage("img", &resource.Image{Host: "h2:4243"})
+	r.imageHosts["img"]["h1:4243"] = true
+	r.images["img"].Host = "h1:4243"
+	if hosts := r.GetHostsByImageId("img"); len(hosts) != 2 || hosts[0] != "h2:4243" {
+		t.Fatalf("expected confirmed host first, got %v", hosts)
+	}
+	if host := r.GetHostByImageId("img"); host != "h2:4243" {
+		t.Fatalf("expected confirmed host, got %s", host)
+	}
+
+	r.ConfirmHost("h1:4243")
+	if len(r.GetAllContainers()) != 1 {
+		t.Fatal("expected confirmed containers to be listed")
+	}
+}
+
+func TestExpireStaleDropsUnconfirmedHosts(t *testing.T) {
+	r := newTestRegistry()
+	a, b := containerId("a"), containerId("b")
+	r.Restore(map[string]*resource.Image{"img": {Host: "h1:4243"}}, map[string]*resource.Container{
+		a: {Host: "h1:4243", Tenant: "t1", Memory: 100},
+		b: {Host: "h2:4243", Tenant: "t1", Memory: 200},
+	})
+	r.ConfirmHost("h2:4243")
+
+	if hosts := r.ExpireStale(); len(hosts) != 1 || hosts[0] != "h1:4243" {
+		t.Fatalf("expected h1 to expire, got %v", hosts)
+	}
+	if _, ok := r.LookupImage("img"); ok {
+		t.Fatal("expected images of expired host to be removed")
+	}
+	if _, ok := r.LookupContainer(a); ok {
+		t.Fatal("expected containers of expired host to be removed")
+	}
+	if count, memory := r.TenantUsage("t1"); count != 1 || memory != 200 {
+		t.Fatalf("expected owners of expired host to be removed, got %d %d", count, memory)
+	}
+}
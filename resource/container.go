@@ -3,8 +3,14 @@ package resource
 import ()
 
 type Container struct {
+	Id      string `json:",omitempty"`
 	Host    string
 	Created int64
+	// 通过controller创建的容器所属的租户和内存限制
+	Tenant string `json:",omitempty"`
+	Memory int64  `json:",omitempty"`
+	// 从快照恢复，尚未得到docker确认
+	Stale bool `json:",omitempty"`
 }
 
 type ContainerArray []*Container
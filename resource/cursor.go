@@ -0,0 +1,11 @@
+package resource
+
+import ()
+
+// controller记录的docker已处理到的事件位置
+type EventCursor struct {
+	Epoch int64
+	Seq   uint64
+	// 已向docker请求补发，等待补发的事件到达
+	Replaying bool `json:"-"`
+}
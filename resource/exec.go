@@ -0,0 +1,9 @@
+package resource
+
+import ()
+
+// 在容器中创建的exec实例，start时需代理到创建它的docker
+type Exec struct {
+	Container string
+	Host      string
+}
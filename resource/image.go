@@ -3,8 +3,11 @@ package resource
 import ()
 
 type Image struct {
-	Host    string
-	Created int64
+	Host     string
+	Created  int64
+	RepoTags []string `json:",omitempty"`
+	// 从快照恢复，尚未得到docker确认
+	Stale bool `json:",omitempty"`
 }
 
 type ImageArray []*Image
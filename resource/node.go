@@ -0,0 +1,42 @@
+package resource
+
+import (
+	"github.com/hugb/beegecluster/utils"
+)
+
+// 集群成员
+type Node struct {
+	Id      string
+	Role    string
+	Address string
+	Labels  map[string]string
+	// online、stale(从快照恢复尚未确认)、suspect或offline
+	State string
+	// docker的调度状态，cordoned、draining或drained
+	Schedule string `json:",omitempty"`
+	Leader   bool   `json:",omitempty"`
+
+	LastHeartbeat int64
+	SystemInfo    *utils.SystemInfo `json:",omitempty"`
+	Version       *Version          `json:",omitempty"`
+
+	Containers int
+	Images     int
+}
+
+type NodeArray []*Node
+
+func (this NodeArray) Len() int {
+	return len(this)
+}
+
+func (this NodeArray) Less(i, j int) bool {
+	if this[i].Role != this[j].Role {
+		return this[i].Role > this[j].Role
+	}
+	return this[i].Address < this[j].Address
+}
+
+func (this NodeArray) Swap(i, j int) {
+	this[i], this[j] = this[j], this[i]
+}
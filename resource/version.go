@@ -0,0 +1,16 @@
+package resource
+
+import ()
+
+// docker或controller的版本信息
+type Version struct {
+	Version       string
+	ApiVersion    string
+	MinAPIVersion string   `json:",omitempty"`
+	GitCommit     string   `json:",omitempty"`
+	GoVersion     string   `json:",omitempty"`
+	Os            string   `json:",omitempty"`
+	Arch          string   `json:",omitempty"`
+	KernelVersion string   `json:",omitempty"`
+	Warnings      []string `json:",omitempty"`
+}
@@ -0,0 +1,52 @@
+package scheduler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/hugb/beegecluster/utils"
+)
+
+var client = &http.Client{
+	Timeout:   60 * time.Second,
+	Transport: &http.Transport{TLSClientConfig: utils.ClientTLSConfig()},
+}
+
+// 调用docker的远程api，result不为nil时解析响应
+func dockerRequest(host, method, path string, body, result interface{}) error {
+	var reader *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	request, err := http.NewRequest(method, utils.DockerURL(host, path), reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 && response.StatusCode != http.StatusNotModified {
+		message, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("%s %s on %s: %s %s", method, path, host, response.Status, bytes.TrimSpace(message))
+	}
+	if result != nil {
+		return json.NewDecoder(response.Body).Decode(result)
+	}
+	return nil
+}
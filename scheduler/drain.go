@@ -0,0 +1,137 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/trace"
+)
+
+const (
+	// 停止docker上的容器
+	DrainStop = "stop"
+	// 在其他docker上重建可迁移的容器后删除原容器，其他容器保持不变
+	DrainReschedule = "reschedule"
+)
+
+// docker上查询到的容器配置
+type containerInfo struct {
+	Name string
+	// 镜像ID，Config.Image为创建时使用的镜像名
+	Image      string
+	Config     map[string]interface{}
+	HostConfig json.RawMessage
+}
+
+// 带有迁移标签或总是重启的容器才迁移，其余容器可能依赖本机的数据
+func (this *containerInfo) reschedulable() bool {
+	if labels, ok := this.Config["Labels"].(map[string]interface{}); ok && labels[config.RescheduleLabel] == "true" {
+		return true
+	}
+	var hostConfig struct {
+		RestartPolicy struct {
+			Name string
+		}
+	}
+	if len(this.HostConfig) > 0 && json.Unmarshal(this.HostConfig, &hostConfig) == nil {
+		return hostConfig.RestartPolicy.Name == "always"
+	}
+	return false
+}
+
+// 停止调度并迁走docker上运行的容器，迁移在后台进行
+func Drain(ctx context.Context, address, policy string) error {
+	if policy == "" {
+		policy = DrainStop
+	}
+	if policy != DrainStop && policy != DrainReschedule {
+		return fmt.Errorf("Bad parameter: unknown drain policy %s", policy)
+	}
+	if err := SetState(ctx, address, config.DockerDraining); err != nil {
+		return err
+	}
+	// 迁移在请求结束后进行，只保留请求id
+	go drain(trace.WithRequestId(context.Background(), trace.RequestId(ctx)), address, policy)
+	return nil
+}
+
+func drain(ctx context.Context, address, policy string) {
+	logger.Info("Drain docker", "node", address, "policy", policy, "request_id", trace.RequestId(ctx))
+
+	var containers []struct {
+		Id string
+	}
+	if err := dockerRequest(address, "GET", "/containers/json", nil, &containers); err != nil {
+		logger.Error("Drain error", "node", address, "error", err)
+		return
+	}
+	for _, container := range containers {
+		var err error
+		if policy == DrainReschedule {
+			err = reschedule(address, container.Id)
+		} else {
+			err = dockerRequest(address, "POST", "/containers/"+container.Id+"/stop?t=10", nil, nil)
+		}
+		if err != nil {
+			logger.Error("Drain container error", "node", address, "container", container.Id, "error", err)
+		}
+	}
+
+	if err := SetState(ctx, address, config.DockerDrained); err != nil {
+		logger.Error("Set drained error", "node", address, "error", err)
+	}
+	logger.Info("Drain finish", "node", address, "containers", len(containers), "request_id", trace.RequestId(ctx))
+}
+
+// 按原配置在其他docker上创建并启动容器，成功后删除原容器
+func reschedule(address, id string) error {
+	container := &containerInfo{}
+	if err := dockerRequest(address, "GET", "/containers/"+id+"/json", nil, container); err != nil {
+		return err
+	}
+	if !container.reschedulable() {
+		logger.Warn("Container is not reschedulable, skip it", "node", address, "container", id)
+		return nil
+	}
+	image, _ := container.Config["Image"].(string)
+	// 按镜像ID选择已有该镜像的主机
+	selector := container.Image
+	if selector == "" {
+		selector = image
+	}
+	host, err := SelectHost(selector, address)
+	if err != nil {
+		return err
+	}
+
+	// 目标主机上可能没有镜像，先拉取
+	if image != "" {
+		if err = dockerRequest(host, "POST", "/images/create?fromImage="+url.QueryEscape(image), nil, nil); err != nil {
+			logger.Warn("Pull image error", "node", host, "image", image, "error", err)
+		}
+	}
+
+	var created struct {
+		Id string
+	}
+	path := "/containers/create"
+	if name := strings.TrimPrefix(container.Name, "/"); name != "" {
+		path += "?name=" + url.QueryEscape(name)
+	}
+	if err = dockerRequest(host, "POST", path, container.Config, &created); err != nil {
+		return err
+	}
+	if err = dockerRequest(host, "POST", "/containers/"+created.Id+"/start", container.HostConfig, nil); err != nil {
+		return err
+	}
+	logger.Info("Container rescheduled", "container", id, "from", address, "to", host, "new", created.Id)
+
+	if err = dockerRequest(address, "POST", "/containers/"+id+"/stop?t=10", nil, nil); err != nil {
+		return err
+	}
+	return dockerRequest(address, "DELETE", "/containers/"+id, nil, nil)
+}
@@ -0,0 +1,129 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/registry"
+	"github.com/hugb/beegecluster/resource"
+)
+
+// 记录收到的请求的docker
+type fakeDocker struct {
+	sync.Mutex
+	server     *httptest.Server
+	requests   []string
+	containers map[string]interface{}
+}
+
+func newFakeDocker(t *testing.T, containers map[string]interface{}) *fakeDocker {
+	d := &fakeDocker{containers: containers}
+	d.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.Lock()
+		d.requests = append(d.requests, r.Method+" "+r.URL.Path)
+		d.Unlock()
+		switch {
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/json"):
+			id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/containers/"), "/json")
+			if container, ok := d.containers[id]; ok {
+				json.NewEncoder(w).Encode(container)
+			} else {
+				http.NotFound(w, r)
+			}
+		case r.URL.Path == "/containers/create":
+			json.NewEncoder(w).Encode(map[string]string{"Id": "new"})
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	t.Cleanup(d.server.Close)
+	return d
+}
+
+func (this *fakeDocker) address() string {
+	return strings.TrimPrefix(this.server.URL, "http://")
+}
+
+func (this *fakeDocker) received(request string) bool {
+	this.Lock()
+	defer this.Unlock()
+
+	for _, r := range this.requests {
+		if r == request {
+			return true
+		}
+	}
+	return false
+}
+
+func setDockers(t *testing.T, addresses ...string) {
+	config.NodesLock.Lock()
+	previous := config.Dockers
+	config.Dockers = make(map[string]int64)
+	for _, address := range addresses {
+		config.Dockers[address] = 1
+	}
+	config.NodesLock.Unlock()
+	t.Cleanup(func() {
+		config.NodesLock.Lock()
+		config.Dockers = previous
+		config.NodesLock.Unlock()
+	})
+}
+
+func TestSelectHostResolvesImageName(t *testing.T) {
+	setDockers(t, "h1:4243", "h2:4243", "h3:4243")
+	registry.RegistryServer.RegisterImage("img-busybox", &resource.Image{Host: "h1:4243", RepoTags: []string{"busybox:latest"}})
+	registry.RegistryServer.RegisterImage("img-busybox", &resource.Image{Host: "h2:4243", RepoTags: []string{"busybox:latest"}})
+	defer registry.RegistryServer.UnregisterImage("img-busybox")
+
+	for _, image := range []string{"busybox", "busybox:latest", "img-busybox"} {
+		host, err := SelectHost(image, "h2:4243")
+		if err != nil || host != "h1:4243" {
+			t.Fatalf("expected %s to select the other host with the image, got %s %v", image, host, err)
+		}
+	}
+}
+
+func TestRescheduleOnlyMovesOptedInContainers(t *testing.T) {
+	source := newFakeDocker(t, map[string]interface{}{
+		"labelled": map[string]interface{}{
+			"Image":  "img-app",
+			"Config": map[string]interface{}{"Image": "app", "Labels": map[string]string{config.RescheduleLabel: "true"}},
+		},
+		"always": map[string]interface{}{
+			"Image":      "img-app",
+			"Config":     map[string]interface{}{"Image": "app"},
+			"HostConfig": map[string]interface{}{"RestartPolicy": map[string]string{"Name": "always"}},
+		},
+		"local": map[string]interface{}{
+			"Image":  "img-app",
+			"Config": map[string]interface{}{"Image": "app"},
+		},
+	})
+	target := newFakeDocker(t, nil)
+	other := newFakeDocker(t, nil)
+	setDockers(t, source.address(), target.address(), other.address())
+	registry.RegistryServer.RegisterImage("img-app", &resource.Image{Host: target.address()})
+	defer registry.RegistryServer.UnregisterImage("img-app")
+
+	for _, id := range []string{"labelled", "always", "local"} {
+		if err := reschedule(source.address(), id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !source.received("DELETE /containers/labelled") || !source.received("DELETE /containers/always") {
+		t.Fatal("expected opted-in containers to be removed from the drained docker")
+	}
+	if source.received("DELETE /containers/local") || source.received("POST /containers/local/stop") {
+		t.Fatal("expected container without opt-in to be left alone")
+	}
+	if !target.received("POST /containers/create") || other.received("POST /containers/create") {
+		t.Fatal("expected containers to be created on the docker that has the image")
+	}
+}
@@ -0,0 +1,91 @@
+////////////////////////////////////////////////////////////
+/*          容器调度，选择docker以及维护docker的调度状态          */
+////////////////////////////////////////////////////////////
+
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/logging"
+	"github.com/hugb/beegecluster/raft"
+	"github.com/hugb/beegecluster/registry"
+)
+
+var logger = logging.Logger("scheduler")
+
+// docker是否在线且可以调度
+func Schedulable(address string) bool {
+	config.NodesLock.RLock()
+	defer config.NodesLock.RUnlock()
+
+	_, online := config.Dockers[address]
+	return online && config.DockerStates[address] == ""
+}
+
+// 为镜像选择一台docker，优先选择已有该镜像的主机，否则按调度策略选择
+// 容器最少或最多的主机；image可以是镜像ID或名称
+func SelectHost(image string, exclude ...string) (string, error) {
+	excluded := make(map[string]bool)
+	for _, address := range exclude {
+		excluded[address] = true
+	}
+
+	config.NodesLock.RLock()
+	var candidates []string
+	for address := range config.Dockers {
+		if config.DockerStates[address] == "" && !excluded[address] {
+			candidates = append(candidates, address)
+		}
+	}
+	config.NodesLock.RUnlock()
+
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("Impossible to schedule: no docker available")
+	}
+
+	if id := registry.RegistryServer.ResolveImage(image); id != "" {
+		for _, host := range registry.RegistryServer.GetHostsByImageId(id) {
+			for _, address := range candidates {
+				if address == host {
+					return host, nil
+				}
+			}
+		}
+	}
+
+	counts := registry.RegistryServer.CountContainersByHost()
+	binpack := config.Get().Scheduler.Strategy == config.StrategyBinpack
+	sort.Strings(candidates)
+	selected := candidates[0]
+	for _, address := range candidates[1:] {
+		if binpack && counts[address] > counts[selected] || !binpack && counts[address] < counts[selected] {
+			selected = address
+		}
+	}
+	return selected, nil
+}
+
+// 修改docker的调度状态，由leader提交后在所有controller生效
+func SetState(ctx context.Context, address, state string) error {
+	config.NodesLock.RLock()
+	_, online := config.Dockers[address]
+	_, stale := config.StaleDockers[address]
+	config.NodesLock.RUnlock()
+
+	if !online && !stale {
+		return fmt.Errorf("No such node: %s", address)
+	}
+	return raft.ProposeContext(ctx, "docker_state", fmt.Sprintf("%s %s", address, state))
+}
+
+func Cordon(ctx context.Context, address string) error {
+	return SetState(ctx, address, config.DockerCordoned)
+}
+
+func Uncordon(ctx context.Context, address string) error {
+	return SetState(ctx, address, "")
+}
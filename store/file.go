@@ -0,0 +1,51 @@
+package store
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func init() {
+	Register("file", NewFileStore)
+}
+
+// 以json文件保存快照，先写临时文件再改名，避免写到一半时崩溃损坏快照
+type FileStore struct {
+	path string
+}
+
+func NewFileStore(path string) (Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return &FileStore{path: path}, nil
+}
+
+func (this *FileStore) Save(state *State) error {
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := this.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, this.path)
+}
+
+func (this *FileStore) Load() (*State, error) {
+	content, err := ioutil.ReadFile(this.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &State{}
+	if err = json.Unmarshal(content, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
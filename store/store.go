@@ -0,0 +1,72 @@
+////////////////////////////////////////////////////////////
+/*     controller状态存储，重启后从快照恢复集群结构和注册表     */
+////////////////////////////////////////////////////////////
+
+package store
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/hugb/beegecluster/resource"
+)
+
+// 集群状态快照
+type State struct {
+	// 快照时间
+	Time int64
+
+	Dockers     map[string]int64
+	Controllers map[string]int64
+
+	Images     map[string]*resource.Image
+	Containers map[string]*resource.Container
+
+	// 调度相关的元数据，如各docker已处理到的事件位置和调度状态
+	Cursors      map[string]*resource.EventCursor
+	DockerStates map[string]string
+}
+
+type Store interface {
+	Save(state *State) error
+	// 没有快照时返回nil
+	Load() (*State, error)
+}
+
+// 根据地址创建存储，如file:///var/lib/beegecluster/state.json
+type Driver func(path string) (Store, error)
+
+var drivers = struct {
+	sync.RWMutex
+	m map[string]Driver
+}{m: make(map[string]Driver)}
+
+// 注册存储驱动
+func Register(scheme string, driver Driver) error {
+	drivers.Lock()
+	defer drivers.Unlock()
+
+	if _, exists := drivers.m[scheme]; exists {
+		return fmt.Errorf("Can't overwrite store driver %s", scheme)
+	}
+	drivers.m[scheme] = driver
+	return nil
+}
+
+// 打开存储，没有指定scheme时使用文件存储
+func Open(address string) (Store, error) {
+	scheme, path := "file", address
+	if parts := strings.SplitN(address, "://", 2); len(parts) == 2 {
+		scheme, path = parts[0], parts[1]
+	}
+
+	drivers.RLock()
+	driver, exists := drivers.m[scheme]
+	drivers.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("No such store driver: %s", scheme)
+	}
+	return driver(path)
+}
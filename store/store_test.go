@@ -0,0 +1,63 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hugb/beegecluster/resource"
+)
+
+func TestFileStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "state.json")
+	s, err := Open("file://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 没有快照时返回nil
+	if state, err := s.Load(); state != nil || err != nil {
+		t.Fatalf("expected no state, got %+v %v", state, err)
+	}
+
+	err = s.Save(&State{
+		Time:       100,
+		Dockers:    map[string]int64{"h1:4243": 1},
+		Images:     map[string]*resource.Image{"img": {Host: "h1:4243", RepoTags: []string{"busybox:latest"}}},
+		Cursors:    map[string]*resource.EventCursor{"h1:4243": {Epoch: 2, Seq: 3}},
+		Containers: map[string]*resource.Container{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("expected temporary file to be renamed")
+	}
+	state, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Time != 100 || state.Dockers["h1:4243"] != 1 || state.Images["img"].RepoTags[0] != "busybox:latest" || state.Cursors["h1:4243"].Seq != 3 {
+		t.Fatalf("unexpected state %+v", state)
+	}
+}
+
+func TestFileStoreRejectsCorruptSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	os.WriteFile(path, []byte(`{"Time":`), 0600)
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Load(); err == nil {
+		t.Fatal("expected corrupt snapshot to be an error")
+	}
+}
+
+func TestOpenUnknownDriver(t *testing.T) {
+	if _, err := Open("etcd://127.0.0.1:2379/beege"); err == nil {
+		t.Fatal("expected unknown driver to be rejected")
+	}
+	if err := Register("file", NewFileStore); err == nil {
+		t.Fatal("expected driver not to be overwritten")
+	}
+}
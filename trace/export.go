@@ -0,0 +1,274 @@
+package trace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// 等待导出的span数，导出跟不上时丢弃
+	queueSize = 4096
+	// 每批导出的最大span数
+	batchSize = 256
+	// 导出间隔
+	flushInterval = time.Second
+)
+
+type exporter interface {
+	export(spans []*Span) error
+	close() error
+}
+
+var (
+	queue chan *Span
+	// 通知导出协程退出，退出后关闭stopped
+	stop, stopped chan bool
+	// 资源属性，标识产生span的节点
+	serviceName     = "beegecluster"
+	serviceInstance string
+)
+
+// 设置导出目标：file://路径写入json行，http(s)://地址以OTLP/HTTP json格式发往collector，
+// 为空时不导出
+func Init(target, instance string) error {
+	if target == "" {
+		return nil
+	}
+	serviceInstance = instance
+
+	var (
+		e   exporter
+		err error
+	)
+	switch {
+	case strings.HasPrefix(target, "file://"):
+		e, err = newFileExporter(strings.TrimPrefix(target, "file://"))
+	case strings.HasPrefix(target, "http://"), strings.HasPrefix(target, "https://"):
+		e = &collectorExporter{url: target, client: &http.Client{Timeout: 5 * time.Second}}
+	default:
+		err = fmt.Errorf("Bad parameter: unknown trace export %s", target)
+	}
+	if err != nil {
+		return err
+	}
+
+	queue = make(chan *Span, queueSize)
+	stop, stopped = make(chan bool), make(chan bool)
+	go run(e)
+	return nil
+}
+
+// 导出剩余的span后停止，超时后直接返回
+func Close(timeout time.Duration) {
+	if queue == nil {
+		return
+	}
+	close(stop)
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+	}
+}
+
+func export(span *Span) {
+	if queue == nil {
+		return
+	}
+	select {
+	case queue <- span:
+	default:
+	}
+}
+
+func run(e exporter) {
+	defer close(stopped)
+	defer e.close()
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.export(batch); err != nil {
+			logger.Warn("Export spans error", "error", err)
+		}
+		batch = make([]*Span, 0, batchSize)
+	}
+	for {
+		select {
+		case span := <-queue:
+			batch = append(batch, span)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-stop:
+			for len(queue) > 0 {
+				if batch = append(batch, <-queue); len(batch) >= batchSize {
+					flush()
+				}
+			}
+			flush()
+			return
+		}
+	}
+}
+
+// 每个span一行json
+type fileExporter struct {
+	file   *os.File
+	writer *bufio.Writer
+}
+
+func newFileExporter(path string) (*fileExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileExporter{file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+func (this *fileExporter) export(spans []*Span) error {
+	encoder := json.NewEncoder(this.writer)
+	for _, span := range spans {
+		span.Lock()
+		err := encoder.Encode(span)
+		span.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return this.writer.Flush()
+}
+
+func (this *fileExporter) close() error {
+	this.writer.Flush()
+	return this.file.Close()
+}
+
+// 以OTLP/HTTP json格式发往collector，如http://127.0.0.1:4318/v1/traces
+type collectorExporter struct {
+	url    string
+	client *http.Client
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+func (this *collectorExporter) export(spans []*Span) error {
+	converted := make([]*otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		converted = append(converted, toOTLP(span))
+	}
+	resource := []otlpAttribute{attribute("service.name", serviceName)}
+	if serviceInstance != "" {
+		resource = append(resource, attribute("service.instance.id", serviceInstance))
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{"attributes": resource},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": serviceName},
+						"spans": converted,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	response, err := this.client.Post(this.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("collector %s returned %s", this.url, response.Status)
+	}
+	return nil
+}
+
+func (this *collectorExporter) close() error {
+	return nil
+}
+
+func toOTLP(span *Span) *otlpSpan {
+	span.Lock()
+	defer span.Unlock()
+
+	converted := &otlpSpan{
+		TraceId:           span.TraceId,
+		SpanId:            span.SpanId,
+		ParentSpanId:      span.ParentId,
+		Name:              span.Name,
+		Kind:              span.Kind,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+	}
+	if span.RequestId != "" {
+		converted.Attributes = append(converted.Attributes, attribute("request.id", span.RequestId))
+	}
+	for key, value := range span.Attributes {
+		converted.Attributes = append(converted.Attributes, attribute(key, value))
+	}
+	if span.Error != "" {
+		// STATUS_CODE_ERROR
+		converted.Status = otlpStatus{Code: 2, Message: span.Error}
+	}
+	return converted
+}
+
+func attribute(key string, value interface{}) otlpAttribute {
+	var v otlpValue
+	switch value := value.(type) {
+	case bool:
+		v.BoolValue = &value
+	case int, int64, uint64:
+		s := fmt.Sprint(value)
+		v.IntValue = &s
+	default:
+		s := fmt.Sprint(value)
+		v.StringValue = &s
+	}
+	return otlpAttribute{Key: key, Value: v}
+}
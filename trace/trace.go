@@ -0,0 +1,156 @@
+////////////////////////////////////////////////////////////
+/*      请求追踪，一个请求在controller和docker之间的各段耗时      */
+////////////////////////////////////////////////////////////
+
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hugb/beegecluster/logging"
+)
+
+var logger = logging.Logger("trace")
+
+const (
+	// 客户端可以指定请求id，响应和转发到docker的请求都带有该头
+	RequestIdHeader = "X-Request-Id"
+	// W3C Trace Context，controller之间转发时延续同一个trace
+	TraceparentHeader = "traceparent"
+
+	// 请求id的最大长度，超过时重新生成
+	maxRequestIdLength = 128
+)
+
+// span的类型，与OpenTelemetry一致
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+var traceparentPattern = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+
+type Span struct {
+	sync.Mutex
+
+	TraceId    string
+	SpanId     string
+	ParentId   string `json:",omitempty"`
+	RequestId  string `json:",omitempty"`
+	Name       string
+	Kind       int
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{} `json:",omitempty"`
+	Error      string                 `json:",omitempty"`
+
+	finished bool
+}
+
+type contextKey int
+
+const (
+	spanKey contextKey = iota
+	requestIdKey
+)
+
+// 在ctx中的span下开始一个子span，没有时开始新的trace
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	span := &Span{
+		SpanId:    newId(8),
+		Name:      name,
+		Kind:      KindInternal,
+		Start:     time.Now(),
+		RequestId: RequestId(ctx),
+	}
+	if parent := FromContext(ctx); parent != nil {
+		span.TraceId, span.ParentId = parent.TraceId, parent.SpanId
+	} else {
+		span.TraceId = newId(16)
+	}
+	return context.WithValue(ctx, spanKey, span), span
+}
+
+// 开始处理请求的span，延续traceparent指定的trace
+func StartRemote(ctx context.Context, name, traceparent string) (context.Context, *Span) {
+	ctx, span := Start(ctx, name)
+	span.Kind = KindServer
+	match := traceparentPattern.FindStringSubmatch(strings.ToLower(traceparent))
+	if match != nil && span.ParentId == "" {
+		span.TraceId, span.ParentId = match[1], match[2]
+	}
+	return ctx, span
+}
+
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey).(*Span)
+	return span
+}
+
+func (this *Span) SetAttribute(key string, value interface{}) {
+	this.Lock()
+	defer this.Unlock()
+
+	if this.Attributes == nil {
+		this.Attributes = make(map[string]interface{})
+	}
+	this.Attributes[key] = value
+}
+
+// 结束span并导出，err不为空时标记为失败；重复调用只生效一次
+func (this *Span) Finish(err error) {
+	this.Lock()
+	if this.finished {
+		this.Unlock()
+		return
+	}
+	this.finished = true
+	this.End = time.Now()
+	if err != nil {
+		this.Error = err.Error()
+	}
+	this.Unlock()
+
+	export(this)
+}
+
+// W3C traceparent头，下游据此延续trace
+func (this *Span) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", this.TraceId, this.SpanId)
+}
+
+// 请求id随ctx传递，之后开始的span都会记录
+func WithRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdKey, id)
+}
+
+func RequestId(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey).(string)
+	return id
+}
+
+// 使用客户端指定的请求id，不合法时生成新的
+func NormalizeRequestId(id string) string {
+	id = strings.TrimSpace(id)
+	if id == "" || len(id) > maxRequestIdLength || strings.ContainsAny(id, "\r\n\"") {
+		return newId(16)
+	}
+	return id
+}
+
+func newId(size int) string {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		// 随机数不可用时以时间代替，id不能全为0
+		copy(b, fmt.Sprintf("%0*x", size, time.Now().UnixNano()))
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,168 @@
+package trace
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 导出到文件，返回读取已导出span的函数
+func exportToFile(t *testing.T) func() []*Span {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	if err := Init("file://"+path, "c1:4244"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		Close(time.Second)
+		queue = nil
+	})
+	return func() []*Span {
+		Close(time.Second)
+		queue = nil
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		var spans []*Span
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			span := &Span{}
+			if err := json.Unmarshal(scanner.Bytes(), span); err != nil {
+				t.Fatal(err)
+			}
+			spans = append(spans, span)
+		}
+		return spans
+	}
+}
+
+func TestStartChildSpan(t *testing.T) {
+	ctx := WithRequestId(context.Background(), "req-1")
+	ctx, parent := Start(ctx, "parent")
+	if len(parent.TraceId) != 32 || len(parent.SpanId) != 16 || parent.ParentId != "" {
+		t.Fatalf("unexpected root span %+v", parent)
+	}
+	_, child := Start(ctx, "child")
+	if child.TraceId != parent.TraceId || child.ParentId != parent.SpanId || child.RequestId != "req-1" {
+		t.Fatalf("expected child of the span in ctx, got %+v", child)
+	}
+	if FromContext(context.Background()) != nil {
+		t.Fatal("expected no span in empty ctx")
+	}
+}
+
+func TestStartRemoteContinuesTraceparent(t *testing.T) {
+	traceId, spanId := strings.Repeat("ab", 16), strings.Repeat("cd", 8)
+	_, span := StartRemote(context.Background(), "GET /info", "00-"+strings.ToUpper(traceId)+"-"+spanId+"-01")
+	if span.Kind != KindServer || span.TraceId != traceId || span.ParentId != spanId {
+		t.Fatalf("expected remote trace to be continued, got %+v", span)
+	}
+	if span.Traceparent() != "00-"+traceId+"-"+span.SpanId+"-01" {
+		t.Fatalf("unexpected traceparent %s", span.Traceparent())
+	}
+
+	// 格式不对时开始新的trace
+	for _, traceparent := range []string{"", "01-" + traceId + "-" + spanId + "-01", "00-" + traceId + "-" + spanId} {
+		_, span = StartRemote(context.Background(), "GET /info", traceparent)
+		if span.TraceId == traceId || span.ParentId != "" {
+			t.Fatalf("expected %q to be ignored, got %+v", traceparent, span)
+		}
+	}
+}
+
+func TestNormalizeRequestId(t *testing.T) {
+	if id := NormalizeRequestId(" req-1 "); id != "req-1" {
+		t.Fatalf("expected client request id to be kept, got %q", id)
+	}
+	for _, id := range []string{"", "  ", strings.Repeat("a", maxRequestIdLength+1), "a\r\nSet-Cookie: x", `a"b`} {
+		if normalized := NormalizeRequestId(id); normalized == id || len(normalized) != 32 {
+			t.Fatalf("expected %q to be replaced, got %q", id, normalized)
+		}
+	}
+}
+
+func TestFinishExportsOnce(t *testing.T) {
+	read := exportToFile(t)
+
+	_, span := Start(context.Background(), "forward")
+	span.SetAttribute("docker", "h1:4243")
+	span.Finish(errors.New("connection refused"))
+	span.Finish(nil)
+
+	spans := read()
+	if len(spans) != 1 {
+		t.Fatalf("expected span to be exported once, got %d", len(spans))
+	}
+	if spans[0].SpanId != span.SpanId || spans[0].Error != "connection refused" || spans[0].Attributes["docker"] != "h1:4243" {
+		t.Fatalf("unexpected exported span %+v", spans[0])
+	}
+	if spans[0].End.Before(spans[0].Start) {
+		t.Fatal("expected span to end after it started")
+	}
+}
+
+func TestInitRejectsUnknownTarget(t *testing.T) {
+	if err := Init("udp://127.0.0.1:4317", ""); err == nil || !strings.HasPrefix(err.Error(), "Bad parameter") {
+		t.Fatalf("expected unknown target to be rejected, got %v", err)
+	}
+	if err := Init("", ""); err != nil || queue != nil {
+		t.Fatal("expected empty target to disable export")
+	}
+}
+
+func TestCollectorExporterSendsOTLP(t *testing.T) {
+	received := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		payload := make(map[string]interface{})
+		json.Unmarshal(body, &payload)
+		received <- payload
+	}))
+	defer server.Close()
+
+	ctx := WithRequestId(context.Background(), "req-1")
+	_, span := Start(ctx, "forward")
+	span.SetAttribute("retry", 2)
+	span.Finish(errors.New("timeout"))
+
+	e := &collectorExporter{url: server.URL, client: server.Client()}
+	if err := e.export([]*Span{span}); err != nil {
+		t.Fatal(err)
+	}
+	payload := <-received
+	scope := payload["resourceSpans"].([]interface{})[0].(map[string]interface{})["scopeSpans"].([]interface{})[0]
+	exported := scope.(map[string]interface{})["spans"].([]interface{})[0].(map[string]interface{})
+	if exported["traceId"] != span.TraceId || exported["spanId"] != span.SpanId {
+		t.Fatalf("unexpected span %v", exported)
+	}
+	if status := exported["status"].(map[string]interface{}); status["code"] != float64(2) || status["message"] != "timeout" {
+		t.Fatalf("expected failed span to have error status, got %v", status)
+	}
+	attributes := make(map[string]interface{})
+	for _, a := range exported["attributes"].([]interface{}) {
+		a := a.(map[string]interface{})
+		attributes[a["key"].(string)] = a["value"]
+	}
+	if attributes["request.id"].(map[string]interface{})["stringValue"] != "req-1" || attributes["retry"].(map[string]interface{})["intValue"] != "2" {
+		t.Fatalf("unexpected attributes %v", attributes)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer failing.Close()
+	e = &collectorExporter{url: failing.URL, client: failing.Client()}
+	if err := e.export([]*Span{span}); err == nil {
+		t.Fatal("expected collector error to be returned")
+	}
+}
@@ -2,9 +2,15 @@ package utils
 
 import (
 	"net/http"
+	"runtime"
+	"strconv"
 	"strings"
+
+	"github.com/hugb/beegecluster/logging"
 )
 
+var logger = logging.Logger("utils")
+
 func GetHostFromQueryParam(r *http.Request) string {
 	if r == nil {
 		return ""
@@ -15,3 +21,39 @@ func GetHostFromQueryParam(r *http.Request) string {
 		return r.Form.Get("host")
 	}
 }
+
+// 比较"1.10"格式的版本号，a小于、等于、大于b时分别返回-1、0、1
+func CompareVersions(a, b string) int {
+	partsA := strings.Split(a, ".")
+	partsB := strings.Split(b, ".")
+	for i := 0; i < len(partsA) || i < len(partsB); i++ {
+		var numA, numB int
+		if i < len(partsA) {
+			numA, _ = strconv.Atoi(partsA[i])
+		}
+		if i < len(partsB) {
+			numB, _ = strconv.Atoi(partsB[i])
+		}
+		if numA < numB {
+			return -1
+		}
+		if numA > numB {
+			return 1
+		}
+	}
+	return 0
+}
+
+// 输出所有goroutine的调用栈，用于排查问题
+func DumpStacks() {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	logger.Info("Goroutine stack dump", "stacks", string(buf))
+}
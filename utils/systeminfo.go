@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"io"
 	"io/ioutil"
+	"runtime"
 	"strconv"
 	"strings"
 	"syscall"
@@ -168,7 +169,8 @@ func GetSwap() (*Swap, error) {
 }
 
 type SystemInfo struct {
-	Cpu float64
+	Cpu  float64
+	NCPU int
 
 	Mem  *Mem
 	Swap *Swap
@@ -180,6 +182,7 @@ func GetSystemInfo() (*SystemInfo, error) {
 	var err error
 	systemInfo := &SystemInfo{}
 	systemInfo.Cpu = GetCpuUsage()
+	systemInfo.NCPU = runtime.NumCPU()
 	systemInfo.Mem, err = GetMem()
 	if err != nil {
 		return systemInfo, err
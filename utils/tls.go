@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/hugb/beegecluster/config"
+	"github.com/hugb/beegecluster/gossip"
+)
+
+// 当前使用的证书和CA，SIGHUP时重新加载
+var credentials = struct {
+	sync.RWMutex
+	cert *tls.Certificate
+	pool *x509.CertPool
+}{}
+
+// 是否以https提供服务
+func TLSEnabled() bool {
+	return config.Get().TLS.Cert != "" || config.Get().TLS.Verify
+}
+
+// 按当前配置加载证书和CA，失败时保留原有的证书
+func ReloadCertificates() error {
+	apply, err := LoadCertificates(&config.Get().TLS)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// 读取证书和CA，调用返回的函数后替换当前使用的证书
+func LoadCertificates(c *config.TLSConfig) (func(), error) {
+	if c.Cert == "" && !c.Verify {
+		return func() {}, nil
+	}
+	if c.Verify && c.CACert == "" {
+		return nil, fmt.Errorf("Bad parameter: tlsverify requires tlscacert")
+	}
+	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return nil, err
+	}
+	var pool *x509.CertPool
+	if c.CACert != "" {
+		content, err := ioutil.ReadFile(c.CACert)
+		if err != nil {
+			return nil, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("No certificate found in %s", c.CACert)
+		}
+	}
+
+	return func() {
+		credentials.Lock()
+		credentials.cert, credentials.pool = &cert, pool
+		credentials.Unlock()
+
+		logger.Info("Loaded certificate", "cert", c.Cert)
+	}, nil
+}
+
+func currentCredentials() (*tls.Certificate, *x509.CertPool) {
+	credentials.RLock()
+	defer credentials.RUnlock()
+
+	return credentials.cert, credentials.pool
+}
+
+// 服务端配置，与dockerd的--tlsverify相同，开启验证时要求客户端证书由CA签发
+func ServerTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := currentCredentials()
+			// 证书尚未加载或加载失败时拒绝握手
+			if cert == nil {
+				return nil, fmt.Errorf("Unavailable: no server certificate loaded")
+			}
+			c := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+			}
+			if config.Get().TLS.Verify {
+				c.ClientCAs = pool
+				c.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return c, nil
+		},
+	}
+}
+
+// 连接docker和其他controller时的配置，使用本机证书作为客户端证书，
+// 每次连接时用当前的CA验证对端，重新加载后立即生效
+func ClientTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return fmt.Errorf("No certificate provided by %s", state.ServerName)
+			}
+			_, pool := currentCredentials()
+			options := x509.VerifyOptions{
+				Roots:         pool,
+				DNSName:       state.ServerName,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range state.PeerCertificates[1:] {
+				options.Intermediates.AddCert(cert)
+			}
+			_, err := state.PeerCertificates[0].Verify(options)
+			return err
+		},
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := currentCredentials()
+			if cert == nil {
+				return &tls.Certificate{}, nil
+			}
+			return cert, nil
+		},
+	}
+}
+
+// 后端是否使用https：docker通过tls标签声明，其他controller与本机配置相同
+func UpstreamTLS(host string) bool {
+	if config.Get().TLS.Nodes {
+		return true
+	}
+	if gossip.Members != nil {
+		if member, ok := gossip.Members.Lookup(host); ok && member.Role == config.DockerRoleName {
+			return member.Labels[config.TLSLabel] == "true"
+		}
+	}
+	return TLSEnabled()
+}
+
+func UpstreamScheme(host string) string {
+	if UpstreamTLS(host) {
+		return "https"
+	}
+	return "http"
+}
+
+// docker远程api的地址
+func DockerURL(host, path string) string {
+	return fmt.Sprintf("%s://%s%s", UpstreamScheme(host), host, path)
+}
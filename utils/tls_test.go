@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hugb/beegecluster/config"
+)
+
+// 生成自签名证书，返回证书和私钥文件
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func resetCredentials(t *testing.T) {
+	credentials.Lock()
+	credentials.cert, credentials.pool = nil, nil
+	credentials.Unlock()
+	t.Cleanup(func() {
+		credentials.Lock()
+		credentials.cert, credentials.pool = nil, nil
+		credentials.Unlock()
+	})
+}
+
+func TestServerTLSConfigWithoutCertificate(t *testing.T) {
+	resetCredentials(t)
+	if _, err := ServerTLSConfig().GetConfigForClient(&tls.ClientHelloInfo{}); err == nil {
+		t.Fatal("expected handshake without certificate to fail")
+	}
+}
+
+func TestServerTLSConfigUsesLoadedCertificate(t *testing.T) {
+	resetCredentials(t)
+	certFile, keyFile := writeCertificate(t, t.TempDir())
+
+	apply, err := LoadCertificates(&config.TLSConfig{Cert: certFile, Key: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	apply()
+	c, err := ServerTLSConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil || len(c.Certificates) != 1 {
+		t.Fatalf("expected loaded certificate to be used, got %v", err)
+	}
+}
+
+func TestLoadCertificatesKeepsCurrentOnError(t *testing.T) {
+	resetCredentials(t)
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir)
+
+	if _, err := LoadCertificates(&config.TLSConfig{Cert: certFile, Key: keyFile, Verify: true}); err == nil {
+		t.Fatal("expected tlsverify without CA to be rejected")
+	}
+	if _, err := LoadCertificates(&config.TLSConfig{Cert: certFile, Key: filepath.Join(dir, "missing.pem")}); err == nil {
+		t.Fatal("expected missing key to be rejected")
+	}
+	if cert, _ := currentCredentials(); cert != nil {
+		t.Fatal("expected failed loads not to replace the certificate")
+	}
+}